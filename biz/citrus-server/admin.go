@@ -0,0 +1,305 @@
+package citrus_server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+// AdminClientInfo describes a client to administrators.
+type AdminClientInfo struct {
+	SecureId       ClientSecureId      `json:"secureId"`
+	InsecureId     ClientInsecureId    `json:"insecureId"`
+	Type           string              `json:"type"`
+	Metadata       *ClientMetadata     `json:"metadata,omitempty"`
+	APIKey         string              `json:"apiKey,omitempty"`
+	RemoteIPHash   string              `json:"remoteIpHash,omitempty"`
+	Connected      bool                `json:"connected"`
+	ConnectedSince *time.Time          `json:"connectedSince,omitempty"`
+	LastSeen       *time.Time          `json:"lastSeen,omitempty"`
+	Bindings       []AdminBindingInfo  `json:"bindings"`
+	Strength       *DataReportStrength `json:"strength,omitempty"`
+}
+
+// AdminBindingInfo describes a binding of a client to administrators.
+type AdminBindingInfo struct {
+	PeerId ClientSecureId `json:"peerId"`
+	Scope  BindingScope   `json:"scope"`
+}
+
+// AdminAuth is a middleware requiring the admin credentials with HTTP basic authentication, the admin API is disabled
+// if no admin password is configured.
+func AdminAuth(ctx context.Context, c *app.RequestContext) {
+	if config.Conf.AdminPassword == "" {
+		failWithStatus(ctx, c, http.StatusNotFound, "AdminAuth", "The admin API is disabled on this server")
+		c.Abort()
+		return
+	}
+	username, password, ok := parseBasicAuth(string(c.GetHeader("Authorization")))
+	usernameOk := subtle.ConstantTimeCompare([]byte(username), []byte(config.Conf.AdminUsername)) == 1
+	passwordOk := subtle.ConstantTimeCompare([]byte(password), []byte(config.Conf.AdminPassword)) == 1
+	if !ok || !usernameOk || !passwordOk {
+		c.Response.Header.Set("WWW-Authenticate", `Basic realm="DG-citrus admin", charset="UTF-8"`)
+		failWithStatus(ctx, c, http.StatusUnauthorized, "AdminAuth", fmt.Sprintf("Invalid admin credentials from %s", c.ClientIP()))
+		c.Abort()
+		return
+	}
+	if !c.IsGet() && !c.IsHead() {
+		if err := checkAdminOrigin(c); err != nil {
+			failWithStatus(ctx, c, http.StatusForbidden, "AdminAuth", err.Error())
+			c.Abort()
+			return
+		}
+	}
+	c.Next(ctx)
+}
+
+// parseBasicAuth parses the value of an Authorization header with HTTP basic authentication.
+func parseBasicAuth(header string) (string, string, bool) {
+	req := http.Request{Header: http.Header{"Authorization": {header}}}
+	return req.BasicAuth()
+}
+
+// AdminClients lists all clients along with their bindings.
+func AdminClients(ctx context.Context, c *app.RequestContext) {
+	c.JSON(http.StatusOK, map[string]interface{}{"code": 200, "message": "success", "clients": citrusServer.listClients()})
+}
+
+// AdminPurgeClient disconnects a client and removes it along with its bindings, its peers are notified with a break
+// message.
+func AdminPurgeClient(ctx context.Context, c *app.RequestContext) {
+	secureId := ClientSecureId(c.Param("id"))
+	if err := citrusServer.forcePurgeClient(ctx, secureId); err != nil {
+		failWithStatus(ctx, c, http.StatusNotFound, "AdminPurgeClient", err.Error())
+		return
+	}
+	auditLog.InfoContext(ctx, "Admin purged client", "clientId", secureId, "remoteIp", c.ClientIP())
+	c.JSON(http.StatusOK, map[string]interface{}{"code": 200, "message": "success"})
+}
+
+// AdminBreakBinding breaks the binding between a client and one of its peers, both are notified with a break message.
+func AdminBreakBinding(ctx context.Context, c *app.RequestContext) {
+	secureId, peerId := ClientSecureId(c.Param("id")), ClientSecureId(c.Param("peerId"))
+	if err := citrusServer.breakBinding(ctx, secureId, peerId); err != nil {
+		failWithStatus(ctx, c, http.StatusNotFound, "AdminBreakBinding", err.Error())
+		return
+	}
+	auditLog.InfoContext(ctx, "Admin broke binding", "clientId", secureId, "peerId", peerId, "remoteIp", c.ClientIP())
+	c.JSON(http.StatusOK, map[string]interface{}{"code": 200, "message": "success"})
+}
+
+// AdminStopDevice sends a panic stop to a DG-LAB app, which clears the pulses of both channels and sets their strength
+// to 0.
+func AdminStopDevice(ctx context.Context, c *app.RequestContext) {
+	appId := ClientSecureId(c.Param("id"))
+	if err := citrusServer.stopDevice(ctx, appId); err != nil {
+		fail(ctx, c, "AdminStopDevice", err.Error())
+		return
+	}
+	auditLog.InfoContext(ctx, "Admin stopped DG-LAB app", "appId", appId, "remoteIp", c.ClientIP())
+	c.JSON(http.StatusOK, map[string]interface{}{"code": 200, "message": "success"})
+}
+
+// AdminSettings returns the settings which can be changed at runtime, they are changed by posting the new values as
+// form or query parameters. Changes are not written back to the config file.
+func AdminSettings(ctx context.Context, c *app.RequestContext) {
+	if c.IsPost() {
+		if value := string(c.FormValue("allowInsecureClientId")); value != "" {
+			allow, err := strconv.ParseBool(value)
+			if err != nil {
+				fail(ctx, c, "AdminSettings", fmt.Sprintf("allowInsecureClientId must be a boolean, got %q", value))
+				return
+			}
+			citrusServer.allowInsecureClientId.Store(allow)
+			auditLog.InfoContext(ctx, "Admin changed setting", "setting", "allowInsecureClientId", "value", allow, "remoteIp", c.ClientIP())
+		}
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code":                  200,
+		"message":               "success",
+		"allowInsecureClientId": citrusServer.insecureClientIdAllowed(),
+	})
+}
+
+// listClients describes all clients to administrators.
+func (server *CitrusServer) listClients() []AdminClientInfo {
+	server.clients.mutex.RLock()
+	defer server.clients.mutex.RUnlock()
+
+	clients := make([]AdminClientInfo, 0, len(server.clients.secureMapping))
+	for _, client := range server.clients.secureMapping {
+		info := AdminClientInfo{
+			SecureId:     client.secureId,
+			InsecureId:   client.insecureId,
+			Type:         clientTypeLabels[client.typ],
+			Metadata:     client.metadata,
+			APIKey:       client.apiKeyName,
+			RemoteIPHash: client.remoteIPHash,
+			Connected:    client.typ == ClientTypeThirdPartyHTTP || client.conn != nil,
+			Bindings:     make([]AdminBindingInfo, 0, len(client.bindings)),
+		}
+		if info.Connected && !client.connectedAt.IsZero() {
+			connectedSince := client.connectedAt
+			info.ConnectedSince = &connectedSince
+		}
+		if lastSeen := client.lastSeen.Load(); lastSeen != 0 {
+			lastSeenTime := time.Unix(0, lastSeen)
+			info.LastSeen = &lastSeenTime
+		}
+		for peerId, scope := range client.bindings {
+			info.Bindings = append(info.Bindings, AdminBindingInfo{PeerId: peerId, Scope: scope})
+		}
+		sort.Slice(info.Bindings, func(i, j int) bool {
+			return info.Bindings[i].PeerId < info.Bindings[j].PeerId
+		})
+		if client.strength != nil {
+			strength := *client.strength
+			info.Strength = &strength
+		}
+		clients = append(clients, info)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Type != clients[j].Type {
+			return clients[i].Type < clients[j].Type
+		}
+		return clients[i].SecureId < clients[j].SecureId
+	})
+	return clients
+}
+
+// forcePurgeClient is the same as purgeClient, but also closes the connection of a websocket client.
+func (server *CitrusServer) forcePurgeClient(ctx context.Context, secureId ClientSecureId) error {
+	server.clients.mutex.Lock()
+	client, ok := server.clients.secureMapping[secureId]
+	if !ok {
+		server.clients.mutex.Unlock()
+		return fmt.Errorf("forcePurgeClient: Client with secure ID %s not found", secureId)
+	}
+	if client.purgeTimer != nil {
+		client.purgeTimer.Stop()
+		client.purgeTimer = nil
+	}
+	// detaching the client first keeps detachClient from scheduling another purge once the connection is closed
+	conn := client.conn
+	client.conn = nil
+	server.clients.mutex.Unlock()
+
+	if conn != nil {
+		closeConn(conn, "removed by an administrator")
+	}
+	server.purgeClient(ctx, secureId)
+
+	// the apps bound with a binding code of a removed third party client have nothing to bind to when they resume
+	server.clients.mutex.Lock()
+	for _, app := range server.clients.secureMapping {
+		if app.bindingCodeOwner == secureId {
+			app.forgetBindingCodeOwnerLocked()
+		}
+	}
+	server.clients.mutex.Unlock()
+	server.persist()
+	return nil
+}
+
+// breakBinding unbinds two clients, and notifies those which are connected.
+func (server *CitrusServer) breakBinding(ctx context.Context, secureId ClientSecureId, peerId ClientSecureId) error {
+	defer server.persist()
+	server.clients.mutex.Lock()
+
+	client, ok := server.clients.secureMapping[secureId]
+	if !ok {
+		server.clients.mutex.Unlock()
+		return fmt.Errorf("breakBinding: Client with secure ID %s not found", secureId)
+	}
+	if _, ok := client.bindings[peerId]; !ok {
+		server.clients.mutex.Unlock()
+		return fmt.Errorf("breakBinding: Client with secure ID %s is not bound to %s", secureId, peerId)
+	}
+	delete(client.bindings, peerId)
+	peer, ok := server.clients.secureMapping[peerId]
+	if ok {
+		delete(peer.bindings, secureId)
+	}
+	appId, thirdPartyId, app := secureId, peerId, client
+	if client.typ != ClientTypeDGApp {
+		appId, thirdPartyId, app = peerId, secureId, peer
+	}
+	// the app would bind again with its binding code when it resumes otherwise, undoing the break
+	var appBindingCode string
+	if app != nil && app.bindingCodeOwner == thirdPartyId {
+		appBindingCode = app.bindingCode
+		app.forgetBindingCodeOwnerLocked()
+	}
+	notify := make([]ClientSecureId, 0, 2)
+	for _, notified := range []*CitrusClient{client, peer} {
+		if notified != nil && notified.conn != nil {
+			notify = append(notify, notified.secureId)
+		}
+	}
+	server.clients.mutex.Unlock()
+
+	adminLog.InfoContext(ctx, "Unbound DG App client from Third Party client", "appId", appId, "thirdPartyId", thirdPartyId)
+	for _, id := range notify {
+		event := &EventBreak{ClientId: thirdPartyId, TargetId: appId}
+		if id == appId && appBindingCode != "" {
+			// the app only knows the third party client by the binding code, which sendEvent no longer replaces
+			event.ClientId = ClientSecureId(appBindingCode)
+		}
+		err := server.sendEvent(ctx, id, event)
+		if err != nil {
+			adminLog.ErrorContext(ctx, "Failed to notify client of the broken binding", "clientId", id, "error", err)
+		}
+	}
+	return nil
+}
+
+// stopDevice clears the pulses of both channels of a DG-LAB app and sets their strength to 0. The commands are sent on
+// behalf of a third party client the app is bound to, as the app ignores commands from other clients.
+func (server *CitrusServer) stopDevice(ctx context.Context, appId ClientSecureId) error {
+	server.clients.mutex.RLock()
+	app, ok := server.clients.secureMapping[appId]
+	if !ok || app.typ != ClientTypeDGApp {
+		server.clients.mutex.RUnlock()
+		return fmt.Errorf("stopDevice: DG App client with secure ID %s not found", appId)
+	}
+	binding := Binding{peer: app}
+	if app.strength != nil {
+		strength := *app.strength
+		binding.peerStrength = &strength
+	}
+	controllerId := app.bindingCodeOwner
+	if _, ok := app.bindings[controllerId]; !ok {
+		controllerId = ""
+		for peerId := range app.bindings {
+			controllerId = peerId
+			break
+		}
+	}
+	server.clients.mutex.RUnlock()
+
+	events := make([]Event, 0, 4)
+	for _, channel := range []Channel{ChannelA, ChannelB} {
+		events = append(events,
+			&EventStopPulse{ClientId: controllerId, TargetId: appId, Channel: channel},
+			&EventAdjustStrength{ClientId: controllerId, TargetId: appId, Strength: DataAdjustStrength{Channel: channel, Type: AdjustStrengthTypeSet, Value: 0}},
+		)
+	}
+	for _, event := range events {
+		if err := server.sendEvent(ctx, appId, event); err != nil {
+			return fmt.Errorf("stopDevice: %v", err)
+		}
+		server.auditCommand(ctx, "", binding, event)
+		if adjust, ok := event.(*EventAdjustStrength); ok && binding.peerStrength != nil {
+			strength := adjust.Strength.apply(*binding.peerStrength)
+			binding.peerStrength = &strength
+		}
+	}
+	return nil
+}
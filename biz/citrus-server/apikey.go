@@ -0,0 +1,145 @@
+package citrus_server
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+type APIKeyScope string
+
+const (
+	// APIKeyScopeHTTP allows registering third party HTTP clients via /v1/register
+	APIKeyScopeHTTP APIKeyScope = "http"
+	// APIKeyScopeWS allows connecting third party websocket clients via /v1/ws
+	APIKeyScopeWS APIKeyScope = "ws"
+)
+
+var (
+	errAPIKeyRequired     = errors.New("an API key is required")
+	errAPIKeyInvalid      = errors.New("invalid API key")
+	errAPIKeyClientLimit  = errors.New("the API key has reached its limit of clients")
+	errAPIKeyBindingLimit = errors.New("the API key has reached its limit of bindings")
+)
+
+// initAPIKeys checks the configured API keys.
+func initAPIKeys() error {
+	names := make(map[string]bool)
+	for _, key := range config.Conf.APIKeys {
+		if key.Name == "" || key.Key == "" {
+			return fmt.Errorf("initAPIKeys: API keys must have a name and a key")
+		}
+		if names[key.Name] {
+			return fmt.Errorf("initAPIKeys: duplicate API key name %q", key.Name)
+		}
+		names[key.Name] = true
+		for _, scope := range key.Scopes {
+			if APIKeyScope(scope) != APIKeyScopeHTTP && APIKeyScope(scope) != APIKeyScopeWS {
+				return fmt.Errorf("initAPIKeys: API key %q has unknown scope %q", key.Name, scope)
+			}
+		}
+	}
+	return nil
+}
+
+// authenticateAPIKey returns the API key given in the X-API-Key header or the apiKey query parameter of a request, if it
+// allows the given scope. It returns nil without an error if no API keys are configured.
+func authenticateAPIKey(c *app.RequestContext, scope APIKeyScope) (*config.APIKey, error) {
+	if len(config.Conf.APIKeys) == 0 {
+		return nil, nil
+	}
+	given := string(c.GetHeader("X-API-Key"))
+	if given == "" {
+		given = c.Query("apiKey")
+	}
+	if given == "" {
+		return nil, errAPIKeyRequired
+	}
+	var found *config.APIKey
+	for i := range config.Conf.APIKeys {
+		// compare with every key in constant time, so that the response time does not reveal which key almost matched
+		if subtle.ConstantTimeCompare([]byte(config.Conf.APIKeys[i].Key), []byte(given)) == 1 {
+			found = &config.Conf.APIKeys[i]
+		}
+	}
+	if found == nil {
+		return nil, errAPIKeyInvalid
+	}
+	if !apiKeyHasScope(found, scope) {
+		return nil, fmt.Errorf("API key %q is not allowed to register %s clients", found.Name, scope)
+	}
+	return found, nil
+}
+
+func apiKeyHasScope(key *config.APIKey, scope APIKeyScope) bool {
+	if len(key.Scopes) == 0 {
+		return true
+	}
+	for _, s := range key.Scopes {
+		if APIKeyScope(s) == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// getAPIKey returns the configured API key with the given name, or nil if it does not exist, e.g. after it has been
+// removed from the config while clients registered with it were kept in the state file.
+func getAPIKey(name string) *config.APIKey {
+	for i := range config.Conf.APIKeys {
+		if config.Conf.APIKeys[i].Name == name {
+			return &config.Conf.APIKeys[i]
+		}
+	}
+	return nil
+}
+
+// checkAPIKeyClientLimit checks whether another client can be registered with the given API key.
+func (server *CitrusServer) checkAPIKeyClientLimit(key *config.APIKey) error {
+	server.clients.mutex.RLock()
+	defer server.clients.mutex.RUnlock()
+
+	return server.checkAPIKeyClientLimitLocked(key)
+}
+
+// checkAPIKeyClientLimitLocked is the same as checkAPIKeyClientLimit, but expects the caller to hold the clients lock.
+func (server *CitrusServer) checkAPIKeyClientLimitLocked(key *config.APIKey) error {
+	if key == nil || key.MaxClients == 0 {
+		return nil
+	}
+	count := 0
+	for _, client := range server.clients.secureMapping {
+		if client.apiKeyName == key.Name {
+			count++
+		}
+	}
+	if count >= key.MaxClients {
+		return fmt.Errorf("checkAPIKeyClientLimit: API key %q: %w", key.Name, errAPIKeyClientLimit)
+	}
+	return nil
+}
+
+// checkAPIKeyBindingLimitLocked checks whether a client registered with the given API key can be bound to another
+// DG-LAB app, it expects the caller to hold the clients lock.
+func (server *CitrusServer) checkAPIKeyBindingLimitLocked(apiKeyName string) error {
+	if apiKeyName == "" {
+		return nil
+	}
+	key := getAPIKey(apiKeyName)
+	if key == nil || key.MaxBindings == 0 {
+		return nil
+	}
+	count := 0
+	for _, client := range server.clients.secureMapping {
+		if client.apiKeyName == apiKeyName {
+			count += len(client.bindings)
+		}
+	}
+	if count >= key.MaxBindings {
+		return fmt.Errorf("checkAPIKeyBindingLimit: API key %q: %w", key.Name, errAPIKeyBindingLimit)
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package citrus_server
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/json"
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+const (
+	// defaultAuditQueryLimit and maxAuditQueryLimit are the number of the latest matching entries returned by a query
+	defaultAuditQueryLimit = 1000
+	maxAuditQueryLimit     = 10000
+)
+
+// AuditEntry records a command forwarded to a DG-LAB app, so that its owner can find out who did what.
+type AuditEntry struct {
+	Time  time.Time      `json:"time"`
+	AppId ClientSecureId `json:"appId"`
+	// ControllerId is the third party client which sent the command, it is empty if an administrator sent it
+	ControllerId   ClientSecureId `json:"controllerId,omitempty"`
+	ControllerName string         `json:"controllerName,omitempty"`
+	APIKey         string         `json:"apiKey,omitempty"`
+	Admin          bool           `json:"admin,omitempty"`
+	// Kind is the kind of the command, strength_adjust, pulse or clear, and Message is the command as it was forwarded
+	Kind          string `json:"kind"`
+	Message       string `json:"message"`
+	CorrelationId string `json:"correlationId,omitempty"`
+	// Strength is the strength the app has after the command, based on the strength it has last reported, it is nil
+	// if the app has not reported its strength yet
+	Strength *DataReportStrength `json:"strength,omitempty"`
+}
+
+// AuditFilter selects audit entries, empty fields match all entries.
+type AuditFilter struct {
+	AppId ClientSecureId
+	Since time.Time
+	Until time.Time
+	// Limit is the number of the latest matching entries returned
+	Limit int
+}
+
+func (f *AuditFilter) matches(entry *AuditEntry) bool {
+	if f.AppId != "" && entry.AppId != f.AppId {
+		return false
+	}
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditStore keeps the audit log of commands forwarded to DG-LAB apps, entries can only be appended.
+type AuditStore interface {
+	Append(entry *AuditEntry) error
+	// Query returns the matching entries from the oldest to the newest.
+	Query(filter AuditFilter) ([]AuditEntry, error)
+	Close() error
+}
+
+// fileAuditStore is an AuditStore which appends entries to a JSON lines file. Once the file reaches its maximum size,
+// it is renamed to <path>.1, the previous <path>.1 to <path>.2 and so on, and the oldest file is dropped.
+type fileAuditStore struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	mutex    sync.Mutex
+}
+
+func NewFileAuditStore(path string, maxSize int64, maxFiles int) (AuditStore, error) {
+	s := &fileAuditStore{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileAuditStore) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *fileAuditStore) rotatedPath(n int) string {
+	return s.path + "." + strconv.Itoa(n)
+}
+
+func (s *fileAuditStore) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %v", err)
+	}
+	_ = os.Remove(s.rotatedPath(s.maxFiles))
+	for n := s.maxFiles - 1; n >= 1; n-- {
+		if err := os.Rename(s.rotatedPath(n), s.rotatedPath(n+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit log: %v", err)
+		}
+	}
+	if s.maxFiles > 0 {
+		if err := os.Rename(s.path, s.rotatedPath(1)); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %v", err)
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %v", err)
+	}
+	return s.open()
+}
+
+func (s *fileAuditStore) Append(entry *AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to serialize audit entry: %v", err)
+	}
+	data = append(data, '\n')
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("audit log is closed")
+	}
+	if s.size > 0 && s.size+int64(len(data)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return nil
+}
+
+func (s *fileAuditStore) Query(filter AuditFilter) ([]AuditEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var entries []AuditEntry
+	paths := make([]string, 0, s.maxFiles+1)
+	for n := s.maxFiles; n >= 1; n-- {
+		paths = append(paths, s.rotatedPath(n))
+	}
+	paths = append(paths, s.path)
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %v", err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry AuditEntry
+			// a line cut short by a crash is skipped
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if filter.matches(&entry) {
+				entries = append(entries, entry)
+			}
+		}
+		err = scanner.Err()
+		_ = file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %v", err)
+		}
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+	return entries, nil
+}
+
+func (s *fileAuditStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// initAuditStore opens the audit log if it is enabled.
+func (server *CitrusServer) initAuditStore() error {
+	if config.Conf.AuditLogFile == "" {
+		return nil
+	}
+	store, err := NewFileAuditStore(config.Conf.AuditLogFile, config.Conf.AuditLogMaxSize, config.Conf.AuditLogMaxFiles)
+	if err != nil {
+		return fmt.Errorf("initAuditStore: %v", err)
+	}
+	server.audit = store
+	return nil
+}
+
+// auditCommand records a command which has been forwarded to the DG-LAB app of the binding, controllerId is empty if
+// an administrator has sent it.
+func (server *CitrusServer) auditCommand(ctx context.Context, controllerId ClientSecureId, binding Binding, command Event) {
+	if server.audit == nil {
+		return
+	}
+	rawEvent, err := command.ToRawEvent()
+	if err != nil {
+		return
+	}
+	_, kind := eventLabels(command)
+	entry := &AuditEntry{
+		Time:          time.Now(),
+		AppId:         binding.peer.secureId,
+		ControllerId:  controllerId,
+		Admin:         controllerId == "",
+		Kind:          kind,
+		Message:       rawEvent.Message,
+		CorrelationId: correlationId(ctx),
+		Strength:      binding.peerStrength,
+	}
+	if controller, err := server.getClientSecure(controllerId); err == nil {
+		if controller.metadata != nil {
+			entry.ControllerName = controller.metadata.Name
+		}
+		entry.APIKey = controller.apiKeyName
+	}
+	if adjust, ok := command.(*EventAdjustStrength); ok && binding.peerStrength != nil {
+		strength := adjust.Strength.apply(*binding.peerStrength)
+		entry.Strength = &strength
+	}
+	if err := server.audit.Append(entry); err != nil {
+		auditLog.ErrorContext(ctx, "Failed to record command in the audit log", "appId", entry.AppId, "error", err)
+	}
+}
+
+// apply returns the strength a DG-LAB app has after the adjustment, the app keeps the strength of each channel between
+// 0 and its limit.
+func (adjust DataAdjustStrength) apply(strength DataReportStrength) DataReportStrength {
+	value, limit := &strength.ChannelAValue, strength.ChannelALimit
+	if adjust.Channel == ChannelB {
+		value, limit = &strength.ChannelBValue, strength.ChannelBLimit
+	} else if adjust.Channel != ChannelA {
+		return strength
+	}
+	switch adjust.Type {
+	case AdjustStrengthTypeDecrease:
+		*value -= adjust.Value
+	case AdjustStrengthTypeIncrease:
+		*value += adjust.Value
+	case AdjustStrengthTypeSet:
+		*value = adjust.Value
+	}
+	*value = min(max(*value, 0), limit)
+	return strength
+}
+
+// AdminAudit queries the audit log of commands forwarded to DG-LAB apps, filtered by the appId, since and until query
+// parameters, the times are in RFC 3339 format. The latest limit entries are returned, from the oldest to the newest.
+func AdminAudit(ctx context.Context, c *app.RequestContext) {
+	filter, ok := auditFilterFromRequest(ctx, c, "AdminAudit")
+	if !ok {
+		return
+	}
+	filter.AppId = ClientSecureId(c.Query("appId"))
+	queryAudit(ctx, c, "AdminAudit", filter, nil)
+}
+
+// HTTPAudit lets the owner of a DG-LAB app query the audit log of the commands forwarded to it, while its session
+// exists. The app is authenticated by the appId and key query parameters, its client ID and its audit key, which its
+// owner finds on the consent page list opened from the device of the app, and only its own entries are returned. The
+// secure IDs of the controllers are left out, as they are the credentials of the controllers. It takes the since,
+// until and limit parameters of AdminAudit.
+func HTTPAudit(ctx context.Context, c *app.RequestContext) {
+	appId := ClientSecureId(c.Query("appId"))
+	if appId == "" {
+		fail(ctx, c, "HTTPAudit", "No app ID provided")
+		return
+	}
+	if err := citrusServer.checkAuditKey(appId, c.Query("key")); err != nil {
+		failWithStatus(ctx, c, http.StatusForbidden, "HTTPAudit", err.Error())
+		return
+	}
+	filter, ok := auditFilterFromRequest(ctx, c, "HTTPAudit")
+	if !ok {
+		return
+	}
+	filter.AppId = appId
+	queryAudit(ctx, c, "HTTPAudit", filter, func(entry *AuditEntry) {
+		entry.ControllerId = ""
+	})
+}
+
+// checkAuditKey checks the audit key of a DG-LAB app.
+func (server *CitrusServer) checkAuditKey(appId ClientSecureId, key string) error {
+	server.clients.mutex.RLock()
+	defer server.clients.mutex.RUnlock()
+
+	app, ok := server.clients.secureMapping[appId]
+	if !ok || app.typ != ClientTypeDGApp {
+		return fmt.Errorf("checkAuditKey: DG App client with secure ID %s not found, its session may have expired", appId)
+	}
+	if app.auditKey == "" || subtle.ConstantTimeCompare([]byte(app.auditKey), []byte(key)) != 1 {
+		return fmt.Errorf("checkAuditKey: invalid audit key for DG App client with secure ID %s", appId)
+	}
+	return nil
+}
+
+// auditFilterFromRequest parses the since, until and limit query parameters of an audit query, and returns whether
+// they are valid. A request with invalid parameters has been failed.
+func auditFilterFromRequest(ctx context.Context, c *app.RequestContext, context string) (AuditFilter, bool) {
+	filter := AuditFilter{Limit: defaultAuditQueryLimit}
+	for name, value := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if query := c.Query(name); query != "" {
+			parsed, err := time.Parse(time.RFC3339, query)
+			if err != nil {
+				fail(ctx, c, context, fmt.Sprintf("%s must be a time in RFC 3339 format, e.g. 2006-01-02T15:04:05Z", name))
+				return filter, false
+			}
+			*value = parsed
+		}
+	}
+	if query := c.Query("limit"); query != "" {
+		limit, err := strconv.Atoi(query)
+		if err != nil || limit < 1 || limit > maxAuditQueryLimit {
+			fail(ctx, c, context, fmt.Sprintf("limit must be an integer between 1 and %d", maxAuditQueryLimit))
+			return filter, false
+		}
+		filter.Limit = limit
+	}
+	return filter, true
+}
+
+// queryAudit responds with the audit entries matching the filter, after passing them to redact if it is not nil.
+func queryAudit(ctx context.Context, c *app.RequestContext, context string, filter AuditFilter, redact func(entry *AuditEntry)) {
+	if citrusServer.audit == nil {
+		failWithStatus(ctx, c, http.StatusNotFound, context, "The audit log is disabled on this server")
+		return
+	}
+	entries, err := citrusServer.audit.Query(filter)
+	if err != nil {
+		failWithStatus(ctx, c, http.StatusInternalServerError, context, err.Error())
+		return
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	if redact != nil {
+		for i := range entries {
+			redact(&entries[i])
+		}
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"code": 200, "message": "success", "entries": entries})
+}
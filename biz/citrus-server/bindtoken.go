@@ -0,0 +1,152 @@
+package citrus_server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+// BindToken is a short-lived, single-use binding code put into the binding QR code in place of the secure ID of the
+// third party client, so that a leaked QR code can neither be used to control the client nor to bind to it later.
+type BindToken struct {
+	token              string
+	thirdPartyClientId ClientSecureId
+	expiresAt          time.Time
+	// requesterName is the display name given by the third party client, which is shown to the owner of the DG-LAB app
+	// when the binding needs their approval
+	requesterName string
+	// scope is the scope of the binding made with the token
+	scope BindingScope
+	// when bindings need approval, a redeemed token is kept until the binding is approved or denied, see consent.go
+	redeemed bool
+	appId    ClientSecureId
+	approved bool
+	// consentSecret is sent to the app which has redeemed the token, its owner approves or denies the binding with it
+	consentSecret string
+}
+
+type BindTokens struct {
+	tokens map[string]*BindToken
+	mutex  sync.Mutex
+}
+
+func (server *CitrusServer) newBindToken(thirdPartyClientId ClientSecureId, requesterName string, scope BindingScope) *BindToken {
+	server.bindTokens.mutex.Lock()
+	defer server.bindTokens.mutex.Unlock()
+
+	server.purgeExpiredBindTokensLocked()
+	bindToken := &BindToken{
+		token:              generateRandomHex(16),
+		thirdPartyClientId: thirdPartyClientId,
+		expiresAt:          time.Now().Add(config.Conf.BindTokenTTL),
+		requesterName:      requesterName,
+		scope:              scope,
+	}
+	server.bindTokens.tokens[bindToken.token] = bindToken
+	return bindToken
+}
+
+// redeemBindToken returns a bind token, the token can not be used again.
+func (server *CitrusServer) redeemBindToken(token string) (*BindToken, bool) {
+	server.bindTokens.mutex.Lock()
+	defer server.bindTokens.mutex.Unlock()
+
+	bindToken, ok := server.bindTokens.tokens[token]
+	if !ok || bindToken.redeemed || time.Now().After(bindToken.expiresAt) {
+		return nil, false
+	}
+	if config.Conf.RequireBindingApproval {
+		// give the owner of the app time to approve the binding after the app has connected
+		bindToken.redeemed = true
+		bindToken.expiresAt = time.Now().Add(config.Conf.BindTokenTTL)
+	} else {
+		delete(server.bindTokens.tokens, token)
+	}
+	serverLog.Info("Redeemed bind token", "thirdPartyId", bindToken.thirdPartyClientId)
+	redeemed := *bindToken
+	return &redeemed, true
+}
+
+// peekBindToken is the same as redeemBindToken, but keeps the token valid.
+func (server *CitrusServer) peekBindToken(token string) (*BindToken, bool) {
+	server.bindTokens.mutex.Lock()
+	defer server.bindTokens.mutex.Unlock()
+
+	bindToken, ok := server.bindTokens.tokens[token]
+	if !ok || bindToken.redeemed || time.Now().After(bindToken.expiresAt) {
+		return nil, false
+	}
+	peeked := *bindToken
+	return &peeked, true
+}
+
+// countBindTokens returns the numbers of unexpired bind tokens which are pending and which have been redeemed and are
+// waiting for approval.
+func (server *CitrusServer) countBindTokens() (pending int, redeemed int) {
+	server.bindTokens.mutex.Lock()
+	defer server.bindTokens.mutex.Unlock()
+
+	now := time.Now()
+	for _, bindToken := range server.bindTokens.tokens {
+		if now.After(bindToken.expiresAt) {
+			continue
+		}
+		if bindToken.redeemed {
+			redeemed++
+		} else {
+			pending++
+		}
+	}
+	return pending, redeemed
+}
+
+func (server *CitrusServer) purgeExpiredBindTokensLocked() {
+	now := time.Now()
+	for token, bindToken := range server.bindTokens.tokens {
+		if now.After(bindToken.expiresAt) {
+			delete(server.bindTokens.tokens, token)
+		}
+	}
+}
+
+// initLegacyBindingCodes checks the scope of bindings made with legacy binding codes, if they are enabled.
+func initLegacyBindingCodes() error {
+	if !config.Conf.LegacyBindingCodes {
+		return nil
+	}
+	if config.Conf.RequireBindingApproval {
+		return fmt.Errorf("initLegacyBindingCodes: LegacyBindingCodes can not be enabled along with RequireBindingApproval, as a legacy binding code does not come with the display name of the controller")
+	}
+	if _, err := ParseBindingScope(config.Conf.LegacyBindingScope); err != nil {
+		return fmt.Errorf("initLegacyBindingCodes: LegacyBindingScope: %v", err)
+	}
+	return nil
+}
+
+// resolveBindingCode returns the bind token of a binding code, which holds the third party client a DG-LAB app connecting
+// with the given binding code will be bound to. A binding code is a bind token, or with LegacyBindingCodes, the secure
+// ID of a third party client as in the official protocol, which is bound with LegacyBindingScope. Bind tokens are only
+// redeemed if redeem is set, a used bind token does not resolve again, see resumeDGAppClient.
+func (server *CitrusServer) resolveBindingCode(bindingCode string, redeem bool) (*BindToken, error) {
+	var bindToken *BindToken
+	var ok bool
+	if redeem {
+		bindToken, ok = server.redeemBindToken(bindingCode)
+	} else {
+		bindToken, ok = server.peekBindToken(bindingCode)
+	}
+	if ok {
+		return bindToken, nil
+	}
+
+	if !config.Conf.LegacyBindingCodes {
+		return nil, fmt.Errorf("resolveBindingCode: bind token %s is invalid or has expired", bindingCode)
+	}
+	client, err := server.getThirdPartyClient(ClientSecureId(bindingCode))
+	if err != nil {
+		return nil, fmt.Errorf("resolveBindingCode: binding code %s is invalid or has expired", bindingCode)
+	}
+	return &BindToken{token: bindingCode, thirdPartyClientId: client.secureId, scope: BindingScope(config.Conf.LegacyBindingScope)}, nil
+}
@@ -0,0 +1,106 @@
+package citrus_server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/tundrawork/DG-citrus/config"
+	"golang.org/x/crypto/blake2b"
+)
+
+// clientIPSourceRemoteAddress is the source of a client IP taken from the connection instead of a header.
+const clientIPSourceRemoteAddress = "remote address"
+
+// trustedProxies are the networks whose real IP headers are trusted, they are parsed from config.Conf.TrustedProxies
+// by Init.
+var trustedProxies []*net.IPNet
+
+// initClientIP checks the configured trusted proxies.
+func initClientIP() error {
+	trustedProxies = make([]*net.IPNet, 0, len(config.Conf.TrustedProxies))
+	for _, proxy := range config.Conf.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return fmt.Errorf("initClientIP: invalid trusted proxy %q: %v", proxy, err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveClientIP returns the IP address of the client of a request, along with where it was taken from. The real IP
+// headers are only used if the request comes from a trusted proxy, and the addresses they contain are checked from the
+// last one, which was added by the closest proxy, skipping trusted proxies, so that clients can not spoof them.
+func resolveClientIP(c *app.RequestContext) (string, string) {
+	remoteIP, _, err := net.SplitHostPort(strings.TrimSpace(c.RemoteAddr().String()))
+	if err != nil {
+		return "", clientIPSourceRemoteAddress
+	}
+	ip := net.ParseIP(remoteIP)
+	if ip == nil || !isTrustedProxy(ip) {
+		return remoteIP, clientIPSourceRemoteAddress
+	}
+	for _, header := range config.Conf.RealIPHeaders {
+		value := c.Request.Header.Get(header)
+		if value == "" {
+			continue
+		}
+		items := strings.Split(value, ",")
+		for i := len(items) - 1; i >= 0; i-- {
+			candidate := strings.TrimSpace(items[i])
+			candidateIP := net.ParseIP(candidate)
+			if candidateIP == nil {
+				break
+			}
+			if i == 0 || !isTrustedProxy(candidateIP) {
+				return candidate, header
+			}
+		}
+	}
+	return remoteIP, clientIPSourceRemoteAddress
+}
+
+// ClientIP implements app.ClientIP, the server uses it for RequestContext.ClientIP.
+func ClientIP(c *app.RequestContext) string {
+	ip, _ := resolveClientIP(c)
+	return ip
+}
+
+// describeClientIP tells where the IP address of the client of a request was taken from, for logs and diagnostics.
+func describeClientIP(c *app.RequestContext) string {
+	ip, source := resolveClientIP(c)
+	if source == clientIPSourceRemoteAddress {
+		return fmt.Sprintf("%s (remote address)", ip)
+	}
+	return fmt.Sprintf("%s (from %s, remote address %s)", ip, source, c.RemoteAddr())
+}
+
+// hashClientIP identifies an IP address to administrators without revealing it, so that they can tell which clients
+// share an address. The hash changes along with the salt of insecure client IDs.
+func hashClientIP(ip string) string {
+	hash, _ := blake2b.New(8, []byte(citrusServer.getInsecureIdSalt()))
+	// the prefix keeps the hash from matching an insecure client ID, which starts with the client type
+	hash.Write([]byte("remote-ip"))
+	hash.Write([]byte{0})
+	hash.Write([]byte(ip))
+	return hex.EncodeToString(hash.Sum(nil))
+}
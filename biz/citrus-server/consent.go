@@ -0,0 +1,195 @@
+package citrus_server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// BindingConsent is what the owner of a DG-LAB app is shown on the consent page before approving a binding.
+type BindingConsent struct {
+	RequesterName string
+	Scope         BindingScope
+	Approved      bool
+	ExpiresAt     time.Time
+}
+
+// PendingBindingConsent is a binding request waiting for approval, as listed to the owner of a DG-LAB app.
+type PendingBindingConsent struct {
+	BindingConsent
+	Secret string
+}
+
+// OwnedApp is a DG-LAB app listed to its owner on the consent page list, along with the key to its audit log.
+type OwnedApp struct {
+	AppId    ClientSecureId
+	AuditKey string
+}
+
+// checkBindingApproval is used when bindings need the approval of the owner of the DG-LAB app. It returns whether the
+// app may be bound to the third party client, which is the case if they are already bound, or if the owner has approved
+// the bind token the app has connected with. Otherwise, the app is recorded on the bind token so that the binding can be
+// completed once the owner approves it, and the consent secret the owner approves it with is returned. The secret is
+// only ever sent to the app, as the third party client knows the bind token and could otherwise approve its own request,
+// and the owner finds it with pendingBindingConsents.
+func (server *CitrusServer) checkBindingApproval(appId ClientSecureId, thirdPartyClientId ClientSecureId) (bool, string, error) {
+	server.clients.mutex.RLock()
+	app, ok := server.clients.secureMapping[appId]
+	if !ok {
+		server.clients.mutex.RUnlock()
+		return false, "", fmt.Errorf("checkBindingApproval: DG App client with secure ID %s not found", appId)
+	}
+	_, bound := app.bindings[thirdPartyClientId]
+	bindingCode := app.bindingCode
+	server.clients.mutex.RUnlock()
+	if bound {
+		return true, "", nil
+	}
+
+	server.bindTokens.mutex.Lock()
+	defer server.bindTokens.mutex.Unlock()
+
+	bindToken, ok := server.bindTokens.tokens[bindingCode]
+	if !ok || !bindToken.redeemed || bindToken.thirdPartyClientId != thirdPartyClientId || time.Now().After(bindToken.expiresAt) {
+		return false, "", fmt.Errorf("checkBindingApproval: no binding request from Third Party client with secure ID %s for DG App client with secure ID %s, it may have expired", thirdPartyClientId, appId)
+	}
+	if bindToken.approved {
+		delete(server.bindTokens.tokens, bindingCode)
+		return true, "", nil
+	}
+	bindToken.appId = appId
+	if bindToken.consentSecret == "" {
+		bindToken.consentSecret = generateRandomHex(16)
+	}
+	return false, bindToken.consentSecret, nil
+}
+
+// findBindTokenByConsentSecretLocked returns the unexpired bind token with the given consent secret.
+func (server *CitrusServer) findBindTokenByConsentSecretLocked(secret string) (string, *BindToken, bool) {
+	now := time.Now()
+	for token, bindToken := range server.bindTokens.tokens {
+		if bindToken.consentSecret == "" || now.After(bindToken.expiresAt) {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(bindToken.consentSecret), []byte(secret)) == 1 {
+			return token, bindToken, true
+		}
+	}
+	return "", nil, false
+}
+
+// getBindingConsent returns the binding request of the given consent secret.
+func (server *CitrusServer) getBindingConsent(secret string) (*BindingConsent, error) {
+	server.bindTokens.mutex.Lock()
+	defer server.bindTokens.mutex.Unlock()
+
+	_, bindToken, ok := server.findBindTokenByConsentSecretLocked(secret)
+	if !ok {
+		return nil, fmt.Errorf("getBindingConsent: binding request not found, it may have expired")
+	}
+	return &BindingConsent{
+		RequesterName: bindToken.requesterName,
+		Scope:         bindToken.scope,
+		Approved:      bindToken.approved,
+		ExpiresAt:     bindToken.expiresAt,
+	}, nil
+}
+
+// pendingBindingConsents returns the binding requests waiting for approval of the apps connected from the given IP
+// address, oldest first. The official DG-LAB App does not show the consent page it is sent, so its owner finds it by
+// opening the consent page list on the device the app runs on, which the third party client can not do from elsewhere.
+func (server *CitrusServer) pendingBindingConsents(clientIP string) []PendingBindingConsent {
+	remoteIPHash := hashClientIP(clientIP)
+	appIds := make(map[string]ClientSecureId)
+	var pending []PendingBindingConsent
+
+	server.bindTokens.mutex.Lock()
+	now := time.Now()
+	for _, bindToken := range server.bindTokens.tokens {
+		if bindToken.consentSecret == "" || bindToken.approved || now.After(bindToken.expiresAt) {
+			continue
+		}
+		appIds[bindToken.consentSecret] = bindToken.appId
+		pending = append(pending, PendingBindingConsent{
+			BindingConsent: BindingConsent{
+				RequesterName: bindToken.requesterName,
+				Scope:         bindToken.scope,
+				ExpiresAt:     bindToken.expiresAt,
+			},
+			Secret: bindToken.consentSecret,
+		})
+	}
+	server.bindTokens.mutex.Unlock()
+
+	server.clients.mutex.RLock()
+	defer server.clients.mutex.RUnlock()
+
+	filtered := pending[:0]
+	for _, consent := range pending {
+		app, ok := server.clients.secureMapping[appIds[consent.Secret]]
+		if ok && app.conn != nil && app.remoteIPHash == remoteIPHash {
+			filtered = append(filtered, consent)
+		}
+	}
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].ExpiresAt.Before(filtered[j].ExpiresAt)
+	})
+	return filtered
+}
+
+// appsConnectedFrom returns the DG-LAB apps connected from the given IP address, which are listed to their owner along
+// with the binding requests waiting for approval.
+func (server *CitrusServer) appsConnectedFrom(clientIP string) []OwnedApp {
+	remoteIPHash := hashClientIP(clientIP)
+	server.clients.mutex.RLock()
+	defer server.clients.mutex.RUnlock()
+
+	var apps []OwnedApp
+	for _, client := range server.clients.secureMapping {
+		if client.typ == ClientTypeDGApp && client.conn != nil && client.remoteIPHash == remoteIPHash {
+			apps = append(apps, OwnedApp{AppId: client.secureId, AuditKey: client.auditKey})
+		}
+	}
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].AppId < apps[j].AppId
+	})
+	return apps
+}
+
+// decideBinding approves or denies the binding request of the given consent secret, and completes or fails the binding
+// of the app waiting for it.
+func (server *CitrusServer) decideBinding(ctx context.Context, secret string, approve bool) error {
+	server.bindTokens.mutex.Lock()
+	token, bindToken, ok := server.findBindTokenByConsentSecretLocked(secret)
+	if !ok {
+		server.bindTokens.mutex.Unlock()
+		return fmt.Errorf("decideBinding: binding request not found, it may have expired")
+	}
+	if bindToken.approved {
+		server.bindTokens.mutex.Unlock()
+		return fmt.Errorf("decideBinding: binding request has already been approved")
+	}
+	appId, thirdPartyClientId, requesterName := bindToken.appId, bindToken.thirdPartyClientId, bindToken.requesterName
+	if approve {
+		bindToken.approved = true
+	} else {
+		delete(server.bindTokens.tokens, token)
+	}
+	server.bindTokens.mutex.Unlock()
+
+	serverLog.InfoContext(ctx, "Decided binding request", "requesterName", requesterName, "thirdPartyId", thirdPartyClientId, "approved", approve)
+	if !approve {
+		return server.sendEvent(ctx, appId, &EventBindResult{
+			ClientId: thirdPartyClientId,
+			TargetId: appId,
+			Code:     400,
+		})
+	}
+	event := &EventBindAppToThirdParty{
+		ClientId: thirdPartyClientId,
+		TargetId: appId,
+	}
+	return event.Process(ctx)
+}
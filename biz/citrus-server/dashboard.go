@@ -0,0 +1,250 @@
+package citrus_server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/utils"
+	"github.com/hertz-contrib/websocket"
+)
+
+const (
+	// dashboardActivityLimit is the number of recent commands and errors kept for the dashboard
+	dashboardActivityLimit = 100
+	// dashboardStrengthLimit is the number of strength reports kept for the graph of each DG-LAB app
+	dashboardStrengthLimit = 120
+	// dashboardUpdateBuffer is the number of updates a slow dashboard can fall behind before updates are dropped
+	dashboardUpdateBuffer = 64
+)
+
+// dashboardClientsInterval is how often the dashboard feed checks the clients for changes, it is a variable so that
+// tests can shorten it.
+var dashboardClientsInterval = 2 * time.Second
+
+const (
+	DashboardActivityCommand = "command"
+	DashboardActivityError   = "error"
+)
+
+// DashboardActivity is a command forwarded to a DG-LAB app, or an error, shown on the dashboard.
+type DashboardActivity struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	// Client describes the third party client involved, see CitrusClient.String
+	Client  string         `json:"client,omitempty"`
+	AppId   ClientSecureId `json:"appId,omitempty"`
+	Message string         `json:"message"`
+}
+
+// DashboardStrength is a strength report of a DG-LAB app shown in its strength graph.
+type DashboardStrength struct {
+	Time time.Time `json:"time"`
+	DataReportStrength
+}
+
+// DashboardUpdate is sent to the dashboard over its websocket feed, its kind is activity, strength or clients.
+type DashboardUpdate struct {
+	Kind     string             `json:"kind"`
+	Activity *DashboardActivity `json:"activity,omitempty"`
+	AppId    ClientSecureId     `json:"appId,omitempty"`
+	Strength *DashboardStrength `json:"strength,omitempty"`
+	Clients  []AdminClientInfo  `json:"clients,omitempty"`
+}
+
+// Dashboard keeps the recent activity shown on the dashboard, and passes new activity on to the open dashboards.
+type Dashboard struct {
+	// activity is ordered from the oldest to the newest
+	activity    []DashboardActivity
+	strength    map[ClientSecureId][]DashboardStrength
+	subscribers map[chan DashboardUpdate]struct{}
+	mutex       sync.Mutex
+}
+
+func newDashboard() Dashboard {
+	return Dashboard{
+		strength:    make(map[ClientSecureId][]DashboardStrength),
+		subscribers: make(map[chan DashboardUpdate]struct{}),
+	}
+}
+
+// recordCommand records a command a third party client has sent to a DG-LAB app.
+func (server *CitrusServer) recordCommand(thirdPartyClientId ClientSecureId, appId ClientSecureId, command Event) {
+	rawEvent, err := command.ToRawEvent()
+	if err != nil {
+		return
+	}
+	server.recordActivity(DashboardActivityCommand, thirdPartyClientId, appId, rawEvent.Message)
+}
+
+// recordActivity records a command or an error, the third party client and the DG-LAB app are optional.
+func (server *CitrusServer) recordActivity(kind string, thirdPartyClientId ClientSecureId, appId ClientSecureId, message string) {
+	activity := DashboardActivity{
+		Time:    time.Now(),
+		Kind:    kind,
+		AppId:   appId,
+		Message: message,
+	}
+	if thirdPartyClientId != "" {
+		activity.Client = server.describeClient(thirdPartyClientId)
+	}
+
+	server.dashboard.mutex.Lock()
+	defer server.dashboard.mutex.Unlock()
+
+	server.dashboard.activity = append(server.dashboard.activity, activity)
+	if len(server.dashboard.activity) > dashboardActivityLimit {
+		server.dashboard.activity = server.dashboard.activity[len(server.dashboard.activity)-dashboardActivityLimit:]
+	}
+	server.publishLocked(DashboardUpdate{Kind: "activity", Activity: &activity})
+}
+
+// recordStrength records a strength report of a DG-LAB app for its strength graph.
+func (server *CitrusServer) recordStrength(appId ClientSecureId, strength DataReportStrength) {
+	sample := DashboardStrength{Time: time.Now(), DataReportStrength: strength}
+
+	server.dashboard.mutex.Lock()
+	defer server.dashboard.mutex.Unlock()
+
+	history := append(server.dashboard.strength[appId], sample)
+	if len(history) > dashboardStrengthLimit {
+		history = history[len(history)-dashboardStrengthLimit:]
+	}
+	server.dashboard.strength[appId] = history
+	server.publishLocked(DashboardUpdate{Kind: "strength", AppId: appId, Strength: &sample})
+}
+
+// forgetStrength drops the strength graph of a purged DG-LAB app.
+func (server *CitrusServer) forgetStrength(appId ClientSecureId) {
+	server.dashboard.mutex.Lock()
+	defer server.dashboard.mutex.Unlock()
+
+	delete(server.dashboard.strength, appId)
+}
+
+// publishLocked passes an update on to the open dashboards, dashboards which fall too far behind miss it.
+func (server *CitrusServer) publishLocked(update DashboardUpdate) {
+	for updates := range server.dashboard.subscribers {
+		select {
+		case updates <- update:
+		default:
+		}
+	}
+}
+
+// subscribeDashboard returns a channel receiving the updates of the dashboard, along with a function to stop receiving
+// them.
+func (server *CitrusServer) subscribeDashboard() (<-chan DashboardUpdate, func()) {
+	server.dashboard.mutex.Lock()
+	defer server.dashboard.mutex.Unlock()
+
+	updates := make(chan DashboardUpdate, dashboardUpdateBuffer)
+	server.dashboard.subscribers[updates] = struct{}{}
+	return updates, func() {
+		server.dashboard.mutex.Lock()
+		defer server.dashboard.mutex.Unlock()
+
+		delete(server.dashboard.subscribers, updates)
+	}
+}
+
+// dashboardHistory returns copies of the recent activity, from the newest to the oldest, and of the strength graphs.
+func (server *CitrusServer) dashboardHistory() ([]DashboardActivity, map[ClientSecureId][]DashboardStrength) {
+	server.dashboard.mutex.Lock()
+	defer server.dashboard.mutex.Unlock()
+
+	activity := make([]DashboardActivity, len(server.dashboard.activity))
+	for i, entry := range server.dashboard.activity {
+		activity[len(activity)-1-i] = entry
+	}
+	strength := make(map[ClientSecureId][]DashboardStrength, len(server.dashboard.strength))
+	for appId, history := range server.dashboard.strength {
+		strength[appId] = append([]DashboardStrength(nil), history...)
+	}
+	return activity, strength
+}
+
+// AdminDashboard shows the clients, their bindings and recent activity to operators, the page keeps itself up to date
+// with AdminFeed.
+func AdminDashboard(ctx context.Context, c *app.RequestContext) {
+	activity, strength := citrusServer.dashboardHistory()
+	c.HTML(http.StatusOK, "dashboard.tmpl", utils.H{
+		"clients":               citrusServer.listClients(),
+		"activity":              activity,
+		"strength":              strength,
+		"allowInsecureClientId": citrusServer.insecureClientIdAllowed(),
+	})
+}
+
+// AdminFeed sends the updates of the dashboard over websocket, along with the clients whenever they change.
+func AdminFeed(ctx context.Context, c *app.RequestContext) {
+	// the default upgrader only accepts connections from the dashboard itself, so that other sites can not read the feed
+	// with the credentials cached by the browser
+	upgrader := websocket.HertzUpgrader{}
+	err := upgrader.Upgrade(c, func(conn *websocket.Conn) {
+		updates, unsubscribe := citrusServer.subscribeDashboard()
+		defer unsubscribe()
+
+		// the dashboard does not send anything, reading only notices when the connection is closed
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		var lastClients []byte
+		sendClients := func() error {
+			clients := citrusServer.listClients()
+			data, err := json.Marshal(clients)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(data, lastClients) {
+				return nil
+			}
+			lastClients = data
+			return conn.WriteJSON(DashboardUpdate{Kind: "clients", Clients: clients})
+		}
+		ticker := time.NewTicker(dashboardClientsInterval)
+		defer ticker.Stop()
+		err := sendClients()
+		for err == nil {
+			select {
+			case <-closed:
+				return
+			case update := <-updates:
+				err = conn.WriteJSON(update)
+			case <-ticker.C:
+				err = sendClients()
+			}
+		}
+		adminLog.InfoContext(ctx, "Stopped sending dashboard updates", "error", err)
+	})
+	if err != nil {
+		adminLog.WarnContext(ctx, "Failed to upgrade dashboard feed connection", "error", err)
+	}
+}
+
+// checkAdminOrigin rejects requests changing state which come from other sites, as browsers send the cached admin
+// credentials along with them.
+func checkAdminOrigin(c *app.RequestContext) error {
+	origin := string(c.GetHeader("Origin"))
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host != string(c.Host()) {
+		return fmt.Errorf("requests from %s are not allowed", origin)
+	}
+	return nil
+}
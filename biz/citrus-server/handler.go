@@ -1,14 +1,21 @@
 package citrus_server
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cloudwego/hertz/pkg/app"
 	"github.com/cloudwego/hertz/pkg/common/hlog"
+	"github.com/cloudwego/hertz/pkg/common/utils"
 	"github.com/cloudwego/hertz/pkg/protocol/consts"
 	"github.com/hertz-contrib/websocket"
 	"github.com/tundrawork/DG-citrus/biz/handler"
@@ -16,37 +23,116 @@ import (
 	"golang.org/x/crypto/blake2b"
 )
 
-var (
-	insecureIdSalt = generateSalt(8)
-	citrusServer   = NewCitrusServer()
-)
+var citrusServer = NewCitrusServer()
 
 func DGAppHandler(ctx context.Context, c *app.RequestContext) {
-	err := wsConnectionHandler(ctx, c, ClientTypeDGApp)
+	if rejectWhileShuttingDown(ctx, c, "DGAppHandler") {
+		return
+	}
+	var bindToken *BindToken
+	if resumeId := c.Query("resume"); resumeId != "" {
+		// a resumed app keeps the bindings it has, the binding code it has connected with first is not used again
+		if err := citrusServer.checkResumeToken(ClientTypeDGApp, ClientSecureId(resumeId), c.Query("token")); err != nil {
+			fail(ctx, c, "DGAppHandler", fmt.Sprintf("Can not resume session: %v", err))
+			return
+		}
+	} else if !citrusServer.hasDetachedDGAppClient(c.Param("uuid")) {
+		// the binding code of a detached app resumes it instead, see resumeDGAppClient
+		var err error
+		// bind tokens are only redeemed by actual websocket connections, so that e.g. link previews do not use them up
+		bindToken, err = citrusServer.resolveBindingCode(c.Param("uuid"), isWebsocketUpgrade(c))
+		if err != nil {
+			fail(ctx, c, "DGAppHandler", fmt.Sprintf("This binding code does not belong to any controller on this server, please ask the controller for a new one: %v", err))
+			return
+		}
+	}
+	err := wsConnectionHandler(ctx, c, ClientTypeDGApp, bindToken, nil, nil)
 	if err != nil {
-		hlog.CtxInfof(ctx, "RootHandler: try to handle connection as websocket failed: %v", err)
+		httpLog.InfoContext(ctx, "Failed to handle connection as websocket", "error", err)
 		wsUpgradeFailed(ctx, c)
 	}
 }
 
 func ThirdPartyWSHandler(ctx context.Context, c *app.RequestContext) {
-	err := wsConnectionHandler(ctx, c, ClientTypeThirdPartyWS)
+	thirdPartyWSHandler(ctx, c, "ThirdPartyWSHandler", ClientTypeThirdPartyWS)
+}
+
+// ObserverWSHandler connects read-only observer clients, such as stream overlays and safety monitors.
+func ObserverWSHandler(ctx context.Context, c *app.RequestContext) {
+	thirdPartyWSHandler(ctx, c, "ObserverWSHandler", ClientTypeObserver)
+}
+
+func thirdPartyWSHandler(ctx context.Context, c *app.RequestContext, context string, typ CitrusClientType) {
+	if rejectWhileShuttingDown(ctx, c, context) {
+		return
+	}
+	apiKey, err := authenticateAPIKey(c, APIKeyScopeWS)
+	if err != nil {
+		failAPIKey(ctx, c, context, err)
+		return
+	}
+	metadata, err := getClientMetadataFromRequest(c)
+	if err != nil {
+		fail(ctx, c, context, fmt.Sprintf("Invalid client metadata: %v", err))
+		return
+	}
+	if _, err := getInsecureSlotFromRequest(c); err != nil {
+		fail(ctx, c, context, err.Error())
+		return
+	}
+	if resumeId := c.Query("resume"); resumeId != "" {
+		err := citrusServer.checkResumeToken(typ, ClientSecureId(resumeId), c.Query("token"))
+		if err != nil {
+			fail(ctx, c, context, fmt.Sprintf("Can not resume session: %v", err))
+			return
+		}
+	} else if err := citrusServer.checkAPIKeyClientLimit(apiKey); err != nil {
+		failAPIKey(ctx, c, context, err)
+		return
+	}
+	err = wsConnectionHandler(ctx, c, typ, nil, metadata, apiKey)
 	if err != nil {
-		hlog.CtxInfof(ctx, "RootHandler: try to handle connection as websocket failed: %v", err)
+		httpLog.InfoContext(ctx, "Failed to handle connection as websocket", "error", err)
 		wsUpgradeFailed(ctx, c)
 	}
 }
 
 func HTTPRegister(ctx context.Context, c *app.RequestContext) {
-	insecureId := getInsecureIdFromRequest(c.ClientIP(), ClientTypeThirdPartyHTTP)
-	if config.Conf.AllowInsecureClientId {
-		_, err := citrusServer.getClientInsecure(insecureId)
-		if err == nil {
-			fail(ctx, c, "HTTPRegister", "We can not register you on this server as insecure client ID is enabled and your IP address is already registered.")
+	if rejectWhileShuttingDown(ctx, c, "HTTPRegister") {
+		return
+	}
+	apiKey, err := authenticateAPIKey(c, APIKeyScopeHTTP)
+	if err != nil {
+		failAPIKey(ctx, c, "HTTPRegister", err)
+		return
+	}
+	metadata, err := getClientMetadataFromRequest(c)
+	if err != nil {
+		fail(ctx, c, "HTTPRegister", fmt.Sprintf("Invalid client metadata: %v", err))
+		return
+	}
+	slot, err := getInsecureSlotFromRequest(c)
+	if err != nil {
+		fail(ctx, c, "HTTPRegister", err.Error())
+		return
+	}
+	insecureId := getInsecureIdFromRequest(c.ClientIP(), ClientTypeThirdPartyHTTP, slot)
+	if citrusServer.insecureClientIdAllowed() {
+		if citrusServer.insecureIdInUse(insecureId) {
+			fail(ctx, c, "HTTPRegister", fmt.Sprintf("We can not register you on this server as insecure client ID is enabled and your IP address %s is already registered with slot %q, please choose another slot.", c.ClientIP(), slot))
 			return
 		}
 	}
-	client := citrusServer.newHTTPClient(insecureId)
+	client, err := citrusServer.newHTTPClient(insecureId, metadata, apiKey)
+	if err != nil {
+		failAPIKey(ctx, c, "HTTPRegister", err)
+		return
+	}
+	citrusServer.markConnected(client, c.ClientIP())
+	if citrusServer.insecureClientIdAllowed() {
+		httpLog.InfoContext(ctx, "Insecure client ID is derived from client IP", "client", client, "clientIp", describeClientIP(c), "slot", slot)
+	}
+	auditAPIKeyRegistration(ctx, c, apiKey, client)
 	event := &EventBindToServer{
 		ClientId: client.secureId,
 	}
@@ -61,18 +147,117 @@ func HTTPRegister(ctx context.Context, c *app.RequestContext) {
 func HTTPBindingQrcode(ctx context.Context, c *app.RequestContext) {
 	secureId, err := getSecureIdFromHTTPRequest(c)
 	if err != nil {
-		fail(ctx, c, "HTTPCommand", fmt.Sprintf("Failed to get client ID: %v", err))
+		fail(ctx, c, "HTTPBindingQrcode", fmt.Sprintf("Failed to get client ID: %v", err))
 		return
 	}
-	err = sendDGAppBindingCode(c.Response.BodyWriter(), secureId)
+	options, err := getQrcodeOptionsFromRequest(c)
+	if err != nil {
+		fail(ctx, c, "HTTPBindingQrcode", fmt.Sprintf("Invalid QR code options: %v", err))
+		return
+	}
+	requesterName := strings.TrimSpace(c.Query("name"))
+	if client, err := citrusServer.getClientSecure(secureId); err == nil && requesterName == "" && client.metadata != nil {
+		requesterName = client.metadata.Name
+	}
+	if config.Conf.RequireBindingApproval && requesterName == "" {
+		fail(ctx, c, "HTTPBindingQrcode", "A display name is required, as bindings on this server need to be approved by the owner of the DG-LAB app")
+		return
+	}
+	if len([]rune(requesterName)) > maxRequesterNameLength {
+		fail(ctx, c, "HTTPBindingQrcode", fmt.Sprintf("The display name must not be longer than %d characters", maxRequesterNameLength))
+		return
+	}
+	scope, err := ParseBindingScope(c.Query("scope"))
+	if err != nil {
+		fail(ctx, c, "HTTPBindingQrcode", err.Error())
+		return
+	}
+	if client, err := citrusServer.getClientSecure(secureId); err == nil && client.typ == ClientTypeObserver {
+		// observers can only watch, which is what the owner of the app is asked to allow
+		scope = BindingScopeReadOnly
+	}
+	bindToken := citrusServer.newBindToken(secureId, requesterName, scope)
+	payload := dgAppBindingPayload(bindToken.token)
+	if options.Format == QrcodeFormatJSON {
+		response := map[string]interface{}{
+			"code":      200,
+			"message":   "success",
+			"url":       payload,
+			"expiresAt": bindToken.expiresAt.UTC().Format(time.RFC3339),
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+	var body bytes.Buffer
+	err = writeQrcode(&body, payload, options)
 	if err != nil {
 		fail(ctx, c, "HTTPBindingQrcode", fmt.Sprintf("Failed to generate DG-LAB app bindings code: %v", err))
 		return
 	}
-	c.Response.Header.SetContentType(consts.MIMEImageJPEG)
+	c.Data(http.StatusOK, qrcodeContentTypes[options.Format], body.Bytes())
+}
+
+func HTTPBindings(ctx context.Context, c *app.RequestContext) {
+	secureId, err := getSecureIdFromHTTPRequest(c)
+	if err != nil {
+		fail(ctx, c, "HTTPBindings", fmt.Sprintf("Failed to get client ID: %v", err))
+		return
+	}
+	bindings, err := citrusServer.listBindings(secureId)
+	if err != nil {
+		fail(ctx, c, "HTTPBindings", fmt.Sprintf("Failed to list bindings: %v", err))
+		return
+	}
+	c.JSON(http.StatusOK, map[string]interface{}{"code": 200, "message": "success", "bindings": bindings})
+}
+
+// BindingConsentListPage lists the binding requests waiting for the approval of DG-LAB apps connected from the same IP
+// address as the request, so that their owner can open it on the device the app runs on to find the consent page. It
+// also links the audit logs of these apps, see HTTPAudit.
+func BindingConsentListPage(ctx context.Context, c *app.RequestContext) {
+	c.HTML(http.StatusOK, "consent.tmpl", utils.H{
+		"list":     true,
+		"requests": citrusServer.pendingBindingConsents(c.ClientIP()),
+		"apps":     citrusServer.appsConnectedFrom(c.ClientIP()),
+		"audit":    citrusServer.audit != nil,
+	})
+}
+
+// BindingConsentPage shows the owner of a DG-LAB app who is requesting control over it, when bindings need approval.
+// It is keyed by the consent secret sent to the app waiting for the binding, not by the bind token.
+func BindingConsentPage(ctx context.Context, c *app.RequestContext) {
+	secret := c.Param("secret")
+	consent, err := citrusServer.getBindingConsent(secret)
+	if err != nil {
+		c.HTML(http.StatusNotFound, "consent.tmpl", utils.H{"error": "This binding request does not exist, it may have expired or been decided already."})
+		return
+	}
+	denied := false
+	if c.IsPost() {
+		action := string(c.FormValue("action"))
+		if action != "approve" && action != "deny" {
+			c.HTML(http.StatusBadRequest, "consent.tmpl", utils.H{"error": fmt.Sprintf("Unknown action %q.", action)})
+			return
+		}
+		err = citrusServer.decideBinding(ctx, secret, action == "approve")
+		if err != nil {
+			httpLog.WarnContext(ctx, "Failed to decide binding request", "error", err)
+			c.HTML(http.StatusBadRequest, "consent.tmpl", utils.H{"error": "This binding request can not be changed, it may have expired or been decided already."})
+			return
+		}
+		consent.Approved, denied = action == "approve", action == "deny"
+	}
+	c.HTML(http.StatusOK, "consent.tmpl", utils.H{
+		"consent":   consent,
+		"denied":    denied,
+		"expiresAt": consent.ExpiresAt.UTC().Format(time.RFC1123),
+	})
 }
 
 func HTTPCommand(ctx context.Context, c *app.RequestContext) {
+	if rejectWhileShuttingDown(ctx, c, "HTTPCommand") {
+		return
+	}
 	secureId, err := getSecureIdFromHTTPRequest(c)
 	if err != nil {
 		fail(ctx, c, "HTTPCommand", fmt.Sprintf("Failed to get client ID: %v", err))
@@ -89,12 +274,22 @@ func HTTPCommand(ctx context.Context, c *app.RequestContext) {
 		TargetId: "",
 		Message:  message,
 	}
+	client, err := citrusServer.getClientSecure(secureId)
+	if err == nil {
+		citrusServer.record(ctx, client.typ, client.secureId, RecordingDirectionIn, rawEvent)
+	}
 	event, err := rawEvent.ToEvent()
 	if err != nil {
 		fail(ctx, c, "HTTPCommand", fmt.Sprintf("Failed to parse event: %v", err))
 		return
 	}
-	err = event.Process()
+	if client != nil {
+		if err = denyAppEvent(ctx, client, event, ""); err != nil {
+			failWithStatus(ctx, c, http.StatusForbidden, "HTTPCommand", err.Error())
+			return
+		}
+	}
+	err = event.Process(ctx)
 	if err != nil {
 		fail(ctx, c, "HTTPCommand", fmt.Sprintf("Failed to process event: %v", err))
 		return
@@ -102,6 +297,20 @@ func HTTPCommand(ctx context.Context, c *app.RequestContext) {
 	c.JSON(http.StatusOK, map[string]interface{}{"code": 200, "message": "success"})
 }
 
+// HTTPWhoami tells a client which IP address the server sees it at, which insecure client IDs are derived from, to help
+// setting up trusted proxies.
+func HTTPWhoami(ctx context.Context, c *app.RequestContext) {
+	ip, source := resolveClientIP(c)
+	c.JSON(http.StatusOK, map[string]interface{}{
+		"code":                  200,
+		"message":               "success",
+		"clientIp":              ip,
+		"source":                source,
+		"remoteAddress":         c.RemoteAddr().String(),
+		"allowInsecureClientId": citrusServer.insecureClientIdAllowed(),
+	})
+}
+
 func HTTPHeartbeat(ctx context.Context, c *app.RequestContext) {
 	secureId, err := getSecureIdFromHTTPRequest(c)
 	if err != nil {
@@ -114,12 +323,15 @@ func HTTPHeartbeat(ctx context.Context, c *app.RequestContext) {
 		TargetId: "",
 		Message:  "",
 	}
+	if client, err := citrusServer.getClientSecure(secureId); err == nil {
+		citrusServer.record(ctx, client.typ, client.secureId, RecordingDirectionIn, rawEvent)
+	}
 	event, err := rawEvent.ToEvent()
 	if err != nil {
 		fail(ctx, c, "HTTPHeartbeat", fmt.Sprintf("Failed to parse event: %v", err))
 		return
 	}
-	err = event.Process()
+	err = event.Process(ctx)
 	if err != nil {
 		fail(ctx, c, "HTTPHeartbeat", fmt.Sprintf("Failed to process event: %v", err))
 		return
@@ -127,20 +339,66 @@ func HTTPHeartbeat(ctx context.Context, c *app.RequestContext) {
 	c.JSON(http.StatusOK, map[string]interface{}{"code": 200, "message": "success"})
 }
 
-func wsConnectionHandler(ctx context.Context, c *app.RequestContext, typ CitrusClientType) error {
+// wsConnectionHandler serves a websocket client, a DG-LAB app client is bound with the given bind token.
+func wsConnectionHandler(ctx context.Context, c *app.RequestContext, typ CitrusClientType, bindToken *BindToken, metadata *ClientMetadata, apiKey *config.APIKey) error {
 	upgrader := websocket.HertzUpgrader{}
 	err := upgrader.Upgrade(c, func(conn *websocket.Conn) {
-		insecureId := getInsecureIdFromRequest(c.ClientIP(), typ)
-		if config.Conf.AllowInsecureClientId {
-			_, err := citrusServer.getClientInsecure(insecureId)
-			if err == nil {
-				fail(ctx, c, "wsConnectionHandler", "We can not register you on this server as insecure client ID is enabled and your IP address is already registered.")
+		// the server may have started shutting down since the request was checked, after it has closed all connections
+		if citrusServer.shuttingDown.Load() {
+			closeConn(conn, "server is shutting down")
+			return
+		}
+		var client *CitrusClient
+		if resumeId := c.Query("resume"); resumeId != "" {
+			var err error
+			client, err = citrusServer.resumeWSClient(typ, ClientSecureId(resumeId), c.Query("token"), conn)
+			if err != nil {
+				httpLog.WarnContext(ctx, "Failed to resume session", "error", err)
+				closeConn(conn, "can not resume session")
+				return
+			}
+		} else if typ == ClientTypeDGApp && bindToken == nil {
+			client = citrusServer.resumeDGAppClient(c.Param("uuid"), conn)
+			if client == nil {
+				// the app has been resumed on another connection or purged since the request was checked
+				httpLog.WarnContext(ctx, "Failed to resume session with binding code")
+				closeConn(conn, "can not resume session")
 				return
 			}
 		}
-		dgClient := citrusServer.newWSClient(typ, insecureId, conn)
-		defer citrusServer.purgeClient(insecureId)
-		dgClient.serve()
+		if client == nil {
+			// DG-LAB apps can not choose a slot, as they connect with the URL in the binding QR code. They are never
+			// addressed by their insecure ID either, so apps behind the same IP address may share it.
+			var slot string
+			if typ != ClientTypeDGApp {
+				slot = c.Query("slot")
+			}
+			insecureId := getInsecureIdFromRequest(c.ClientIP(), typ, slot)
+			if typ != ClientTypeDGApp && citrusServer.insecureClientIdAllowed() && citrusServer.insecureIdInUse(insecureId) {
+				httpLog.WarnContext(ctx, "Insecure client ID derived from client IP is already registered", "clientIp", describeClientIP(c), "slot", slot)
+				closeConn(conn, "insecure client ID is enabled and your IP address is already registered with this slot")
+				return
+			}
+			var err error
+			if typ == ClientTypeDGApp {
+				client, err = citrusServer.newWSClient(typ, insecureId, conn, bindToken, nil, nil)
+			} else {
+				client, err = citrusServer.newWSClient(typ, insecureId, conn, nil, metadata, apiKey)
+			}
+			if err != nil {
+				// another client has been registered with the same API key since it was checked before the upgrade
+				httpLog.WarnContext(ctx, "Failed to register client", "error", err)
+				closeConn(conn, "API key limit reached")
+				return
+			}
+			auditAPIKeyRegistration(ctx, c, apiKey, client)
+			if citrusServer.insecureClientIdAllowed() {
+				httpLog.InfoContext(ctx, "Insecure client ID is derived from client IP", "client", client, "clientIp", describeClientIP(c), "slot", slot)
+			}
+		}
+		citrusServer.markConnected(client, c.ClientIP())
+		defer citrusServer.detachClient(client, conn)
+		client.serve(ctx, conn)
 	})
 	if err != nil {
 		return fmt.Errorf("wsConnectionHandler: Failed to upgrade connection: %v", err)
@@ -148,50 +406,224 @@ func wsConnectionHandler(ctx context.Context, c *app.RequestContext, typ CitrusC
 	return nil
 }
 
-func generateSalt(length int) string {
+// Init sets up the citrus server according to the config, it must be called after the config is loaded.
+func Init() {
+	if err := initLogging(); err != nil {
+		hlog.Fatalf("Init: %v", err)
+	}
+	if err := initPublicURL(); err != nil {
+		hlog.Fatalf("Init: %v", err)
+	}
+	if err := initClientIP(); err != nil {
+		hlog.Fatalf("Init: %v", err)
+	}
+	if err := initQrcode(); err != nil {
+		hlog.Fatalf("Init: %v", err)
+	}
+	if err := initAPIKeys(); err != nil {
+		hlog.Fatalf("Init: %v", err)
+	}
+	if err := initLegacyBindingCodes(); err != nil {
+		hlog.Fatalf("Init: %v", err)
+	}
+	citrusServer.allowInsecureClientId.Store(config.Conf.AllowInsecureClientId)
+	if err := citrusServer.initInsecureIdSalt(); err != nil {
+		hlog.Fatalf("Init: %v", err)
+	}
+	if err := citrusServer.initRecordings(); err != nil {
+		hlog.Fatalf("Init: %v", err)
+	}
+	if err := citrusServer.initAuditStore(); err != nil {
+		hlog.Fatalf("Init: %v", err)
+	}
+	if config.Conf.StateFile != "" {
+		citrusServer.store = NewFileStore(config.Conf.StateFile)
+		err := citrusServer.restore()
+		if err != nil {
+			hlog.Fatalf("Init: failed to restore state: %v", err)
+		}
+	}
+	citrusServer.scheduleInsecureIdSaltRotation()
+}
+
+func generateRandomHex(length int) string {
 	bytes := make([]byte, length)
 	if _, err := rand.Read(bytes); err != nil {
-		hlog.Errorf("generateSalt: Failed to generate salt: %v", err)
-		panic(err)
+		panic(fmt.Errorf("generateRandomHex: Failed to generate random bytes: %v", err))
 	}
 	return hex.EncodeToString(bytes)
 }
 
-func getInsecureIdFromRequest(clientIP string, clientType CitrusClientType) ClientInsecureId {
-	hash, _ := blake2b.New(16, []byte(insecureIdSalt))
+// getInsecureIdFromRequest derives the insecure ID of a client from its IP address, and the slot it has chosen so that
+// multiple clients behind the same IP address can be told apart.
+func getInsecureIdFromRequest(clientIP string, clientType CitrusClientType, slot string) ClientInsecureId {
+	hash, _ := blake2b.New(16, []byte(citrusServer.getInsecureIdSalt()))
 	hash.Write([]byte{byte(clientType)})
-	return ClientInsecureId(hex.EncodeToString(hash.Sum([]byte(clientIP))))
+	hash.Write([]byte(clientIP))
+	// the separator keeps an IP address and a slot from being confused with another IP address and slot
+	hash.Write([]byte{0})
+	hash.Write([]byte(slot))
+	return ClientInsecureId(hex.EncodeToString(hash.Sum(nil)))
+}
+
+// maxInsecureSlotLength is the maximum length of the slot of an insecure client ID.
+const maxInsecureSlotLength = 32
+
+var insecureSlotPattern = regexp.MustCompile(`^[\p{L}\p{N}_.-]*$`)
+
+// getInsecureSlotFromRequest returns the slot a client has chosen for its insecure client ID, it is empty if the client
+// has not chosen one.
+func getInsecureSlotFromRequest(c *app.RequestContext) (string, error) {
+	slot := c.Query("slot")
+	if len([]rune(slot)) > maxInsecureSlotLength || !insecureSlotPattern.MatchString(slot) {
+		return "", fmt.Errorf("slot must be at most %d letters, digits, '_', '.' or '-'", maxInsecureSlotLength)
+	}
+	return slot, nil
+}
+
+const (
+	maxRequesterNameLength = 64
+	maxDescriptionLength   = 256
+	maxLabels              = 16
+	maxLabelKeyLength      = 32
+	maxLabelValueLength    = 64
+)
+
+// getClientMetadataFromRequest parses the metadata a third party client gives on registration, labels are given as
+// repeated label=<key>:<value> query parameters. It returns nil if the client has not given any.
+func getClientMetadataFromRequest(c *app.RequestContext) (*ClientMetadata, error) {
+	metadata := &ClientMetadata{
+		Name:        strings.TrimSpace(c.Query("name")),
+		Description: strings.TrimSpace(c.Query("description")),
+	}
+	if len([]rune(metadata.Name)) > maxRequesterNameLength {
+		return nil, fmt.Errorf("name must not be longer than %d characters", maxRequesterNameLength)
+	}
+	if len([]rune(metadata.Description)) > maxDescriptionLength {
+		return nil, fmt.Errorf("description must not be longer than %d characters", maxDescriptionLength)
+	}
+	labels := c.QueryArgs().PeekAll("label")
+	if len(labels) > maxLabels {
+		return nil, fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for _, label := range labels {
+		key, value, ok := strings.Cut(string(label), ":")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("label %q is not in the form of <key>:<value>", label)
+		}
+		if len([]rune(key)) > maxLabelKeyLength || len([]rune(value)) > maxLabelValueLength {
+			return nil, fmt.Errorf("label keys must not be longer than %d characters, and values not longer than %d characters", maxLabelKeyLength, maxLabelValueLength)
+		}
+		if metadata.Labels == nil {
+			metadata.Labels = make(map[string]string)
+		}
+		metadata.Labels[key] = value
+	}
+	if metadata.Name == "" && metadata.Description == "" && metadata.Labels == nil {
+		return nil, nil
+	}
+	return metadata, nil
+}
+
+// bindingConsentURL returns the address of the page the owner of a DG-LAB app approves a binding request on.
+func bindingConsentURL(secret string) string {
+	return publicURL("/consent/"+secret, false)
+}
+
+var qrcodeContentTypes = map[QrcodeFormat]string{
+	QrcodeFormatJPEG: consts.MIMEImageJPEG,
+	QrcodeFormatPNG:  consts.MIMEImagePNG,
+	QrcodeFormatSVG:  consts.MIMEImageSVG,
+	QrcodeFormatTXT:  consts.MIMETextPlainUTF8,
+}
+
+func getQrcodeOptionsFromRequest(c *app.RequestContext) (*QrcodeOptions, error) {
+	options := DefaultQrcodeOptions()
+	if format := c.Query("format"); format != "" {
+		options.Format = QrcodeFormat(strings.ToLower(format))
+	}
+	for name, value := range map[string]*int{"size": &options.Size, "margin": &options.Margin} {
+		if query := c.Query(name); query != "" {
+			parsed, err := strconv.Atoi(query)
+			if err != nil {
+				return nil, fmt.Errorf("%s must be an integer", name)
+			}
+			*value = parsed
+		}
+	}
+	if ec := c.Query("ec"); ec != "" {
+		options.ErrorCorrection = ec
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return options, nil
 }
 
 func getSecureIdFromHTTPRequest(c *app.RequestContext) (ClientSecureId, error) {
 	var secureId ClientSecureId
 	if clientId := c.Query("clientId"); clientId == "" {
-		if config.Conf.AllowInsecureClientId {
-			insecureId := getInsecureIdFromRequest(c.ClientIP(), ClientTypeThirdPartyHTTP)
+		if citrusServer.insecureClientIdAllowed() {
+			slot, err := getInsecureSlotFromRequest(c)
+			if err != nil {
+				return "", err
+			}
+			insecureId := getInsecureIdFromRequest(c.ClientIP(), ClientTypeThirdPartyHTTP, slot)
 			dgClient, err := citrusServer.getClientInsecure(insecureId)
 			if err != nil {
-				return "", fmt.Errorf("can not match you with an existing client, this may caused by an IP address change of your device or network: %v", err)
+				return "", fmt.Errorf("can not match you with an existing client by your IP address %s and slot %q, this may caused by an IP address change of your device or network: %v", c.ClientIP(), slot, err)
 			}
+			dgClient.touch()
 			secureId = dgClient.secureId
 		} else {
 			return "", fmt.Errorf("no client ID provided, insecure client ID is not allowed on this server")
 		}
 	} else {
 		secureId = ClientSecureId(clientId)
-		_, err := citrusServer.getClientSecure(secureId)
+		client, err := citrusServer.getClientSecure(secureId)
 		if err != nil {
 			return "", fmt.Errorf("can not find the client ID provided: %v", err)
 		}
+		client.touch()
 	}
 	return secureId, nil
 }
 
+func isWebsocketUpgrade(c *app.RequestContext) bool {
+	return strings.EqualFold(string(c.GetHeader("Upgrade")), "websocket")
+}
+
 func wsUpgradeFailed(ctx context.Context, c *app.RequestContext) {
 	c.Response.ResetBody()
 	handler.HomeHandler(ctx, c)
 }
 
 func fail(ctx context.Context, c *app.RequestContext, context string, message string) {
-	hlog.CtxWarnf(ctx, "%s: %s", context, message)
-	c.JSON(http.StatusBadRequest, map[string]interface{}{"code": 400, "message": message})
+	failWithStatus(ctx, c, http.StatusBadRequest, context, message)
+}
+
+func failWithStatus(ctx context.Context, c *app.RequestContext, status int, context string, message string) {
+	httpLog.WarnContext(ctx, "Request failed", "handler", context, "status", status, "message", message)
+	c.JSON(status, map[string]interface{}{"code": status, "message": message})
+}
+
+// failAPIKey responds to a request which failed to authenticate with an API key, or exceeded its limits.
+func failAPIKey(ctx context.Context, c *app.RequestContext, context string, err error) {
+	status := http.StatusForbidden
+	switch {
+	case errors.Is(err, errAPIKeyRequired), errors.Is(err, errAPIKeyInvalid):
+		status = http.StatusUnauthorized
+	case errors.Is(err, errAPIKeyClientLimit):
+		status = http.StatusTooManyRequests
+	}
+	failWithStatus(ctx, c, status, context, err.Error())
+}
+
+// auditAPIKeyRegistration logs which API key a client has been registered with.
+func auditAPIKeyRegistration(ctx context.Context, c *app.RequestContext, apiKey *config.APIKey, client *CitrusClient) {
+	if apiKey == nil {
+		return
+	}
+	auditLog.InfoContext(ctx, "API key registered client", "apiKey", apiKey.Name, "client", client, "remoteIp", c.ClientIP())
 }
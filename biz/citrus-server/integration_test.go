@@ -0,0 +1,2186 @@
+package citrus_server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/cloudwego/hertz/pkg/network/standard"
+	"github.com/gorilla/websocket"
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+const testTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	logOutput = io.Discard
+	os.Exit(m.Run())
+}
+
+// testServer is an in-process citrus server listening on a random local port.
+type testServer struct {
+	t    *testing.T
+	addr string
+}
+
+// startTestServer resets the global citrus server state and starts a Hertz server with the routes of RegisterRoutes.
+func startTestServer(t *testing.T, conf config.Config) *testServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	_, port, _ := net.SplitHostPort(addr)
+
+	conf.HostName = "127.0.0.1"
+	conf.Port = port
+	conf.SetDefaults()
+	config.Conf = conf
+	citrusServer = NewCitrusServer()
+	Init()
+
+	// the standard transport goes through the net package, which lets the race detector see the ordering of requests
+	h := server.New(server.WithHostPorts(addr), server.WithTransport(standard.NewTransporter))
+	h.NoHijackConnPool = true
+	h.LoadHTMLGlob("../../resources/views/*")
+	h.SetClientIPFunc(ClientIP)
+	h.Use(HTTPCorrelation, HTTPMetrics)
+	RegisterRoutes(h)
+	go func() {
+		_ = h.Run()
+	}()
+	s := &testServer{t: t, addr: addr}
+	t.Cleanup(func() {
+		citrusServer.stopInsecureIdSaltRotation()
+		if citrusServer.audit != nil {
+			_ = citrusServer.audit.Close()
+		}
+		citrusServer.closeRecordings()
+		// websocket clients are closed by their own cleanups, wait for them to be purged so the next test starts fresh
+		s.eventually("websocket clients to be purged", func() bool {
+			return s.countWSClients() == 0
+		})
+		http.DefaultClient.CloseIdleConnections()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_ = h.Shutdown(ctx)
+	})
+	s.eventually("server to start", func() bool {
+		resp, err := http.Get(s.url("/ping", nil))
+		if err != nil {
+			return false
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+	return s
+}
+
+func (s *testServer) countWSClients() int {
+	citrusServer.clients.mutex.RLock()
+	defer citrusServer.clients.mutex.RUnlock()
+
+	count := 0
+	for _, client := range citrusServer.clients.secureMapping {
+		if client.conn != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// url returns the address of the given path on the test server, under the configured path prefix.
+func (s *testServer) url(path string, query url.Values) string {
+	u := url.URL{Scheme: "http", Host: s.addr, Path: config.Conf.PathPrefix + path, RawQuery: query.Encode()}
+	return u.String()
+}
+
+// get performs an HTTP GET request and decodes the JSON response body.
+func (s *testServer) get(path string, query url.Values) (int, map[string]interface{}) {
+	s.t.Helper()
+	return s.getWithHeader(path, query, nil)
+}
+
+// getWithHeader is the same as get, but sends the given headers along with the request.
+func (s *testServer) getWithHeader(path string, query url.Values, header http.Header) (int, map[string]interface{}) {
+	s.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.url(path, query), nil)
+	if err != nil {
+		s.t.Fatalf("GET %s failed: %v", path, err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatalf("GET %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body := make(map[string]interface{})
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		s.t.Fatalf("GET %s returned a non-JSON body: %v", path, err)
+	}
+	return resp.StatusCode, body
+}
+
+// getRaw performs an HTTP GET request and returns the raw response body and its content type.
+func (s *testServer) getRaw(path string, query url.Values) (int, string, []byte) {
+	s.t.Helper()
+	resp, err := http.Get(s.url(path, query))
+	if err != nil {
+		s.t.Fatalf("GET %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatalf("GET %s failed to read body: %v", path, err)
+	}
+	return resp.StatusCode, resp.Header.Get("Content-Type"), body
+}
+
+// registerHTTP registers a new HTTP controller and returns its secure ID.
+func (s *testServer) registerHTTP() ClientSecureId {
+	s.t.Helper()
+	status, body := s.get("/v1/register", nil)
+	if status != http.StatusOK {
+		s.t.Fatalf("register failed: %d %v", status, body)
+	}
+	if body["message"] != "targetId" {
+		s.t.Fatalf("unexpected register response: %v", body)
+	}
+	return ClientSecureId(body["clientId"].(string))
+}
+
+// command sends a message through the HTTP command API.
+func (s *testServer) command(secureId ClientSecureId, message string) (int, map[string]interface{}) {
+	s.t.Helper()
+	query := url.Values{"message": {message}}
+	if secureId != "" {
+		query.Set("clientId", string(secureId))
+	}
+	return s.get("/v1/command", query)
+}
+
+func (s *testServer) eventually(what string, condition func() bool) {
+	s.t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			s.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testWSClient is a websocket peer speaking the official protocol, used to simulate both DG-LAB apps and controllers.
+type testWSClient struct {
+	t           *testing.T
+	conn        *websocket.Conn
+	secureId    ClientSecureId
+	resumeToken string
+	// bindingCode is the code a simulated DG-LAB app has connected with, which messages of its controller come from
+	bindingCode ClientSecureId
+	// events receives the messages read from conn, it is closed once the connection is closed
+	events chan *RawEvent
+}
+
+// dial connects to a websocket endpoint and consumes the initial bind message carrying the assigned secure ID.
+func (s *testServer) dial(path string, query url.Values) *testWSClient {
+	s.t.Helper()
+	u := url.URL{Scheme: "ws", Host: s.addr, Path: config.Conf.PathPrefix + path, RawQuery: query.Encode()}
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		s.t.Fatalf("dial %s failed: %v", path, err)
+	}
+	client := &testWSClient{t: s.t, conn: conn, events: make(chan *RawEvent, 16)}
+	s.t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go client.readLoop()
+	event := client.read()
+	if event.Type != EventTypeBind || event.Message != "targetId" {
+		s.t.Fatalf("expected bind message on connect, got %+v", event)
+	}
+	client.secureId = ClientSecureId(event.ClientId)
+	client.resumeToken = event.ResumeToken
+	return client
+}
+
+// dialApp connects a DG-LAB app with the given binding code, and asserts it is bound automatically.
+func (s *testServer) dialApp(bindingCode ClientSecureId) *testWSClient {
+	s.t.Helper()
+	app := s.dial("/app/"+string(bindingCode), nil)
+	app.bindingCode = bindingCode
+	expectEvent(s.t, app.read(), EventTypeBind, bindingCode, app.secureId, "200")
+	return app
+}
+
+// dialAppFor connects a DG-LAB app with a bind token of the given controller, as if it has scanned its QR code.
+func (s *testServer) dialAppFor(controllerId ClientSecureId) *testWSClient {
+	s.t.Helper()
+	token, _ := s.requestBindToken(controllerId, "")
+	return s.dialApp(token)
+}
+
+// resumeApp reconnects a DG-LAB app with its resume token, and asserts it is bound again with its binding code.
+func (s *testServer) resumeApp(app *testWSClient, bindingCode ClientSecureId) *testWSClient {
+	s.t.Helper()
+	resumed := s.dial("/app/"+string(bindingCode), url.Values{"resume": {string(app.secureId)}, "token": {app.resumeToken}})
+	if resumed.secureId != app.secureId {
+		s.t.Fatalf("app should resume its previous secure ID %s, got %s", app.secureId, resumed.secureId)
+	}
+	expectEvent(s.t, resumed.read(), EventTypeBind, bindingCode, app.secureId, "200")
+	return resumed
+}
+
+func (s *testServer) dialController() *testWSClient {
+	s.t.Helper()
+	return s.dial("/v1/ws", nil)
+}
+
+func (c *testWSClient) send(event RawEvent) {
+	c.t.Helper()
+	data, err := json.Marshal(event)
+	if err != nil {
+		c.t.Fatalf("failed to marshal event: %v", err)
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		c.t.Fatalf("failed to send event: %v", err)
+	}
+}
+
+func (c *testWSClient) readLoop() {
+	defer close(c.events)
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		event := &RawEvent{}
+		if err := event.FromByteArray(data); err != nil {
+			event.Message = fmt.Sprintf("unparsable message %q: %v", data, err)
+		}
+		c.events <- event
+	}
+}
+
+func (c *testWSClient) read() *RawEvent {
+	c.t.Helper()
+	select {
+	case event, ok := <-c.events:
+		if !ok {
+			c.t.Fatalf("connection closed while waiting for an event")
+		}
+		return event
+	case <-time.After(testTimeout):
+		c.t.Fatalf("timed out waiting for an event")
+		return nil
+	}
+}
+
+// expectNothing asserts that no message arrives within a short period.
+func (c *testWSClient) expectNothing() {
+	c.t.Helper()
+	select {
+	case event, ok := <-c.events:
+		if ok {
+			c.t.Fatalf("expected no message, got %+v", *event)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// expectClosed asserts that the server closes the connection.
+func (c *testWSClient) expectClosed() {
+	c.t.Helper()
+	for {
+		select {
+		case _, ok := <-c.events:
+			if !ok {
+				return
+			}
+		case <-time.After(testTimeout):
+			c.t.Fatalf("timed out waiting for the connection to be closed")
+		}
+	}
+}
+
+// bind sends the DG-LAB app bind request with the given binding code and asserts the app receives a successful result.
+func (c *testWSClient) bind(bindingCode ClientSecureId) {
+	c.t.Helper()
+	c.send(RawEvent{Type: EventTypeBind, ClientId: string(bindingCode), TargetId: string(c.secureId), Message: "DGLAB"})
+	expectEvent(c.t, c.read(), EventTypeBind, bindingCode, c.secureId, "200")
+}
+
+func expectEvent(t *testing.T, event *RawEvent, typ EventType, clientId ClientSecureId, targetId ClientSecureId, message string) {
+	t.Helper()
+	want := RawEvent{Type: typ, ClientId: string(clientId), TargetId: string(targetId), Message: message}
+	if *event != want {
+		t.Fatalf("unexpected event:\n got: %+v\nwant: %+v", *event, want)
+	}
+}
+
+func expectStatus(t *testing.T, status int, body map[string]interface{}, want int) {
+	t.Helper()
+	if status != want {
+		t.Fatalf("unexpected status %d (want %d): %v", status, want, body)
+	}
+}
+
+func TestHTTPControllerFlow(t *testing.T) {
+	s := startTestServer(t, config.Config{})
+	controllerId := s.registerHTTP()
+
+	resp, err := http.Get(s.url("/v1/bind", url.Values{"clientId": {string(controllerId)}}))
+	if err != nil {
+		t.Fatalf("bind qrcode request failed: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("unexpected bind qrcode response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	app := s.dialAppFor(controllerId)
+	app.bind(app.bindingCode)
+
+	status, body := s.command(controllerId, "strength-1+1+5")
+	expectStatus(t, status, body, http.StatusOK)
+	expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, "strength-1+1+5")
+
+	pulse := `pulse-A:["0a0a0a0a64646464","0a0a0a0a00000000"]`
+	status, body = s.command(controllerId, pulse)
+	expectStatus(t, status, body, http.StatusOK)
+	expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, pulse)
+
+	status, body = s.command(controllerId, "clear-2")
+	expectStatus(t, status, body, http.StatusOK)
+	expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, "clear-2")
+
+	status, body = s.get("/v1/heartbeat", url.Values{"clientId": {string(controllerId)}})
+	expectStatus(t, status, body, http.StatusOK)
+
+	status, body = s.command(controllerId, "bogus")
+	expectStatus(t, status, body, http.StatusBadRequest)
+	status, body = s.command("not-a-client", "clear-1")
+	expectStatus(t, status, body, http.StatusBadRequest)
+	status, body = s.command("", "clear-1")
+	expectStatus(t, status, body, http.StatusBadRequest)
+}
+
+func TestWSControllerFlow(t *testing.T) {
+	s := startTestServer(t, config.Config{})
+	controller := s.dialController()
+	app := s.dialAppFor(controller.secureId)
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+
+	// the app binds itself again as in the official protocol, which is only acknowledged to the app
+	app.bind(app.bindingCode)
+	controller.expectNothing()
+
+	// binding to an unknown controller is rejected
+	app.send(RawEvent{Type: EventTypeBind, ClientId: "unknown", TargetId: string(app.secureId), Message: "DGLAB"})
+	expectEvent(t, app.read(), EventTypeBind, "unknown", app.secureId, "400")
+
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-2+2+20"})
+	expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, "strength-2+2+20")
+
+	pulse := `pulse-B:["0a0a0a0a64646464"]`
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: pulse})
+	expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, pulse)
+
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-10+20+100+100"})
+	expectEvent(t, controller.read(), EventTypeMsg, controller.secureId, app.secureId, "strength-10+20+100+100")
+
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "feedback-7"})
+	expectEvent(t, controller.read(), EventTypeMsg, controller.secureId, app.secureId, "feedback-7")
+
+	app.send(RawEvent{Type: EventTypeHeartbeat, ClientId: string(controller.secureId), TargetId: string(app.secureId)})
+	controller.expectNothing()
+}
+
+func TestMixedControllersFlow(t *testing.T) {
+	s := startTestServer(t, config.Config{LegacyBindingCodes: true, LegacyBindingScope: "full"})
+	wsController := s.dialController()
+	httpController := s.registerHTTP()
+	app := s.dialAppFor(wsController.secureId)
+
+	app.bind(app.bindingCode)
+	expectEvent(t, wsController.read(), EventTypeBind, wsController.secureId, app.secureId, "200")
+	// the app binds to another controller with its client ID, as with a legacy binding code
+	app.bind(httpController)
+
+	status, body := s.command(httpController, "strength-1+0+3")
+	expectStatus(t, status, body, http.StatusOK)
+	expectEvent(t, app.read(), EventTypeMsg, httpController, app.secureId, "strength-1+0+3")
+
+	// reports are only forwarded to websocket controllers
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(wsController.secureId), TargetId: string(app.secureId), Message: "strength-7+0+100+100"})
+	expectEvent(t, wsController.read(), EventTypeMsg, wsController.secureId, app.secureId, "strength-7+0+100+100")
+}
+
+func TestDisconnectPurgesClient(t *testing.T) {
+	s := startTestServer(t, config.Config{ResumeGracePeriod: 50 * time.Millisecond, LegacyBindingCodes: true, LegacyBindingScope: "full"})
+	controller := s.dialController()
+	httpController := s.registerHTTP()
+	app := s.dialAppFor(controller.secureId)
+	app.bind(app.bindingCode)
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+	app.bind(httpController)
+
+	_ = controller.conn.Close()
+	expectEvent(t, app.read(), EventTypeBreak, app.bindingCode, app.secureId, "209")
+	_, err := citrusServer.getClientSecure(controller.secureId)
+	if err == nil {
+		t.Fatalf("controller should be purged")
+	}
+	bindings, err := citrusServer.getClientBindings(app.secureId)
+	if err != nil {
+		t.Fatalf("app should still be registered: %v", err)
+	}
+	if len(bindings) != 1 || bindings[0].peer.secureId != httpController {
+		t.Fatalf("app should only be bound to the HTTP controller, got %d bindings", len(bindings))
+	}
+
+	_ = app.conn.Close()
+	s.eventually("app to be purged", func() bool {
+		_, err := citrusServer.getClientSecure(app.secureId)
+		return err != nil
+	})
+	bindings, err = citrusServer.getClientBindings(httpController)
+	if err != nil {
+		t.Fatalf("HTTP controller should still be registered: %v", err)
+	}
+	if len(bindings) != 0 {
+		t.Fatalf("HTTP controller should have no bindings left, got %d", len(bindings))
+	}
+	status, body := s.command(httpController, "clear-1")
+	expectStatus(t, status, body, http.StatusOK)
+}
+
+func TestInsecureClientIdMode(t *testing.T) {
+	s := startTestServer(t, config.Config{AllowInsecureClientId: true})
+	controllerId := s.registerHTTP()
+
+	status, body := s.get("/v1/register", nil)
+	expectStatus(t, status, body, http.StatusBadRequest)
+
+	app := s.dialAppFor(controllerId)
+	app.bind(app.bindingCode)
+
+	status, body = s.command("", "strength-1+2+"+strconv.Itoa(10))
+	expectStatus(t, status, body, http.StatusOK)
+	expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, "strength-1+2+10")
+
+	status, body = s.get("/v1/heartbeat", nil)
+	expectStatus(t, status, body, http.StatusOK)
+}
+
+func TestInsecureClientIdModeAllowsAppsBehindOneAddress(t *testing.T) {
+	s := startTestServer(t, config.Config{AllowInsecureClientId: true})
+	first := s.dial("/v1/ws", url.Values{"slot": {"first"}})
+	second := s.dial("/v1/ws", url.Values{"slot": {"second"}})
+
+	// both apps connect from the loopback address, like phones sharing a home network
+	firstApp := s.dialAppFor(first.secureId)
+	expectEvent(t, first.read(), EventTypeBind, first.secureId, firstApp.secureId, "200")
+	secondApp := s.dialAppFor(second.secureId)
+	expectEvent(t, second.read(), EventTypeBind, second.secureId, secondApp.secureId, "200")
+
+	for _, tc := range []struct{ controller, app *testWSClient }{{first, firstApp}, {second, secondApp}} {
+		tc.controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(tc.controller.secureId), TargetId: string(tc.app.secureId), Message: "strength-1+2+10"})
+		expectEvent(t, tc.app.read(), EventTypeMsg, tc.app.bindingCode, tc.app.secureId, "strength-1+2+10")
+	}
+}
+
+func TestSecureModeRequiresClientId(t *testing.T) {
+	s := startTestServer(t, config.Config{})
+	s.registerHTTP()
+	s.registerHTTP()
+
+	status, body := s.get("/v1/heartbeat", nil)
+	expectStatus(t, status, body, http.StatusBadRequest)
+	if msg := fmt.Sprint(body["message"]); msg == "" {
+		t.Fatalf("expected an explanation, got %v", body)
+	}
+}
+
+func TestStateSurvivesRestart(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	var controllerId ClientSecureId
+	var app *testWSClient
+	var state []byte
+	t.Run("before restart", func(t *testing.T) {
+		s := startTestServer(t, config.Config{StateFile: stateFile})
+		controllerId = s.registerHTTP()
+		app = s.dialAppFor(controllerId)
+		app.bind(app.bindingCode)
+
+		// keep the state as it was when the server went down, before the app connection is purged
+		var err error
+		state, err = os.ReadFile(stateFile)
+		if err != nil {
+			t.Fatalf("state file was not written: %v", err)
+		}
+	})
+	if err := os.WriteFile(stateFile, state, 0o600); err != nil {
+		t.Fatalf("failed to restore state file: %v", err)
+	}
+
+	s := startTestServer(t, config.Config{StateFile: stateFile})
+	status, body := s.command(controllerId, "clear-1")
+	expectStatus(t, status, body, http.StatusOK)
+
+	// the restored app is detached, it resumes when it reconnects with the URL of the binding QR code like the official app
+	resumed := s.dialApp(app.bindingCode)
+	if resumed.secureId != app.secureId {
+		t.Fatalf("app should resume its previous secure ID %s, got %s", app.secureId, resumed.secureId)
+	}
+	// while it is connected, its binding code can not be used to take over the session
+	status, body = s.get("/app/"+string(app.bindingCode), nil)
+	expectStatus(t, status, body, http.StatusBadRequest)
+
+	// the resume token takes over the session from the current connection
+	again := s.resumeApp(app, app.bindingCode)
+	resumed.expectClosed()
+	again.bind(app.bindingCode)
+	status, body = s.command(controllerId, "strength-1+1+1")
+	expectStatus(t, status, body, http.StatusOK)
+	expectEvent(t, again.read(), EventTypeMsg, app.bindingCode, app.secureId, "strength-1+1+1")
+}
+
+func TestRestoredClientsExpire(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	store := NewFileStore(stateFile)
+	err := store.Save(&Snapshot{Clients: []ClientSnapshot{
+		{Type: ClientTypeThirdPartyHTTP, SecureId: "controller", Bindings: []ClientSecureId{"app"}},
+		{Type: ClientTypeDGApp, SecureId: "app", Bindings: []ClientSecureId{"controller"}},
+	}})
+	if err != nil {
+		t.Fatalf("failed to save state: %v", err)
+	}
+
+	s := startTestServer(t, config.Config{StateFile: stateFile, ResumeGracePeriod: 50 * time.Millisecond})
+	s.eventually("app to expire", func() bool {
+		_, err := citrusServer.getClientSecure("app")
+		return err != nil
+	})
+	bindings, err := citrusServer.getClientBindings("controller")
+	if err != nil || len(bindings) != 0 {
+		t.Fatalf("controller should be kept without bindings: %v, %d", err, len(bindings))
+	}
+	snapshot, err := store.Load()
+	if err != nil || len(snapshot.Clients) != 1 {
+		t.Fatalf("expired client should be removed from the state file: %v, %+v", err, snapshot)
+	}
+}
+
+func TestWSControllerResume(t *testing.T) {
+	s := startTestServer(t, config.Config{})
+	controller := s.dialController()
+	if controller.resumeToken == "" {
+		t.Fatalf("controller should receive a resume token")
+	}
+	app := s.dialAppFor(controller.secureId)
+	app.bind(app.bindingCode)
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+
+	resp, err := http.Get(s.url("/v1/ws", url.Values{"resume": {string(controller.secureId)}, "token": {"wrong"}}))
+	if err != nil {
+		t.Fatalf("resume request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("resuming with a wrong token should be rejected, got %d", resp.StatusCode)
+	}
+
+	_ = controller.conn.Close()
+	s.eventually("controller to be detached", func() bool {
+		return s.countWSClients() == 1
+	})
+	app.expectNothing()
+
+	resumed := s.dial("/v1/ws", url.Values{"resume": {string(controller.secureId)}, "token": {controller.resumeToken}})
+	if resumed.secureId != controller.secureId {
+		t.Fatalf("resumed session should keep secure ID %s, got %s", controller.secureId, resumed.secureId)
+	}
+	resumed.send(RawEvent{Type: EventTypeMsg, ClientId: string(resumed.secureId), TargetId: string(app.secureId), Message: "clear-1"})
+	expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, "clear-1")
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(resumed.secureId), TargetId: string(app.secureId), Message: "feedback-0"})
+	expectEvent(t, resumed.read(), EventTypeMsg, resumed.secureId, app.secureId, "feedback-0")
+
+	// resuming again takes over the session from the current connection
+	again := s.dial("/v1/ws", url.Values{"resume": {string(controller.secureId)}, "token": {controller.resumeToken}})
+	resumed.expectClosed()
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(again.secureId), TargetId: string(app.secureId), Message: "feedback-1"})
+	expectEvent(t, again.read(), EventTypeMsg, again.secureId, app.secureId, "feedback-1")
+}
+
+func TestAppBindingCodeValidation(t *testing.T) {
+	s := startTestServer(t, config.Config{})
+	controller := s.dialController()
+	app := s.dialAppFor(controller.secureId)
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+
+	// the client ID of a controller is only a binding code with LegacyBindingCodes
+	for _, id := range []ClientSecureId{"unknown", app.secureId, controller.secureId} {
+		status, body := s.get("/app/"+string(id), nil)
+		expectStatus(t, status, body, http.StatusBadRequest)
+		u := url.URL{Scheme: "ws", Host: s.addr, Path: "/app/" + string(id)}
+		_, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("connecting with binding code %s should be rejected", id)
+		}
+		_ = resp.Body.Close()
+	}
+}
+
+func TestBindTokens(t *testing.T) {
+	s := startTestServer(t, config.Config{BindTokenTTL: time.Second})
+	controller := s.dialController()
+	token := ClientSecureId(citrusServer.newBindToken(controller.secureId, "", BindingScopeFull).token)
+
+	// the app only ever sees the bind token instead of the secure ID of the controller
+	app := s.dialApp(token)
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+	app.bind(token)
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "clear-1"})
+	expectEvent(t, app.read(), EventTypeMsg, token, app.secureId, "clear-1")
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(token), TargetId: string(app.secureId), Message: "feedback-2"})
+	expectEvent(t, controller.read(), EventTypeMsg, controller.secureId, app.secureId, "feedback-2")
+
+	// bind tokens can only be used once
+	status, body := s.get("/app/"+string(token), nil)
+	expectStatus(t, status, body, http.StatusBadRequest)
+
+	expired := citrusServer.newBindToken(controller.secureId, "", BindingScopeFull).token
+	time.Sleep(1100 * time.Millisecond)
+	status, body = s.get("/app/"+expired, nil)
+	expectStatus(t, status, body, http.StatusBadRequest)
+
+	// a disconnected app takes up its session again with the used bind token, as the official app reconnects with the
+	// URL of the QR code, or with its resume token
+	_ = app.conn.Close()
+	s.eventually("app to be detached", func() bool {
+		return s.countWSClients() == 1
+	})
+	status, body = s.get("/app/"+string(token), url.Values{"resume": {string(app.secureId)}, "token": {"wrong"}})
+	expectStatus(t, status, body, http.StatusBadRequest)
+	resumed := s.dialApp(token)
+	if resumed.secureId != app.secureId {
+		t.Fatalf("app should resume its previous secure ID %s, got %s", app.secureId, resumed.secureId)
+	}
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "clear-2"})
+	expectEvent(t, resumed.read(), EventTypeMsg, token, app.secureId, "clear-2")
+	_ = resumed.conn.Close()
+	s.eventually("app to be detached", func() bool {
+		return s.countWSClients() == 1
+	})
+	resumed = s.resumeApp(app, token)
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "clear-1"})
+	expectEvent(t, resumed.read(), EventTypeMsg, token, app.secureId, "clear-1")
+
+	// once the session has expired, the used bind token does not bind a new app
+	_ = resumed.conn.Close()
+	s.eventually("app to be detached", func() bool {
+		return s.countWSClients() == 1
+	})
+	citrusServer.purgeClient(context.Background(), app.secureId)
+	expectEvent(t, controller.read(), EventTypeBreak, controller.secureId, app.secureId, "209")
+	status, body = s.get("/app/"+string(token), nil)
+	expectStatus(t, status, body, http.StatusBadRequest)
+}
+
+func TestLegacyBindingCodes(t *testing.T) {
+	s := startTestServer(t, config.Config{LegacyBindingCodes: true})
+	controller := s.dialController()
+
+	// the client ID of the controller is a binding code as in QR codes made for the official server, which only gets
+	// the pulse-only scope by default
+	app := s.dialApp(controller.secureId)
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+	pulse := `pulse-A:["0a0a0a0a64646464"]`
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: pulse})
+	expectEvent(t, app.read(), EventTypeMsg, controller.secureId, app.secureId, pulse)
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-1+2+10"})
+	expectEvent(t, controller.read(), EventTypeError, controller.secureId, app.secureId, strconv.Itoa(ErrorCodePermissionDenied))
+	app.expectNothing()
+
+	// an app connected with a bind token can also bind to another controller with its client ID
+	other := s.registerHTTP()
+	tokenApp := s.dialAppFor(controller.secureId)
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, tokenApp.secureId, "200")
+	tokenApp.bind(other)
+	status, body := s.command(other, "strength-1+2+10")
+	expectStatus(t, status, body, http.StatusBadRequest)
+	tokenApp.expectNothing()
+}
+
+func TestControllersCanNotSendAppEvents(t *testing.T) {
+	s := startTestServer(t, config.Config{})
+	owner := s.dialController()
+	app := s.dialAppFor(owner.secureId)
+	expectEvent(t, owner.read(), EventTypeBind, owner.secureId, app.secureId, "200")
+
+	// another controller knowing the secure ID of the app can not bind itself to it as if it was the app
+	controller := s.dialController()
+	controller.send(RawEvent{Type: EventTypeBind, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "DGLAB"})
+	expectEvent(t, controller.read(), EventTypeError, controller.secureId, app.secureId, strconv.Itoa(ErrorCodePermissionDenied))
+	if bindings, err := citrusServer.listBindings(controller.secureId); err != nil || len(bindings) != 0 {
+		t.Fatalf("expected the controller not to be bound, got %v %v", bindings, err)
+	}
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "clear-1"})
+	app.expectNothing()
+
+	// nor report strength or feedback in the name of the app
+	owner.send(RawEvent{Type: EventTypeMsg, ClientId: string(owner.secureId), TargetId: string(app.secureId), Message: "strength-0+0+200+200"})
+	expectEvent(t, owner.read(), EventTypeError, owner.secureId, app.secureId, strconv.Itoa(ErrorCodePermissionDenied))
+	status, body := s.command(s.registerHTTP(), "feedback-0")
+	expectStatus(t, status, body, http.StatusForbidden)
+	owner.expectNothing()
+	app.expectNothing()
+}
+
+func TestBindingQrcodeFormats(t *testing.T) {
+	s := startTestServer(t, config.Config{})
+	controller := s.registerHTTP()
+	query := func(options ...string) url.Values {
+		values := url.Values{"clientId": {string(controller)}}
+		for i := 0; i+1 < len(options); i += 2 {
+			values.Set(options[i], options[i+1])
+		}
+		return values
+	}
+
+	// the json format returns the payload for clients rendering their own QR code, which is a working bind token
+	status, body := s.get("/v1/bind", query("format", "json"))
+	expectStatus(t, status, body, http.StatusOK)
+	payload, _ := body["url"].(string)
+	prefix := fmt.Sprintf("%s#%s#ws://%s/app/", DGAppWebsiteLink, DGAppWebsocketTag, s.addr)
+	if !strings.HasPrefix(payload, prefix) {
+		t.Fatalf("unexpected payload %q, want prefix %q", payload, prefix)
+	}
+	if _, err := time.Parse(time.RFC3339, fmt.Sprint(body["expiresAt"])); err != nil {
+		t.Fatalf("unexpected expiresAt %v: %v", body["expiresAt"], err)
+	}
+	token := ClientSecureId(strings.TrimPrefix(payload, prefix))
+	app := s.dialApp(token)
+	app.bind(token)
+
+	status, contentType, raw := s.getRaw("/v1/bind", query())
+	if status != http.StatusOK || contentType != "image/jpeg" {
+		t.Fatalf("unexpected default response: %d %s", status, contentType)
+	}
+	if _, err := jpeg.Decode(strings.NewReader(string(raw))); err != nil {
+		t.Fatalf("default QR code is not a JPEG image: %v", err)
+	}
+
+	status, contentType, raw = s.getRaw("/v1/bind", query("format", "png", "size", "4", "margin", "0", "ec", "L"))
+	if status != http.StatusOK || contentType != "image/png" {
+		t.Fatalf("unexpected png response: %d %s", status, contentType)
+	}
+	img, err := png.Decode(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatalf("QR code is not a PNG image: %v", err)
+	}
+	// every QR code version is 4k+17 modules wide, and the modules are 4 pixels wide without a margin
+	if width := img.Bounds().Dx(); width%4 != 0 || (width/4-17)%4 != 0 {
+		t.Fatalf("unexpected PNG width %d", width)
+	}
+
+	status, contentType, raw = s.getRaw("/v1/bind", query("format", "svg"))
+	if status != http.StatusOK || contentType != "image/svg+xml" || !strings.HasPrefix(string(raw), "<svg ") {
+		t.Fatalf("unexpected svg response: %d %s %q", status, contentType, raw)
+	}
+
+	status, contentType, raw = s.getRaw("/v1/bind", query("format", "txt", "margin", "2"))
+	if status != http.StatusOK || !strings.HasPrefix(contentType, "text/plain") {
+		t.Fatalf("unexpected txt response: %d %s", status, contentType)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+	if strings.TrimSpace(lines[0]) != "" || !strings.ContainsRune(lines[1], '█') {
+		t.Fatalf("unexpected txt QR code:\n%s", raw)
+	}
+
+	for _, invalid := range []url.Values{
+		query("format", "gif"),
+		query("size", "0"),
+		query("size", "big"),
+		query("margin", "-1"),
+		query("size", "255", "margin", "16"),
+		query("format", "png", "size", "80"),
+		query("ec", "X"),
+	} {
+		status, body := s.get("/v1/bind", invalid)
+		expectStatus(t, status, body, http.StatusBadRequest)
+	}
+}
+
+// requestBindToken requests a binding QR code as json, and returns the bind token in it along with the response body.
+func (s *testServer) requestBindToken(controllerId ClientSecureId, name string) (ClientSecureId, map[string]interface{}) {
+	s.t.Helper()
+	status, body := s.get("/v1/bind", url.Values{"clientId": {string(controllerId)}, "format": {"json"}, "name": {name}})
+	expectStatus(s.t, status, body, http.StatusOK)
+	payload, _ := body["url"].(string)
+	return ClientSecureId(payload[strings.LastIndex(payload, "/")+1:]), body
+}
+
+// expectConsentRequest asserts that an app connected with a bind token is waiting for approval, and returns the consent
+// secret of its consent page.
+func expectConsentRequest(t *testing.T, app *testWSClient, token ClientSecureId) string {
+	t.Helper()
+	event := app.read()
+	if event.Type != EventTypeBind || event.ClientId != string(token) || event.TargetId != string(app.secureId) || event.Message != "202" || event.ConsentURL == "" {
+		t.Fatalf("expected the binding to wait for approval, got %+v", *event)
+	}
+	return event.ConsentURL[strings.LastIndex(event.ConsentURL, "/")+1:]
+}
+
+// consent opens the consent page of a consent secret, and submits the given action unless it is empty.
+func (s *testServer) consent(secret string, action string) (int, string) {
+	s.t.Helper()
+	var resp *http.Response
+	var err error
+	if action == "" {
+		resp, err = http.Get(s.url("/consent/"+secret, nil))
+	} else {
+		resp, err = http.PostForm(s.url("/consent/"+secret, nil), url.Values{"action": {action}})
+	}
+	if err != nil {
+		s.t.Fatalf("consent request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// ownerPage opens the consent page list with the given headers, and returns the page.
+func (s *testServer) ownerPage(header http.Header) string {
+	s.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.url("/consent", nil), nil)
+	if err != nil {
+		s.t.Fatalf("consent list request failed: %v", err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatalf("consent list request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		s.t.Fatalf("unexpected consent list: %d\n%s", resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+// pendingConsents opens the consent page list with the given headers, and returns the consent secrets linked on it.
+func (s *testServer) pendingConsents(header http.Header) []string {
+	s.t.Helper()
+	var secrets []string
+	for _, link := range strings.Split(s.ownerPage(header), `href="consent/`)[1:] {
+		secrets = append(secrets, link[:strings.Index(link, `"`)])
+	}
+	return secrets
+}
+
+// auditKeys opens the consent page list with the given headers, and returns the audit keys of the apps linked on it.
+func (s *testServer) auditKeys(header http.Header) map[ClientSecureId]string {
+	s.t.Helper()
+	keys := make(map[ClientSecureId]string)
+	for _, link := range strings.Split(s.ownerPage(header), `href="v1/audit?`)[1:] {
+		query, err := url.ParseQuery(strings.ReplaceAll(link[:strings.Index(link, `"`)], "&amp;", "&"))
+		if err != nil {
+			s.t.Fatalf("invalid audit link %q: %v", link, err)
+		}
+		keys[ClientSecureId(query.Get("appId"))] = query.Get("key")
+	}
+	return keys
+}
+
+func TestBindingApproval(t *testing.T) {
+	s := startTestServer(t, config.Config{RequireBindingApproval: true})
+	controller := s.dialController()
+
+	status, body := s.get("/v1/bind", url.Values{"clientId": {string(controller.secureId)}, "format": {"json"}})
+	expectStatus(t, status, body, http.StatusBadRequest)
+	// the secure ID of a controller does not come with a display name
+	status, body = s.get("/app/"+string(controller.secureId), nil)
+	expectStatus(t, status, body, http.StatusBadRequest)
+
+	token, body := s.requestBindToken(controller.secureId, "Citrus World")
+	if _, ok := body["consentUrl"]; ok {
+		t.Fatalf("the controller must not get the consent page: %v", body)
+	}
+	app := s.dial("/app/"+string(token), nil)
+	secret := expectConsentRequest(t, app, token)
+	// the controller holds the bind token, which does not open the consent page, so it can not approve its own request
+	for _, guess := range []string{string(token), string(controller.secureId)} {
+		if status, _ := s.consent(guess, "approve"); status != http.StatusNotFound {
+			t.Fatalf("expected the consent page to be unknown to the controller, got %d", status)
+		}
+	}
+	// the binding stays pending until the owner of the app approves it
+	app.send(RawEvent{Type: EventTypeBind, ClientId: string(token), TargetId: string(app.secureId), Message: "DGLAB"})
+	if again := expectConsentRequest(t, app, token); again != secret {
+		t.Fatalf("expected the same consent secret, got %s and %s", secret, again)
+	}
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "clear-1"})
+	app.expectNothing()
+	controller.expectNothing()
+
+	status, page := s.consent(secret, "")
+	if status != http.StatusOK || !strings.Contains(page, "Citrus World") || !strings.Contains(page, "waiting for your decision") {
+		t.Fatalf("unexpected consent page: %d\n%s", status, page)
+	}
+	status, page = s.consent(secret, "approve")
+	if status != http.StatusOK || !strings.Contains(page, "You have allowed") {
+		t.Fatalf("unexpected consent page after approval: %d\n%s", status, page)
+	}
+	expectEvent(t, app.read(), EventTypeBind, token, app.secureId, "200")
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "clear-1"})
+	expectEvent(t, app.read(), EventTypeMsg, token, app.secureId, "clear-1")
+	status, _ = s.consent(secret, "approve")
+	if status != http.StatusNotFound {
+		t.Fatalf("a completed binding request should be gone, got %d", status)
+	}
+
+	// a denied binding request fails the bind of the waiting app
+	denied, _ := s.requestBindToken(controller.secureId, "Citrus World")
+	deniedApp := s.dial("/app/"+string(denied), nil)
+	deniedSecret := expectConsentRequest(t, deniedApp, denied)
+	if status, page := s.consent(deniedSecret, "deny"); status != http.StatusOK || !strings.Contains(page, "You have denied") {
+		t.Fatalf("unexpected consent page after denial: %d\n%s", status, page)
+	}
+	expectEvent(t, deniedApp.read(), EventTypeBind, denied, deniedApp.secureId, "400")
+	controller.expectNothing()
+}
+
+func TestBindingApprovalOwnerPage(t *testing.T) {
+	s := startTestServer(t, config.Config{RequireBindingApproval: true})
+	controller := s.dialController()
+	token, _ := s.requestBindToken(controller.secureId, "Citrus World")
+	// the owner can not tell the binding request apart from any other on the app, which ignores unknown fields
+	app := s.dial("/app/"+string(token), nil)
+	if event := app.read(); event.Type != EventTypeBind || event.Message != "202" {
+		t.Fatalf("expected the binding to wait for approval, got %+v", *event)
+	}
+
+	// the controller sees no requests from elsewhere, here a proxy forwarding the request of another address
+	if secrets := s.pendingConsents(http.Header{"X-Forwarded-For": {"203.0.113.1"}}); len(secrets) != 0 {
+		t.Fatalf("expected no binding requests for another address, got %v", secrets)
+	}
+	// the owner opens the list on the device the app runs on
+	secrets := s.pendingConsents(nil)
+	if len(secrets) != 1 {
+		t.Fatalf("expected one binding request for the address of the app, got %v", secrets)
+	}
+	status, page := s.consent(secrets[0], "")
+	if status != http.StatusOK || !strings.Contains(page, "Citrus World") {
+		t.Fatalf("unexpected consent page: %d\n%s", status, page)
+	}
+	if status, page = s.consent(secrets[0], "approve"); status != http.StatusOK || !strings.Contains(page, "You have allowed") {
+		t.Fatalf("unexpected consent page after approval: %d\n%s", status, page)
+	}
+	expectEvent(t, app.read(), EventTypeBind, token, app.secureId, "200")
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+	if secrets := s.pendingConsents(nil); len(secrets) != 0 {
+		t.Fatalf("expected an approved binding request to leave the list, got %v", secrets)
+	}
+}
+
+func TestControllerMetadata(t *testing.T) {
+	s := startTestServer(t, config.Config{LegacyBindingCodes: true})
+
+	status, body := s.get("/v1/register", url.Values{"label": {"no separator"}})
+	expectStatus(t, status, body, http.StatusBadRequest)
+	status, body = s.get("/v1/register", url.Values{"name": {"Overlay"}, "description": {"Stream overlay"}, "label": {"world:Citrus Island", "avatar:Tundra"}})
+	if status != http.StatusOK {
+		t.Fatalf("failed to register: %d %v", status, body)
+	}
+	httpController := ClientSecureId(fmt.Sprint(body["clientId"]))
+
+	wsController := s.dial("/v1/ws", url.Values{"name": {"Citrus World"}})
+	token, _ := s.requestBindToken(wsController.secureId, "")
+	app := s.dial("/app/"+string(token), nil)
+	// bind results tell the app who it is bound to
+	result := app.read()
+	if result.Message != "200" || result.Controller == nil || result.Controller.Name != "Citrus World" {
+		t.Fatalf("unexpected bind result %+v", result)
+	}
+	if result := wsController.read(); result.Message != "200" || result.Controller == nil || result.Controller.Name != "Citrus World" {
+		t.Fatalf("unexpected bind result %+v", result)
+	}
+	// the app binds to another controller with its client ID, as with a legacy binding code
+	app.send(RawEvent{Type: EventTypeBind, ClientId: string(httpController), TargetId: string(app.secureId), Message: "DGLAB"})
+	if result := app.read(); result.Message != "200" || result.Controller == nil || result.Controller.Labels["world"] != "Citrus Island" {
+		t.Fatalf("unexpected bind result %+v", result)
+	}
+
+	status, raw := func() (int, string) {
+		status, _, raw := s.getRaw("/v1/bindings", url.Values{"clientId": {string(httpController)}})
+		return status, string(raw)
+	}()
+	if status != http.StatusOK || strings.Contains(raw, string(wsController.secureId)) {
+		t.Fatalf("binding listings must not reveal the secure IDs of other controllers: %d %s", status, raw)
+	}
+	var listing struct {
+		Bindings []BindingInfo `json:"bindings"`
+	}
+	if err := json.Unmarshal([]byte(raw), &listing); err != nil {
+		t.Fatalf("failed to parse binding listing %s: %v", raw, err)
+	}
+	if len(listing.Bindings) != 1 || listing.Bindings[0].AppId != app.secureId || !listing.Bindings[0].Connected || len(listing.Bindings[0].Controllers) != 2 {
+		t.Fatalf("unexpected binding listing %s", raw)
+	}
+	for _, controller := range listing.Bindings[0].Controllers {
+		switch controller.Name {
+		case "Overlay":
+			if !controller.Self || controller.Description != "Stream overlay" || controller.Labels["avatar"] != "Tundra" {
+				t.Fatalf("unexpected controller %+v", controller)
+			}
+		case "Citrus World":
+			if controller.Self || !controller.Connected {
+				t.Fatalf("unexpected controller %+v", controller)
+			}
+		default:
+			t.Fatalf("unexpected controller %+v", controller)
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	s := startTestServer(t, config.Config{APIKeys: []config.APIKey{
+		{Name: "overlay", Key: "overlay-key", Scopes: []string{"http"}, MaxClients: 1, MaxBindings: 1},
+		{Name: "world", Key: "world-key", Scopes: []string{"ws"}},
+	}})
+
+	for _, tc := range []struct {
+		query url.Values
+		want  int
+	}{
+		{nil, http.StatusUnauthorized},
+		{url.Values{"apiKey": {"wrong"}}, http.StatusUnauthorized},
+		{url.Values{"apiKey": {"world-key"}}, http.StatusForbidden},
+	} {
+		status, body := s.get("/v1/register", tc.query)
+		expectStatus(t, status, body, tc.want)
+	}
+	req, _ := http.NewRequest(http.MethodGet, s.url("/v1/register", nil), nil)
+	req.Header.Set("X-API-Key", "overlay-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+	var registered RawEvent
+	_ = json.NewDecoder(resp.Body).Decode(&registered)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || registered.ClientId == "" {
+		t.Fatalf("failed to register with API key: %d", resp.StatusCode)
+	}
+	controller := ClientSecureId(registered.ClientId)
+	status, body := s.get("/v1/register", url.Values{"apiKey": {"overlay-key"}})
+	expectStatus(t, status, body, http.StatusTooManyRequests)
+
+	// websocket clients need a key with the ws scope
+	for key, want := range map[string]int{"": http.StatusUnauthorized, "overlay-key": http.StatusForbidden} {
+		u := url.URL{Scheme: "ws", Host: s.addr, Path: "/v1/ws", RawQuery: url.Values{"apiKey": {key}}.Encode()}
+		_, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		if err == nil || resp == nil || resp.StatusCode != want {
+			t.Fatalf("expected websocket handshake with key %q to fail with %d, got %v", key, want, err)
+		}
+		_ = resp.Body.Close()
+	}
+	s.dial("/v1/ws", url.Values{"apiKey": {"world-key"}})
+
+	// clients registered with a key are limited in their bindings
+	s.dialAppFor(controller)
+	token, _ := s.requestBindToken(controller, "")
+	app := s.dial("/app/"+string(token), nil)
+	expectEvent(t, app.read(), EventTypeBind, token, app.secureId, "400")
+}
+
+func TestBindingScopes(t *testing.T) {
+	s := startTestServer(t, config.Config{LegacyBindingCodes: true})
+	// every app gets its own controller, since controllers forward commands to all DG-LAB apps bound to them
+	dialAppWithScope := func(scope string) (*testWSClient, *testWSClient, ClientSecureId) {
+		controller := s.dialController()
+		status, body := s.get("/v1/bind", url.Values{"clientId": {string(controller.secureId)}, "format": {"json"}, "scope": {scope}})
+		expectStatus(t, status, body, http.StatusOK)
+		payload := fmt.Sprint(body["url"])
+		token := ClientSecureId(payload[strings.LastIndex(payload, "/")+1:])
+		app := s.dialApp(token)
+		expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+		return controller, app, token
+	}
+	command := func(controller *testWSClient, app *testWSClient, message string) {
+		controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: message})
+	}
+	expectDenied := func(controller *testWSClient, app *testWSClient) {
+		t.Helper()
+		expectEvent(t, controller.read(), EventTypeError, controller.secureId, app.secureId, "406")
+		app.expectNothing()
+	}
+
+	status, body := s.get("/v1/bind", url.Values{"clientId": {string(s.registerHTTP())}, "scope": {"admin"}})
+	expectStatus(t, status, body, http.StatusBadRequest)
+
+	controller, pulseOnly, token := dialAppWithScope("pulse-only")
+	command(controller, pulseOnly, "strength-1+1+5")
+	expectDenied(controller, pulseOnly)
+	command(controller, pulseOnly, "clear-1")
+	expectEvent(t, pulseOnly.read(), EventTypeMsg, token, pulseOnly.secureId, "clear-1")
+
+	controller, limited, token := dialAppWithScope("strength-increase-max-30")
+	// the strength is unknown until the app reports it
+	command(controller, limited, "strength-1+1+1")
+	expectDenied(controller, limited)
+	limited.send(RawEvent{Type: EventTypeMsg, ClientId: string(token), TargetId: string(limited.secureId), Message: "strength-20+0+100+100"})
+	expectEvent(t, controller.read(), EventTypeMsg, controller.secureId, limited.secureId, "strength-20+0+100+100")
+	for _, tc := range []struct {
+		message string
+		allowed bool
+	}{
+		{"strength-1+2+30", true},
+		{"strength-1+2+31", false},
+		{"strength-1+1+1", false},
+		{"strength-2+1+20", true},
+		// the app has not reported the previous increase yet, which counts nonetheless
+		{"strength-2+1+20", false},
+		{"strength-2+1+10", true},
+		{"strength-2+0+50", true},
+	} {
+		command(controller, limited, tc.message)
+		if tc.allowed {
+			expectEvent(t, limited.read(), EventTypeMsg, token, limited.secureId, tc.message)
+		} else {
+			expectDenied(controller, limited)
+		}
+	}
+	// a negative value is not a valid command
+	command(controller, limited, "strength-2+0+-50")
+	limited.expectNothing()
+
+	// an HTTP controller the app has bound to itself with its client ID has the scope of legacy binding codes, which is
+	// pulse-only by default, a read-only controller can not act as it
+	controller, readOnly, _ := dialAppWithScope("read-only")
+	httpController := s.registerHTTP()
+	readOnly.bind(httpController)
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(httpController), TargetId: string(readOnly.secureId), Message: "clear-2"})
+	expectDenied(controller, readOnly)
+	status, body = s.command(httpController, "clear-2")
+	expectStatus(t, status, body, http.StatusOK)
+	expectEvent(t, readOnly.read(), EventTypeMsg, httpController, readOnly.secureId, "clear-2")
+
+	httpReadOnly := s.registerHTTP()
+	status, body = s.get("/v1/bind", url.Values{"clientId": {string(httpReadOnly)}, "format": {"json"}, "scope": {"read-only"}})
+	expectStatus(t, status, body, http.StatusOK)
+	payload := fmt.Sprint(body["url"])
+	app := s.dialApp(ClientSecureId(payload[strings.LastIndex(payload, "/")+1:]))
+	status, body = s.command(httpReadOnly, "clear-1")
+	expectStatus(t, status, body, http.StatusBadRequest)
+	app.expectNothing()
+
+	status, _, raw := s.getRaw("/v1/bindings", url.Values{"clientId": {string(httpReadOnly)}})
+	if status != http.StatusOK || !strings.Contains(string(raw), `"scope":"read-only"`) {
+		t.Fatalf("unexpected binding listing: %d %s", status, raw)
+	}
+}
+
+func TestObserver(t *testing.T) {
+	s := startTestServer(t, config.Config{LegacyBindingCodes: true})
+	controller := s.dial("/v1/ws", url.Values{"name": {"Citrus World"}})
+	appToken, _ := s.requestBindToken(controller.secureId, "")
+	app := s.dial("/app/"+string(appToken), nil)
+	expectBound := func(client *testWSClient, controllerName string) {
+		t.Helper()
+		event := client.read()
+		if event.Type != EventTypeBind || event.Message != "200" || event.Controller == nil || event.Controller.Name != controllerName {
+			t.Fatalf("unexpected bind result: %+v", *event)
+		}
+	}
+	expectBound(app, "Citrus World")
+	expectBound(controller, "Citrus World")
+
+	// the app binds to other controllers with their client IDs, as with legacy binding codes
+	observer := s.dial("/v1/observe", url.Values{"name": {"Stream Overlay"}})
+	app.send(RawEvent{Type: EventTypeBind, ClientId: string(observer.secureId), TargetId: string(app.secureId), Message: "DGLAB"})
+	expectBound(app, "Stream Overlay")
+	expectBound(observer, "Stream Overlay")
+
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-5+0+100+100"})
+	expectEvent(t, controller.read(), EventTypeMsg, controller.secureId, app.secureId, "strength-5+0+100+100")
+	expectEvent(t, observer.read(), EventTypeMsg, observer.secureId, app.secureId, "strength-5+0+100+100")
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "feedback-3"})
+	expectEvent(t, controller.read(), EventTypeMsg, controller.secureId, app.secureId, "feedback-3")
+	expectEvent(t, observer.read(), EventTypeMsg, observer.secureId, app.secureId, "feedback-3")
+
+	// observers see who sent what, without learning the secure ID of the controller
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-1+1+5"})
+	expectEvent(t, app.read(), EventTypeMsg, appToken, app.secureId, "strength-1+1+5")
+	expectControlActivity := func(message string, controllerName string) {
+		t.Helper()
+		event := observer.read()
+		if event.Controller == nil || event.Controller.Name != controllerName {
+			t.Fatalf("unexpected controller in control activity: %+v", *event)
+		}
+		event.Controller = nil
+		expectEvent(t, event, EventTypeMsg, observer.secureId, app.secureId, message)
+	}
+	expectControlActivity("strength-1+1+5", "Citrus World")
+	httpController := s.registerHTTP()
+	app.bind(httpController)
+	status, body := s.command(httpController, "clear-2")
+	expectStatus(t, status, body, http.StatusOK)
+	expectEvent(t, app.read(), EventTypeMsg, httpController, app.secureId, "clear-2")
+	expectControlActivity("clear-2", "")
+
+	observer.send(RawEvent{Type: EventTypeMsg, ClientId: string(observer.secureId), TargetId: string(app.secureId), Message: "clear-1"})
+	expectEvent(t, observer.read(), EventTypeError, observer.secureId, app.secureId, "406")
+	app.expectNothing()
+	status, body = s.command(observer.secureId, "strength-1+2+50")
+	expectStatus(t, status, body, http.StatusBadRequest)
+	expectEvent(t, observer.read(), EventTypeError, observer.secureId, "", "406")
+	app.expectNothing()
+
+	// a binding requested by an observer is always read-only
+	status, body = s.get("/v1/bind", url.Values{"clientId": {string(observer.secureId)}, "format": {"json"}, "scope": {"full"}})
+	expectStatus(t, status, body, http.StatusOK)
+	payload := fmt.Sprint(body["url"])
+	token := ClientSecureId(payload[strings.LastIndex(payload, "/")+1:])
+	expectBound(s.dial("/app/"+string(token), nil), "Stream Overlay")
+	expectBound(observer, "Stream Overlay")
+	status, _, raw := s.getRaw("/v1/bindings", url.Values{"clientId": {string(observer.secureId)}})
+	if status != http.StatusOK || strings.Count(string(raw), `"scope":"read-only"`) != 2 || !strings.Contains(string(raw), `"observer":true`) {
+		t.Fatalf("unexpected binding listing: %d %s", status, raw)
+	}
+}
+
+func TestPublicBaseURL(t *testing.T) {
+	s := startTestServer(t, config.Config{PublicBaseURL: "https://citrus.example.com/dg/", PathPrefix: "dg/", RequireBindingApproval: true})
+	if config.Conf.PathPrefix != "/dg" {
+		t.Fatalf("path prefix was not normalized: %q", config.Conf.PathPrefix)
+	}
+	controllerId := s.registerHTTP()
+	status, body := s.get("/v1/bind", url.Values{"clientId": {string(controllerId)}, "format": {"json"}, "name": {"Citrus World"}})
+	expectStatus(t, status, body, http.StatusOK)
+	payload := fmt.Sprint(body["url"])
+	prefix := fmt.Sprintf("%s#%s#wss://citrus.example.com/dg/app/", DGAppWebsiteLink, DGAppWebsocketTag)
+	if !strings.HasPrefix(payload, prefix) {
+		t.Fatalf("unexpected QR code content %q, want prefix %q", payload, prefix)
+	}
+	token := ClientSecureId(strings.TrimPrefix(payload, prefix))
+	app := s.dial("/app/"+string(token), nil)
+	event := app.read()
+	if !strings.HasPrefix(event.ConsentURL, "https://citrus.example.com/dg/consent/") {
+		t.Fatalf("unexpected consent URL %q", event.ConsentURL)
+	}
+
+	// routes are only served under the path prefix
+	resp, err := http.Get(fmt.Sprintf("http://%s/ping", s.addr))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unexpected status without path prefix: %d", resp.StatusCode)
+	}
+	status, page := s.consent(event.ConsentURL[strings.LastIndex(event.ConsentURL, "/")+1:], "")
+	if status != http.StatusOK || !strings.Contains(page, "Citrus World") {
+		t.Fatalf("unexpected consent page: %d %s", status, page)
+	}
+}
+
+func TestPublicBaseURLDefaultsToPathPrefix(t *testing.T) {
+	s := startTestServer(t, config.Config{PathPrefix: "dg"})
+	if want := fmt.Sprintf("http://%s/dg", s.addr); config.Conf.PublicBaseURL != want {
+		t.Fatalf("unexpected default public base URL %q, want %q", config.Conf.PublicBaseURL, want)
+	}
+	controllerId := s.registerHTTP()
+	status, body := s.get("/v1/bind", url.Values{"clientId": {string(controllerId)}, "format": {"json"}})
+	expectStatus(t, status, body, http.StatusOK)
+	payload := fmt.Sprint(body["url"])
+	prefix := fmt.Sprintf("%s#%s#ws://%s/dg/app/", DGAppWebsiteLink, DGAppWebsocketTag, s.addr)
+	if !strings.HasPrefix(payload, prefix) {
+		t.Fatalf("unexpected QR code content %q, want prefix %q", payload, prefix)
+	}
+	// the app connects to the address in the QR code as it is
+	conn, _, err := websocket.DefaultDialer.Dial(payload[strings.LastIndex(payload, "#")+1:], nil)
+	if err != nil {
+		t.Fatalf("failed to connect to the address in the QR code: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	event := &RawEvent{}
+	if err := conn.ReadJSON(event); err != nil || event.Type != EventTypeBind || event.Message != "targetId" {
+		t.Fatalf("expected bind message on connect, got %+v: %v", *event, err)
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	s := startTestServer(t, config.Config{AllowInsecureClientId: true})
+	forwardedFor := func(ip string) http.Header {
+		return http.Header{"X-Forwarded-For": {ip}}
+	}
+	expectClientIP := func(header http.Header, ip string, source string) {
+		t.Helper()
+		status, body := s.getWithHeader("/v1/whoami", nil, header)
+		expectStatus(t, status, body, http.StatusOK)
+		if body["clientIp"] != ip || body["source"] != source {
+			t.Fatalf("unexpected client IP: %v", body)
+		}
+	}
+
+	// the test client connects from the loopback address, which is a trusted proxy by default
+	expectClientIP(nil, "127.0.0.1", "remote address")
+	expectClientIP(forwardedFor("203.0.113.1"), "203.0.113.1", "X-Forwarded-For")
+	expectClientIP(forwardedFor("198.51.100.7, 203.0.113.1"), "203.0.113.1", "X-Forwarded-For")
+	// private networks are not trusted unless configured
+	expectClientIP(forwardedFor("203.0.113.1, 10.0.0.2"), "10.0.0.2", "X-Forwarded-For")
+	expectClientIP(http.Header{"X-Real-Ip": {"203.0.113.9"}}, "203.0.113.9", "X-Real-IP")
+
+	// clients behind the same proxy get their own insecure client IDs
+	for _, ip := range []string{"203.0.113.1", "203.0.113.2"} {
+		status, body := s.getWithHeader("/v1/register", nil, forwardedFor(ip))
+		expectStatus(t, status, body, http.StatusOK)
+	}
+	status, body := s.getWithHeader("/v1/register", nil, forwardedFor("203.0.113.1"))
+	expectStatus(t, status, body, http.StatusBadRequest)
+	status, body = s.getWithHeader("/v1/heartbeat", nil, forwardedFor("203.0.113.2"))
+	expectStatus(t, status, body, http.StatusOK)
+	status, body = s.getWithHeader("/v1/heartbeat", nil, forwardedFor("203.0.113.3"))
+	expectStatus(t, status, body, http.StatusBadRequest)
+}
+
+func TestUntrustedProxies(t *testing.T) {
+	s := startTestServer(t, config.Config{TrustedProxies: []string{"192.0.2.1", "2001:db8::/32"}, RealIPHeaders: []string{"CF-Connecting-IP"}})
+	status, body := s.getWithHeader("/v1/whoami", nil, http.Header{"Cf-Connecting-Ip": {"203.0.113.1"}, "X-Forwarded-For": {"203.0.113.2"}})
+	expectStatus(t, status, body, http.StatusOK)
+	if body["clientIp"] != "127.0.0.1" || body["source"] != "remote address" {
+		t.Fatalf("headers of an untrusted proxy should be ignored: %v", body)
+	}
+
+	config.Conf.TrustedProxies = []string{"127.0.0.1"}
+	if err := initClientIP(); err != nil {
+		t.Fatalf("initClientIP failed: %v", err)
+	}
+	status, body = s.getWithHeader("/v1/whoami", nil, http.Header{"Cf-Connecting-Ip": {"203.0.113.1"}, "X-Forwarded-For": {"203.0.113.2"}})
+	expectStatus(t, status, body, http.StatusOK)
+	if body["clientIp"] != "203.0.113.1" || body["source"] != "CF-Connecting-IP" {
+		t.Fatalf("unexpected client IP: %v", body)
+	}
+
+	config.Conf.TrustedProxies = []string{"not-a-network"}
+	if err := initClientIP(); err == nil {
+		t.Fatalf("initClientIP should reject invalid trusted proxies")
+	}
+}
+
+func TestInsecureSlots(t *testing.T) {
+	s := startTestServer(t, config.Config{AllowInsecureClientId: true})
+	register := func(slot string) ClientSecureId {
+		t.Helper()
+		status, body := s.get("/v1/register", url.Values{"slot": {slot}})
+		expectStatus(t, status, body, http.StatusOK)
+		return ClientSecureId(body["clientId"].(string))
+	}
+	alice, bob := register("alice"), register("bob")
+	status, body := s.get("/v1/register", url.Values{"slot": {"alice"}})
+	expectStatus(t, status, body, http.StatusBadRequest)
+	status, body = s.get("/v1/register", url.Values{"slot": {"not a slot"}})
+	expectStatus(t, status, body, http.StatusBadRequest)
+
+	// both clients are addressable by their slot without a client ID
+	for slot, controllerId := range map[string]ClientSecureId{"alice": alice, "bob": bob} {
+		status, body = s.get("/v1/bind", url.Values{"slot": {slot}, "format": {"json"}})
+		expectStatus(t, status, body, http.StatusOK)
+		payload := fmt.Sprint(body["url"])
+		token := ClientSecureId(payload[strings.LastIndex(payload, "/")+1:])
+		app := s.dialApp(token)
+		status, body = s.get("/v1/command", url.Values{"slot": {slot}, "message": {"clear-1"}})
+		expectStatus(t, status, body, http.StatusOK)
+		expectEvent(t, app.read(), EventTypeMsg, token, app.secureId, "clear-1")
+		status, _, raw := s.getRaw("/v1/bindings", url.Values{"clientId": {string(controllerId)}})
+		if status != http.StatusOK || !strings.Contains(string(raw), string(app.secureId)) {
+			t.Fatalf("app was bound to the wrong client: %d %s", status, raw)
+		}
+		// the test apps connect from the same IP address, which DG-LAB apps can not choose slots for
+		_ = app.conn.Close()
+		s.eventually("app to be detached", func() bool {
+			return s.countWSClients() == 0
+		})
+	}
+	status, body = s.get("/v1/heartbeat", url.Values{"slot": {"carol"}})
+	expectStatus(t, status, body, http.StatusBadRequest)
+
+	s.dial("/v1/ws", url.Values{"slot": {"alice"}})
+	s.dial("/v1/ws", url.Values{"slot": {"bob"}})
+	u := url.URL{Scheme: "ws", Host: s.addr, Path: "/v1/ws", RawQuery: url.Values{"slot": {"alice"}}.Encode()}
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	duplicate := &testWSClient{t: t, conn: conn, events: make(chan *RawEvent, 16)}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go duplicate.readLoop()
+	duplicate.expectClosed()
+}
+
+func TestInsecureIdSalt(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	conf := config.Config{AllowInsecureClientId: true, StateFile: stateFile}
+	t.Run("before restart", func(t *testing.T) {
+		s := startTestServer(t, conf)
+		s.registerHTTP()
+	})
+
+	// the salt is persisted, so that clients can still be reached by their insecure client IDs after a restart
+	s := startTestServer(t, conf)
+	status, body := s.get("/v1/heartbeat", nil)
+	expectStatus(t, status, body, http.StatusOK)
+
+	if err := RotateInsecureIdSalt(); err != nil {
+		t.Fatalf("RotateInsecureIdSalt failed: %v", err)
+	}
+	status, body = s.get("/v1/heartbeat", nil)
+	expectStatus(t, status, body, http.StatusBadRequest)
+	s.registerHTTP()
+	status, body = s.get("/v1/heartbeat", nil)
+	expectStatus(t, status, body, http.StatusOK)
+
+	t.Run("scheduled rotation", func(t *testing.T) {
+		conf := conf
+		conf.InsecureIdSaltRotation = 50 * time.Millisecond
+		s := startTestServer(t, conf)
+		salt := citrusServer.getInsecureIdSalt()
+		s.eventually("salt to be rotated", func() bool {
+			return citrusServer.getInsecureIdSalt() != salt
+		})
+		status, body := s.get("/v1/heartbeat", nil)
+		expectStatus(t, status, body, http.StatusBadRequest)
+	})
+
+	t.Run("configured salt", func(t *testing.T) {
+		conf := config.Config{AllowInsecureClientId: true, InsecureIdSalt: "citrus"}
+		startTestServer(t, conf)
+		if salt := citrusServer.getInsecureIdSalt(); salt != "citrus" {
+			t.Fatalf("configured salt was not used: %q", salt)
+		}
+		if err := citrusServer.rotateInsecureIdSalt(); err == nil {
+			t.Fatalf("a configured salt should not be rotated")
+		}
+	})
+}
+
+func TestInsecureIdSaltRotationWhileInUse(t *testing.T) {
+	s := startTestServer(t, config.Config{AllowInsecureClientId: true})
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(slot string) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				insecureId := getInsecureIdFromRequest("203.0.113.1", ClientTypeThirdPartyHTTP, slot)
+				_, _ = citrusServer.getClientInsecure(insecureId)
+				_ = hashClientIP("203.0.113.1")
+			}
+		}(strconv.Itoa(i))
+	}
+	for i := 0; i < 20; i++ {
+		s.registerHTTP()
+		if err := citrusServer.rotateInsecureIdSalt(); err != nil {
+			t.Fatalf("rotateInsecureIdSalt failed: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	// the IDs derived from the old salts are all gone, and the new salt is used for new ones
+	status, body := s.get("/v1/heartbeat", nil)
+	expectStatus(t, status, body, http.StatusBadRequest)
+	s.registerHTTP()
+	status, body = s.get("/v1/heartbeat", nil)
+	expectStatus(t, status, body, http.StatusOK)
+}
+
+func TestMetrics(t *testing.T) {
+	s := startTestServer(t, config.Config{MetricsToken: "secret", LegacyBindingCodes: true})
+	scrape := func() string {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, s.url("/metrics", nil), nil)
+		if err != nil {
+			t.Fatalf("GET /metrics failed: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /metrics failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /metrics returned %d: %v", resp.StatusCode, err)
+		}
+		return string(body)
+	}
+
+	status, body := s.get("/metrics", nil)
+	expectStatus(t, status, body, http.StatusUnauthorized)
+	status, body = s.getWithHeader("/metrics", nil, http.Header{"Authorization": {"Bearer wrong"}})
+	expectStatus(t, status, body, http.StatusUnauthorized)
+
+	controller := s.dialController()
+	app := s.dialAppFor(controller.secureId)
+	httpController := s.registerHTTP()
+	// the app binds to the HTTP controller with its client ID, as with a legacy binding code
+	app.bind(httpController)
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-1+1+5"})
+	expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, "strength-1+1+5")
+	status, body = s.get("/v1/bind", url.Values{"clientId": {string(httpController)}, "format": {"json"}})
+	expectStatus(t, status, body, http.StatusOK)
+
+	metrics := scrape()
+	for _, line := range []string{
+		`citrus_clients{state="connected",type="dg_app"} 1`,
+		`citrus_clients{state="connected",type="third_party_ws"} 1`,
+		`citrus_clients{state="connected",type="third_party_http"} 1`,
+		`citrus_clients{state="detached",type="observer"} 0`,
+		`citrus_bindings{scope="full"} 1`,
+		`citrus_bindings{scope="pulse-only"} 1`,
+		`citrus_bind_tokens{state="pending"} 1`,
+		`citrus_send_queue_depth 0`,
+	} {
+		if !strings.Contains(metrics, line+"\n") {
+			t.Errorf("metrics do not contain %q", line)
+		}
+	}
+	// counters are shared by all tests, so only check that they are there
+	for _, prefix := range []string{
+		`citrus_events_processed_total{event_type="msg",kind="strength_adjust"} `,
+		`citrus_events_processed_total{event_type="bind",kind="bind_app"} `,
+		`citrus_send_event_duration_seconds_count{kind="strength_adjust"} `,
+		`citrus_http_requests_total{code="200",method="GET",route="` + config.Conf.PathPrefix + `/v1/register"} `,
+		`citrus_http_requests_total{code="401",method="GET",route="` + config.Conf.PathPrefix + `/metrics"} `,
+	} {
+		if !strings.Contains(metrics, "\n"+prefix) {
+			t.Errorf("metrics do not contain %q", prefix)
+		}
+	}
+
+	_ = app.conn.Close()
+	s.eventually("app detached", func() bool {
+		return strings.Contains(scrape(), `citrus_clients{state="detached",type="dg_app"} 1`+"\n")
+	})
+}
+
+// admin performs a request to the admin API with the credentials used by the tests, and returns the raw response body
+// and its content type.
+func (s *testServer) admin(method string, path string, query url.Values, header http.Header) (int, string, []byte) {
+	s.t.Helper()
+	req, err := http.NewRequest(method, s.url(path, query), nil)
+	if err != nil {
+		s.t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.SetBasicAuth("admin", "secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		s.t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.t.Fatalf("%s %s failed to read body: %v", method, path, err)
+	}
+	return resp.StatusCode, resp.Header.Get("Content-Type"), body
+}
+
+func TestAdminAPI(t *testing.T) {
+	s := startTestServer(t, config.Config{AdminPassword: "secret", LegacyBindingCodes: true})
+	admin := func(method string, path string, query url.Values) (int, map[string]interface{}) {
+		t.Helper()
+		status, _, data := s.admin(method, path, query, nil)
+		body := make(map[string]interface{})
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Fatalf("%s %s returned a non-JSON body: %v", method, path, err)
+		}
+		return status, body
+	}
+
+	status, body := s.get("/admin/clients", nil)
+	expectStatus(t, status, body, http.StatusUnauthorized)
+	status, body = s.getWithHeader("/admin/clients", nil, http.Header{"Authorization": {"Basic YWRtaW46d3Jvbmc="}})
+	expectStatus(t, status, body, http.StatusUnauthorized)
+
+	controller := s.dialController()
+	app := s.dialAppFor(controller.secureId)
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+	httpController := s.registerHTTP()
+	// the app binds to the HTTP controller with its client ID, as with a legacy binding code
+	app.bind(httpController)
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-5+0+100+100"})
+	expectEvent(t, controller.read(), EventTypeMsg, controller.secureId, app.secureId, "strength-5+0+100+100")
+
+	status, body = admin(http.MethodGet, "/admin/clients", nil)
+	expectStatus(t, status, body, http.StatusOK)
+	clients := make(map[ClientSecureId]map[string]interface{})
+	for _, client := range body["clients"].([]interface{}) {
+		info := client.(map[string]interface{})
+		clients[ClientSecureId(info["secureId"].(string))] = info
+	}
+	appInfo := clients[app.secureId]
+	if appInfo["type"] != "dg_app" || appInfo["connected"] != true || appInfo["connectedSince"] == nil || appInfo["lastSeen"] == nil {
+		t.Fatalf("unexpected app info: %v", appInfo)
+	}
+	if bindings := appInfo["bindings"].([]interface{}); len(bindings) != 2 {
+		t.Fatalf("expected the app to have 2 bindings, got %v", bindings)
+	}
+	if strength := appInfo["strength"].(map[string]interface{}); strength["channelAValue"] != float64(5) {
+		t.Fatalf("unexpected strength: %v", strength)
+	}
+	// all clients connect from the same address
+	if hash := appInfo["remoteIpHash"]; hash == "" || clients[controller.secureId]["remoteIpHash"] != hash || clients[httpController]["remoteIpHash"] != hash {
+		t.Fatalf("expected all clients to have the same remote IP hash: %v", clients)
+	}
+	if clients[httpController]["type"] != "third_party_http" || clients[controller.secureId]["type"] != "third_party_ws" {
+		t.Fatalf("unexpected client types: %v", clients)
+	}
+
+	status, body = admin(http.MethodPost, "/admin/clients/"+string(app.secureId)+"/stop", nil)
+	expectStatus(t, status, body, http.StatusOK)
+	for _, message := range []string{"clear-1", "strength-1+2+0", "clear-2", "strength-2+2+0"} {
+		expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, message)
+	}
+	status, body = admin(http.MethodPost, "/admin/clients/"+string(httpController)+"/stop", nil)
+	expectStatus(t, status, body, http.StatusBadRequest)
+
+	status, body = admin(http.MethodDelete, "/admin/clients/"+string(app.secureId)+"/bindings/"+string(httpController), nil)
+	expectStatus(t, status, body, http.StatusOK)
+	expectEvent(t, app.read(), EventTypeBreak, httpController, app.secureId, "209")
+	status, body = s.get("/v1/bindings", url.Values{"clientId": {string(httpController)}})
+	expectStatus(t, status, body, http.StatusOK)
+	if bindings := body["bindings"].([]interface{}); len(bindings) != 0 {
+		t.Fatalf("expected the binding to be broken, got %v", bindings)
+	}
+	status, body = admin(http.MethodDelete, "/admin/clients/"+string(app.secureId)+"/bindings/"+string(httpController), nil)
+	expectStatus(t, status, body, http.StatusNotFound)
+
+	// a binding made with a bind token stays broken when the app resumes, which binds with its binding code again
+	status, body = admin(http.MethodDelete, "/admin/clients/"+string(app.secureId)+"/bindings/"+string(controller.secureId), nil)
+	expectStatus(t, status, body, http.StatusOK)
+	expectEvent(t, app.read(), EventTypeBreak, app.bindingCode, app.secureId, "209")
+	expectEvent(t, controller.read(), EventTypeBreak, controller.secureId, app.secureId, "209")
+	_ = app.conn.Close()
+	s.eventually("app to be detached", func() bool {
+		return s.countWSClients() == 1
+	})
+	resumed := s.dial("/app/"+string(app.bindingCode), url.Values{"resume": {string(app.secureId)}, "token": {app.resumeToken}})
+	resumed.expectNothing()
+	app.conn, app.events = resumed.conn, resumed.events
+	app.send(RawEvent{Type: EventTypeBind, ClientId: string(app.bindingCode), TargetId: string(app.secureId), Message: "DGLAB"})
+	if result := app.read(); result.Type != EventTypeBind || result.Message != "400" {
+		t.Fatalf("expected the app not to bind with its binding code again, got %+v", *result)
+	}
+	status, body = admin(http.MethodGet, "/admin/clients", nil)
+	expectStatus(t, status, body, http.StatusOK)
+	for _, client := range body["clients"].([]interface{}) {
+		info := client.(map[string]interface{})
+		if bindings := info["bindings"].([]interface{}); info["secureId"] == string(app.secureId) && len(bindings) != 0 {
+			t.Fatalf("expected the resumed app to have 0 bindings, got %v", bindings)
+		}
+	}
+	controller.expectNothing()
+
+	status, body = admin(http.MethodDelete, "/admin/clients/"+string(controller.secureId), nil)
+	expectStatus(t, status, body, http.StatusOK)
+	controller.expectClosed()
+	if _, err := citrusServer.getClientSecure(controller.secureId); err == nil {
+		t.Fatalf("expected the controller to be purged")
+	}
+	status, body = admin(http.MethodDelete, "/admin/clients/"+string(controller.secureId), nil)
+	expectStatus(t, status, body, http.StatusNotFound)
+
+	status, body = admin(http.MethodGet, "/admin/settings", nil)
+	expectStatus(t, status, body, http.StatusOK)
+	if body["allowInsecureClientId"] != false {
+		t.Fatalf("unexpected settings: %v", body)
+	}
+	status, body = admin(http.MethodPost, "/admin/settings", url.Values{"allowInsecureClientId": {"true"}})
+	expectStatus(t, status, body, http.StatusOK)
+	if body["allowInsecureClientId"] != true {
+		t.Fatalf("unexpected settings: %v", body)
+	}
+	// the HTTP controller registered before already holds the insecure client ID without a slot
+	slot := url.Values{"slot": {"admin"}}
+	status, body = s.get("/v1/register", slot)
+	expectStatus(t, status, body, http.StatusOK)
+	status, body = s.get("/v1/heartbeat", slot)
+	expectStatus(t, status, body, http.StatusOK)
+	status, body = admin(http.MethodPost, "/admin/settings", url.Values{"allowInsecureClientId": {"false"}})
+	expectStatus(t, status, body, http.StatusOK)
+	status, body = s.get("/v1/heartbeat", slot)
+	expectStatus(t, status, body, http.StatusBadRequest)
+	status, body = admin(http.MethodPost, "/admin/settings", url.Values{"allowInsecureClientId": {"maybe"}})
+	expectStatus(t, status, body, http.StatusBadRequest)
+}
+
+func TestAdminAPIDisabled(t *testing.T) {
+	s := startTestServer(t, config.Config{})
+	status, body := s.getWithHeader("/admin/clients", nil, http.Header{"Authorization": {"Basic YWRtaW46"}})
+	expectStatus(t, status, body, http.StatusNotFound)
+}
+
+func TestDashboard(t *testing.T) {
+	s := startTestServer(t, config.Config{AdminPassword: "secret"})
+	controller := s.dial("/v1/ws", url.Values{"name": {"<b>Citrus World</b>"}})
+	token, _ := s.requestBindToken(controller.secureId, "")
+	app := s.dial("/app/"+string(token), nil)
+	app.read()
+	controller.read()
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-5+0+100+100"})
+	expectEvent(t, controller.read(), EventTypeMsg, controller.secureId, app.secureId, "strength-5+0+100+100")
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "clear-1"})
+	expectEvent(t, app.read(), EventTypeMsg, token, app.secureId, "clear-1")
+
+	status, contentType, page := s.admin(http.MethodGet, "/admin/dashboard", nil, nil)
+	if status != http.StatusOK || !strings.HasPrefix(contentType, "text/html") {
+		t.Fatalf("unexpected dashboard response %d %s", status, contentType)
+	}
+	for _, want := range []string{string(app.secureId), "A 5/100", "clear-1", "&lt;b&gt;Citrus World&lt;/b&gt;"} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("dashboard does not contain %q", want)
+		}
+	}
+	if strings.Contains(string(page), "<b>Citrus World</b>") {
+		t.Errorf("dashboard contains the unescaped name of a client")
+	}
+	status, _, page = s.getRaw("/", nil)
+	if status != http.StatusOK || !strings.Contains(string(page), config.Conf.PathPrefix+"/admin/dashboard") {
+		t.Errorf("home page does not link to the dashboard")
+	}
+
+	feedURL := url.URL{Scheme: "ws", Host: s.addr, Path: config.Conf.PathPrefix + "/admin/feed"}
+	auth := http.Header{"Authorization": {"Basic YWRtaW46c2VjcmV0"}}
+	if _, _, err := websocket.DefaultDialer.Dial(feedURL.String(), nil); err == nil {
+		t.Fatalf("expected the feed to require admin credentials")
+	}
+	crossOrigin := http.Header{"Authorization": auth["Authorization"], "Origin": {"https://evil.example"}}
+	if _, _, err := websocket.DefaultDialer.Dial(feedURL.String(), crossOrigin); err == nil {
+		t.Fatalf("expected the feed to reject other origins")
+	}
+	feed, _, err := websocket.DefaultDialer.Dial(feedURL.String(), auth)
+	if err != nil {
+		t.Fatalf("dial feed failed: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = feed.Close()
+	})
+	readUpdate := func(kind string) DashboardUpdate {
+		t.Helper()
+		_ = feed.SetReadDeadline(time.Now().Add(testTimeout))
+		for {
+			var update DashboardUpdate
+			if err := feed.ReadJSON(&update); err != nil {
+				t.Fatalf("failed to read dashboard update: %v", err)
+			}
+			if update.Kind == kind {
+				return update
+			}
+		}
+	}
+	if update := readUpdate("clients"); len(update.Clients) != 2 {
+		t.Fatalf("unexpected clients: %+v", update.Clients)
+	}
+
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-7+0+100+100"})
+	controller.read()
+	if update := readUpdate("strength"); update.AppId != app.secureId || update.Strength.ChannelAValue != 7 {
+		t.Fatalf("unexpected strength update: %+v", update)
+	}
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-1+1+5"})
+	app.read()
+	update := readUpdate("activity")
+	if update.Activity.Kind != DashboardActivityCommand || update.Activity.AppId != app.secureId || update.Activity.Message != "strength-1+1+5" {
+		t.Fatalf("unexpected activity update: %+v", update.Activity)
+	}
+
+	// browsers send the cached admin credentials along with requests from other sites
+	status, _, _ = s.admin(http.MethodPost, "/admin/clients/"+string(app.secureId)+"/stop", nil, http.Header{"Origin": {"https://evil.example"}})
+	if status != http.StatusForbidden {
+		t.Fatalf("expected a request from another site to be rejected, got %d", status)
+	}
+	app.expectNothing()
+}
+
+func TestControllerPage(t *testing.T) {
+	s := startTestServer(t, config.Config{APIKeys: []config.APIKey{{Name: "web", Key: "secret"}}})
+	status, contentType, page := s.getRaw("/controller", nil)
+	if status != http.StatusOK || !strings.HasPrefix(contentType, "text/html") {
+		t.Fatalf("unexpected controller page response %d %s", status, contentType)
+	}
+	for _, want := range []string{"v1/ws?", "v1/bind?", `name="apiKey"`} {
+		if !strings.Contains(string(page), want) {
+			t.Errorf("controller page does not contain %q", want)
+		}
+	}
+	status, _, page = s.getRaw("/", nil)
+	if status != http.StatusOK || !strings.Contains(string(page), config.Conf.PathPrefix+"/controller") {
+		t.Errorf("home page does not link to the controller page")
+	}
+}
+
+// syncBuffer collects the logs written by the server, which may log from multiple goroutines.
+type syncBuffer struct {
+	buffer strings.Builder
+	mutex  sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestStructuredLogging(t *testing.T) {
+	logs := &syncBuffer{}
+	logOutput = logs
+	t.Cleanup(func() {
+		logOutput = io.Discard
+	})
+	s := startTestServer(t, config.Config{LogFormat: "json", LogLevels: map[string]string{"processor": "debug", "server": "debug"}})
+	controller := s.registerHTTP()
+	app := s.dialAppFor(controller)
+	app.bind(app.bindingCode)
+
+	req, err := http.NewRequest(http.MethodGet, s.url("/v1/command", url.Values{"clientId": {string(controller)}, "message": {"strength-1+1+5"}}), nil)
+	if err != nil {
+		t.Fatalf("GET /v1/command failed: %v", err)
+	}
+	req.Header.Set("X-Request-Id", "test-request")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /v1/command failed: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Request-Id") != "test-request" {
+		t.Fatalf("unexpected command response %d with request ID %q", resp.StatusCode, resp.Header.Get("X-Request-Id"))
+	}
+	expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, "strength-1+1+5")
+
+	var received, sent bool
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		if entry["correlationId"] != "test-request" {
+			continue
+		}
+		switch {
+		case entry["subsystem"] == "processor" && entry["direction"] == "in" && entry["kind"] == "strength_adjust":
+			received = true
+		case entry["subsystem"] == "server" && entry["direction"] == "out" && entry["clientId"] == string(app.secureId)[:8]+"…":
+			sent = true
+		}
+	}
+	if !received || !sent {
+		t.Errorf("the command is not logged with its correlation ID on the way in (%t) and out (%t)", received, sent)
+	}
+	for _, id := range []ClientSecureId{controller, app.secureId} {
+		if strings.Contains(logs.String(), string(id)) {
+			t.Errorf("logs contain the secure ID %s", id)
+		}
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	// small enough for the entries to be spread over rotated files
+	s := startTestServer(t, config.Config{AdminPassword: "secret", AuditLogFile: auditFile, AuditLogMaxSize: 1024})
+	query := func(query url.Values) (int, []AuditEntry) {
+		t.Helper()
+		status, _, data := s.admin(http.MethodGet, "/admin/audit", query, nil)
+		var body struct {
+			Entries []AuditEntry `json:"entries"`
+		}
+		if err := json.Unmarshal(data, &body); err != nil {
+			t.Fatalf("GET /admin/audit returned a non-JSON body: %v", err)
+		}
+		return status, body.Entries
+	}
+
+	status, body := s.get("/v1/register", url.Values{"name": {"Alice"}})
+	expectStatus(t, status, body, http.StatusOK)
+	controller := ClientSecureId(body["clientId"].(string))
+	// the bind result carries the name of the controller, which dialApp does not expect
+	dialApp := func() *testWSClient {
+		t.Helper()
+		token, _ := s.requestBindToken(controller, "")
+		app := s.dial("/app/"+string(token), nil)
+		app.bindingCode = token
+		if event := app.read(); event.Type != EventTypeBind || event.Message != "200" {
+			t.Fatalf("expected the app to be bound, got %+v", event)
+		}
+		return app
+	}
+	app, other := dialApp(), dialApp()
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller), TargetId: string(app.secureId), Message: "strength-10+20+100+150"})
+	s.eventually("strength to be reported", func() bool {
+		for _, client := range citrusServer.listClients() {
+			if client.SecureId == app.secureId {
+				return client.Strength != nil
+			}
+		}
+		return false
+	})
+
+	pulse := `pulse-A:["0a0a0a0a64646464"]`
+	for _, message := range []string{"strength-1+1+5", pulse, "clear-2"} {
+		status, body = s.command(controller, message)
+		expectStatus(t, status, body, http.StatusOK)
+		expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, message)
+		expectEvent(t, other.read(), EventTypeMsg, other.bindingCode, other.secureId, message)
+	}
+	status, _, _ = s.admin(http.MethodPost, "/admin/clients/"+string(app.secureId)+"/stop", nil, nil)
+	if status != http.StatusOK {
+		t.Fatalf("panic stop failed with %d", status)
+	}
+
+	status, entries := query(url.Values{"appId": {string(app.secureId)}})
+	if status != http.StatusOK || len(entries) != 7 {
+		t.Fatalf("expected 7 audit entries of the app, got %d %+v", status, entries)
+	}
+	first := entries[0]
+	if first.ControllerId != controller || first.ControllerName != "Alice" || first.Admin || first.Kind != "strength_adjust" || first.Message != "strength-1+1+5" {
+		t.Fatalf("unexpected audit entry: %+v", first)
+	}
+	if first.Strength == nil || first.Strength.ChannelAValue != 15 || first.Strength.ChannelBValue != 20 {
+		t.Fatalf("unexpected resulting strength: %+v", first.Strength)
+	}
+	if entries[1].Kind != "pulse" || entries[1].Message != pulse || entries[2].Kind != "clear" {
+		t.Fatalf("unexpected audit entries: %+v", entries[1:3])
+	}
+	last := entries[6]
+	if !last.Admin || last.ControllerId != "" || last.Strength == nil || last.Strength.ChannelAValue != 0 || last.Strength.ChannelBValue != 0 {
+		t.Fatalf("unexpected audit entry of the panic stop: %+v", last)
+	}
+	if _, err := os.Stat(auditFile + ".1"); err != nil {
+		t.Errorf("expected the audit log to be rotated: %v", err)
+	}
+
+	status, entries = query(url.Values{"appId": {string(other.secureId)}})
+	if status != http.StatusOK || len(entries) != 3 || entries[0].Strength != nil {
+		t.Fatalf("expected 3 audit entries without strength for the other app, got %d %+v", status, entries)
+	}
+	status, entries = query(url.Values{"limit": {"2"}})
+	if status != http.StatusOK || len(entries) != 2 || entries[1].Message != "strength-2+2+0" {
+		t.Fatalf("expected the latest 2 audit entries, got %d %+v", status, entries)
+	}
+	status, entries = query(url.Values{"since": {time.Now().Add(time.Hour).Format(time.RFC3339)}})
+	if status != http.StatusOK || len(entries) != 0 {
+		t.Fatalf("expected no audit entries in the future, got %d %+v", status, entries)
+	}
+	status, entries = query(url.Values{"until": {first.Time.Add(-time.Second).Format(time.RFC3339)}})
+	if status != http.StatusOK || len(entries) != 0 {
+		t.Fatalf("expected no audit entries before the first command, got %d %+v", status, entries)
+	}
+	status, _ = query(url.Values{"since": {"yesterday"}})
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected an invalid time to be rejected, got %d", status)
+	}
+
+	// the owner of an app finds the audit key of the app on the consent page list, opened from the device of the app
+	if keys := s.auditKeys(http.Header{"X-Forwarded-For": {"203.0.113.1"}}); len(keys) != 0 {
+		t.Fatalf("expected no audit links for another address, got %v", keys)
+	}
+	keys := s.auditKeys(nil)
+	if len(keys) != 2 || keys[app.secureId] == "" || keys[app.secureId] == keys[other.secureId] {
+		t.Fatalf("expected the audit keys of both apps, got %v", keys)
+	}
+	status, raw := func() (int, string) {
+		status, _, raw := s.getRaw("/v1/audit", url.Values{"appId": {string(app.secureId)}, "key": {keys[app.secureId]}, "limit": {"5"}})
+		return status, string(raw)
+	}()
+	if status != http.StatusOK || strings.Contains(raw, string(controller)) || strings.Contains(raw, "controllerId") {
+		t.Fatalf("the owner of an app must not see the secure IDs of controllers: %d %s", status, raw)
+	}
+	if err := json.Unmarshal([]byte(raw), &body); err != nil {
+		t.Fatalf("failed to parse audit entries %s: %v", raw, err)
+	}
+	ownEntries := body["entries"].([]interface{})
+	if len(ownEntries) != 5 {
+		t.Fatalf("expected the latest 5 audit entries of the app, got %+v", ownEntries)
+	}
+	for _, entry := range ownEntries {
+		if entry.(map[string]interface{})["appId"] != string(app.secureId) {
+			t.Fatalf("expected only entries of the app, got %+v", entry)
+		}
+	}
+	if ownEntries[0].(map[string]interface{})["controllerName"] != "Alice" {
+		t.Fatalf("expected the owner to see the names of controllers, got %+v", ownEntries[0])
+	}
+	for _, query := range []url.Values{
+		{"appId": {string(other.secureId)}, "key": {keys[app.secureId]}},
+		{"appId": {string(app.secureId)}, "key": {keys[other.secureId]}},
+		{"appId": {string(app.secureId)}, "key": {app.resumeToken}},
+		{"appId": {string(app.secureId)}},
+		{"appId": {string(controller)}, "key": {keys[app.secureId]}},
+	} {
+		status, body = s.get("/v1/audit", query)
+		expectStatus(t, status, body, http.StatusForbidden)
+	}
+	status, body = s.get("/v1/audit", url.Values{"key": {keys[app.secureId]}})
+	expectStatus(t, status, body, http.StatusBadRequest)
+}
+
+func TestRecording(t *testing.T) {
+	dir := t.TempDir()
+	s := startTestServer(t, config.Config{RecordingDir: dir})
+	controller := s.dialController()
+	app := s.dialAppFor(controller.secureId)
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+
+	controller.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-1+2+20"})
+	expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, "strength-1+2+20")
+	app.send(RawEvent{Type: EventTypeMsg, ClientId: string(controller.secureId), TargetId: string(app.secureId), Message: "strength-20+0+100+100"})
+	expectEvent(t, controller.read(), EventTypeMsg, controller.secureId, app.secureId, "strength-20+0+100+100")
+
+	// events are recorded once they have been sent, so the last one may not be written yet
+	recording := func(secureId ClientSecureId, last string) []RecordedEvent {
+		t.Helper()
+		var events []RecordedEvent
+		s.eventually("recording of "+string(secureId), func() bool {
+			file, err := os.Open(filepath.Join(dir, string(secureId)+".jsonl"))
+			if err != nil {
+				return false
+			}
+			defer file.Close()
+			events, err = ReadRecording(file)
+			return err == nil && len(events) > 0 && events[len(events)-1].Event.Message == last
+		})
+		return events
+	}
+	find := func(events []RecordedEvent, message string) RecordedEvent {
+		t.Helper()
+		for _, event := range events {
+			if event.Event.Message == message {
+				return event
+			}
+		}
+		t.Fatalf("%q is not recorded in %+v", message, events)
+		return RecordedEvent{}
+	}
+
+	controllerEvents := recording(controller.secureId, "strength-20+0+100+100")
+	command := find(controllerEvents, "strength-1+2+20")
+	if command.Direction != RecordingDirectionIn || command.ClientType != "third_party_ws" || command.ClientId != controller.secureId || !command.IsCommandToApp() {
+		t.Fatalf("unexpected recorded command: %+v", command)
+	}
+	report := find(controllerEvents, "strength-20+0+100+100")
+	if report.Direction != RecordingDirectionOut || report.IsCommandToApp() || report.Time.Before(command.Time) {
+		t.Fatalf("unexpected recorded report: %+v", report)
+	}
+
+	appEvents := recording(app.secureId, "strength-20+0+100+100")
+	command = find(appEvents, "strength-1+2+20")
+	if command.Direction != RecordingDirectionOut || command.ClientType != "dg_app" || command.Event.TargetId != string(app.secureId) || !command.IsCommandToApp() {
+		t.Fatalf("unexpected recorded command: %+v", command)
+	}
+	report = find(appEvents, "strength-20+0+100+100")
+	if report.Direction != RecordingDirectionIn || report.IsCommandToApp() {
+		t.Fatalf("unexpected recorded report: %+v", report)
+	}
+
+	// the bind message on connect is recorded without the resume token, which would let anyone reading it take over
+	for _, events := range [][]RecordedEvent{controllerEvents, appEvents} {
+		bind := find(events, "targetId")
+		if bind.Event.ResumeToken != "" {
+			t.Fatalf("the resume token must not be recorded: %+v", bind)
+		}
+	}
+	for _, secureId := range []ClientSecureId{controller.secureId, app.secureId} {
+		data, err := os.ReadFile(filepath.Join(dir, string(secureId)+".jsonl"))
+		if err != nil {
+			t.Fatalf("failed to read recording: %v", err)
+		}
+		if strings.Contains(string(data), controller.resumeToken) || strings.Contains(string(data), app.resumeToken) {
+			t.Fatalf("the resume tokens must not be recorded: %s", data)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir := t.TempDir()
+	stateFile, auditFile := filepath.Join(dir, "state.json"), filepath.Join(dir, "audit.jsonl")
+	s := startTestServer(t, config.Config{StateFile: stateFile, AuditLogFile: auditFile})
+	controller := s.dialController()
+	app := s.dialAppFor(controller.secureId)
+	expectEvent(t, controller.read(), EventTypeBind, controller.secureId, app.secureId, "200")
+	unbound := s.dialController()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	citrusServer.shutdown(ctx)
+
+	// the app is stopped before it is told the binding is broken
+	for _, message := range []string{"clear-1", "strength-1+2+0", "clear-2", "strength-2+2+0"} {
+		expectEvent(t, app.read(), EventTypeMsg, app.bindingCode, app.secureId, message)
+	}
+	expectEvent(t, app.read(), EventTypeBreak, app.bindingCode, app.secureId, "209")
+	expectEvent(t, controller.read(), EventTypeBreak, controller.secureId, app.secureId, "209")
+	app.expectClosed()
+	controller.expectClosed()
+	unbound.expectClosed()
+
+	status, body := s.get("/v1/register", nil)
+	expectStatus(t, status, body, http.StatusServiceUnavailable)
+	status, body = s.command(controller.secureId, "strength-1+1+5")
+	expectStatus(t, status, body, http.StatusServiceUnavailable)
+
+	// the bindings are kept for the clients to resume after a restart
+	data, err := os.ReadFile(stateFile)
+	if err != nil || !strings.Contains(string(data), string(app.secureId)) {
+		t.Fatalf("expected the state to be saved, got %v %s", err, data)
+	}
+	data, err = os.ReadFile(auditFile)
+	if err != nil || strings.Count(string(data), "\n") != 4 {
+		t.Fatalf("expected the stop commands to be in the audit log, got %v %s", err, data)
+	}
+}
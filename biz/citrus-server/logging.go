@@ -0,0 +1,367 @@
+package citrus_server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/hlog"
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+// Levels of hertz which slog does not have, they are logged as TRACE, NOTICE and FATAL.
+const (
+	logLevelTrace  = slog.LevelDebug - 4
+	logLevelNotice = slog.LevelInfo + 2
+	logLevelFatal  = slog.LevelError + 4
+)
+
+// correlationIdHeader carries the correlation ID of an HTTP request, a valid ID given by the client is kept so that
+// requests can be traced across a reverse proxy.
+const correlationIdHeader = "X-Request-Id"
+
+var correlationIdPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// secureIdPattern matches secure client IDs, as well as bind tokens, resume tokens and insecure client IDs.
+var secureIdPattern = regexp.MustCompile(`[0-9a-f]{8}(?:-?[0-9a-f]{4}){3}-?[0-9a-f]{12}`)
+
+var (
+	// logOutput is where logs are written to, it is a variable so that tests can capture or discard logs
+	logOutput io.Writer = os.Stderr
+	// logHandler formats and writes the logs of all subsystems, it is replaced by initLogging according to the config
+	logHandler   atomic.Pointer[slog.Handler]
+	logSecureIds atomic.Bool
+	// logLevels holds the level of each subsystem, which are the keys allowed in Config.LogLevels
+	logLevels    = make(map[string]*slog.LevelVar)
+	setHertzOnce sync.Once
+
+	serverLog    = newSubsystemLogger("server")
+	processorLog = newSubsystemLogger("processor")
+	httpLog      = newSubsystemLogger("http")
+	adminLog     = newSubsystemLogger("admin")
+	auditLog     = newSubsystemLogger("audit")
+	hertzLog     = newSubsystemLogger("hertz")
+)
+
+// newSubsystemLogger returns a logger whose level can be configured separately from the other subsystems.
+func newSubsystemLogger(subsystem string) *slog.Logger {
+	level := &slog.LevelVar{}
+	logLevels[subsystem] = level
+	return slog.New(&subsystemHandler{level: level}).With("subsystem", subsystem)
+}
+
+// initLogging sets up the log format and the level of each subsystem according to the config, and routes the logs of
+// hertz through the "hertz" subsystem.
+func initLogging() error {
+	var level slog.Level
+	if config.Conf.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(config.Conf.LogLevel)); err != nil {
+			return fmt.Errorf("initLogging: invalid LogLevel %q: %v", config.Conf.LogLevel, err)
+		}
+	}
+	levels := make(map[string]slog.Level, len(logLevels))
+	for subsystem := range logLevels {
+		levels[subsystem] = level
+	}
+	for subsystem, value := range config.Conf.LogLevels {
+		if _, ok := logLevels[subsystem]; !ok {
+			return fmt.Errorf("initLogging: unknown subsystem %q in LogLevels", subsystem)
+		}
+		var subsystemLevel slog.Level
+		if err := subsystemLevel.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("initLogging: invalid level %q of subsystem %q: %v", value, subsystem, err)
+		}
+		levels[subsystem] = subsystemLevel
+	}
+
+	options := &slog.HandlerOptions{Level: logLevelTrace, ReplaceAttr: replaceLogAttr}
+	var handler slog.Handler
+	switch strings.ToLower(config.Conf.LogFormat) {
+	case "", "text":
+		handler = slog.NewTextHandler(logOutput, options)
+	case "json":
+		handler = slog.NewJSONHandler(logOutput, options)
+	default:
+		return fmt.Errorf("initLogging: LogFormat must be text or json, got %q", config.Conf.LogFormat)
+	}
+
+	for subsystem, subsystemLevel := range levels {
+		logLevels[subsystem].Set(subsystemLevel)
+	}
+	logSecureIds.Store(config.Conf.LogSecureIds)
+	logHandler.Store(&handler)
+	setHertzOnce.Do(func() {
+		hlog.SetLogger(hertzLogger{})
+	})
+	return nil
+}
+
+// subsystemHandler passes the records of a subsystem at or above its level on to the current logHandler, along with
+// the correlation ID of their context.
+type subsystemHandler struct {
+	level *slog.LevelVar
+	// wraps are the attributes and groups added with With and WithGroup, they are applied on every record so that
+	// logHandler can be replaced after the logger has been created
+	wraps []func(slog.Handler) slog.Handler
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, record slog.Record) error {
+	var handler slog.Handler
+	if current := logHandler.Load(); current != nil {
+		handler = *current
+	} else {
+		handler = slog.NewTextHandler(logOutput, &slog.HandlerOptions{Level: logLevelTrace, ReplaceAttr: replaceLogAttr})
+	}
+	for _, wrap := range h.wraps {
+		handler = wrap(handler)
+	}
+	if id := correlationId(ctx); id != "" {
+		record = record.Clone()
+		record.AddAttrs(slog.String("correlationId", id))
+	}
+	return handler.Handle(ctx, record)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithAttrs(attrs)
+	})
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler {
+		return handler.WithGroup(name)
+	})
+}
+
+func (h *subsystemHandler) with(wrap func(slog.Handler) slog.Handler) slog.Handler {
+	wraps := make([]func(slog.Handler) slog.Handler, len(h.wraps), len(h.wraps)+1)
+	copy(wraps, h.wraps)
+	return &subsystemHandler{level: h.level, wraps: append(wraps, wrap)}
+}
+
+// replaceLogAttr names the levels of hertz, and redacts secure IDs from all messages and attributes unless
+// LogSecureIds is enabled.
+func replaceLogAttr(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := a.Value.Any().(slog.Level); ok {
+			switch level {
+			case logLevelTrace:
+				a.Value = slog.StringValue("TRACE")
+			case logLevelNotice:
+				a.Value = slog.StringValue("NOTICE")
+			case logLevelFatal:
+				a.Value = slog.StringValue("FATAL")
+			}
+		}
+		return a
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(redactSecureIds(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(redactSecureIds(err.Error()))
+		}
+	}
+	return a
+}
+
+// redactSecureIds shortens the secure IDs in a log message to their first 8 characters, which is enough to tell
+// clients apart in logs but not to act as them.
+func redactSecureIds(s string) string {
+	if logSecureIds.Load() {
+		return s
+	}
+	return secureIdPattern.ReplaceAllStringFunc(s, func(id string) string {
+		return id[:8] + "…"
+	})
+}
+
+// LogValue logs the secure ID as a string, so that it is redacted along with the IDs in messages.
+func (id ClientSecureId) LogValue() slog.Value {
+	return slog.StringValue(string(id))
+}
+
+// LogValue identifies the client in logs by its secure ID, along with its name if it has given one.
+func (client *CitrusClient) LogValue() slog.Value {
+	if client.metadata != nil && client.metadata.Name != "" {
+		return slog.GroupValue(slog.Any("id", client.secureId), slog.String("name", client.metadata.Name))
+	}
+	return slog.GroupValue(slog.Any("id", client.secureId))
+}
+
+// logClient identifies the client with the given secure ID in logs like CitrusClient.LogValue, the client is only
+// looked up if the log is written. It must not be logged while holding the clients lock.
+type logClient ClientSecureId
+
+func (id logClient) LogValue() slog.Value {
+	if client, err := citrusServer.getClientSecure(ClientSecureId(id)); err == nil {
+		return client.LogValue()
+	}
+	return slog.GroupValue(slog.Any("id", ClientSecureId(id)))
+}
+
+// eventLogAttrs describes an event in logs, direction is "in" for events received from clients and "out" for events
+// sent to them.
+func eventLogAttrs(event Event, direction string, attrs ...any) []any {
+	eventType, kind := eventLabels(event)
+	return append([]any{"eventType", string(eventType), "kind", kind, "direction", direction}, attrs...)
+}
+
+type correlationIdKey struct{}
+
+// withCorrelationId returns a context carrying the given correlation ID, which is added to all logs made with it.
+func withCorrelationId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIdKey{}, id)
+}
+
+// newCorrelationContext returns a context with a new correlation ID, for work which is not started by a request or a
+// message, such as timers.
+func newCorrelationContext(ctx context.Context) context.Context {
+	return withCorrelationId(ctx, generateRandomHex(8))
+}
+
+func correlationId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationIdKey{}).(string)
+	return id
+}
+
+// HTTPCorrelation is a middleware giving each request a correlation ID, which is returned in the X-Request-Id header
+// and follows the request through the logs of the events it causes.
+func HTTPCorrelation(ctx context.Context, c *app.RequestContext) {
+	id := string(c.GetHeader(correlationIdHeader))
+	if !correlationIdPattern.MatchString(id) {
+		id = generateRandomHex(8)
+	}
+	c.Response.Header.Set(correlationIdHeader, id)
+	c.Next(withCorrelationId(ctx, id))
+}
+
+// hertzLogger routes the logs of hertz, and of the rest of the program using hlog, through the "hertz" subsystem.
+type hertzLogger struct{}
+
+var hertzLevels = map[hlog.Level]slog.Level{
+	hlog.LevelTrace:  logLevelTrace,
+	hlog.LevelDebug:  slog.LevelDebug,
+	hlog.LevelInfo:   slog.LevelInfo,
+	hlog.LevelNotice: logLevelNotice,
+	hlog.LevelWarn:   slog.LevelWarn,
+	hlog.LevelError:  slog.LevelError,
+	hlog.LevelFatal:  logLevelFatal,
+}
+
+func (hertzLogger) log(ctx context.Context, level slog.Level, message string) {
+	hertzLog.Log(ctx, level, message)
+	if level == logLevelFatal {
+		os.Exit(1)
+	}
+}
+
+func (l hertzLogger) Trace(v ...interface{}) {
+	l.log(context.Background(), logLevelTrace, fmt.Sprint(v...))
+}
+
+func (l hertzLogger) Debug(v ...interface{}) {
+	l.log(context.Background(), slog.LevelDebug, fmt.Sprint(v...))
+}
+
+func (l hertzLogger) Info(v ...interface{}) {
+	l.log(context.Background(), slog.LevelInfo, fmt.Sprint(v...))
+}
+
+func (l hertzLogger) Notice(v ...interface{}) {
+	l.log(context.Background(), logLevelNotice, fmt.Sprint(v...))
+}
+
+func (l hertzLogger) Warn(v ...interface{}) {
+	l.log(context.Background(), slog.LevelWarn, fmt.Sprint(v...))
+}
+
+func (l hertzLogger) Error(v ...interface{}) {
+	l.log(context.Background(), slog.LevelError, fmt.Sprint(v...))
+}
+
+func (l hertzLogger) Fatal(v ...interface{}) {
+	l.log(context.Background(), logLevelFatal, fmt.Sprint(v...))
+}
+
+func (l hertzLogger) Tracef(format string, v ...interface{}) {
+	l.log(context.Background(), logLevelTrace, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) Debugf(format string, v ...interface{}) {
+	l.log(context.Background(), slog.LevelDebug, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) Infof(format string, v ...interface{}) {
+	l.log(context.Background(), slog.LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) Noticef(format string, v ...interface{}) {
+	l.log(context.Background(), logLevelNotice, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) Warnf(format string, v ...interface{}) {
+	l.log(context.Background(), slog.LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) Errorf(format string, v ...interface{}) {
+	l.log(context.Background(), slog.LevelError, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) Fatalf(format string, v ...interface{}) {
+	l.log(context.Background(), logLevelFatal, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) CtxTracef(ctx context.Context, format string, v ...interface{}) {
+	l.log(ctx, logLevelTrace, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) CtxDebugf(ctx context.Context, format string, v ...interface{}) {
+	l.log(ctx, slog.LevelDebug, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) CtxInfof(ctx context.Context, format string, v ...interface{}) {
+	l.log(ctx, slog.LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) CtxNoticef(ctx context.Context, format string, v ...interface{}) {
+	l.log(ctx, logLevelNotice, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) CtxWarnf(ctx context.Context, format string, v ...interface{}) {
+	l.log(ctx, slog.LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) CtxErrorf(ctx context.Context, format string, v ...interface{}) {
+	l.log(ctx, slog.LevelError, fmt.Sprintf(format, v...))
+}
+
+func (l hertzLogger) CtxFatalf(ctx context.Context, format string, v ...interface{}) {
+	l.log(ctx, logLevelFatal, fmt.Sprintf(format, v...))
+}
+
+// SetLevel changes the level of the "hertz" subsystem.
+func (hertzLogger) SetLevel(level hlog.Level) {
+	if slogLevel, ok := hertzLevels[level]; ok {
+		logLevels["hertz"].Set(slogLevel)
+	}
+}
+
+// SetOutput is ignored, logs are written to the output of all subsystems.
+func (hertzLogger) SetOutput(io.Writer) {}
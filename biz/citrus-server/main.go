@@ -1,12 +1,18 @@
 package citrus_server
 
 import (
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/cloudwego/hertz/pkg/common/hlog"
 	"github.com/google/uuid"
 	"github.com/hertz-contrib/websocket"
+	"github.com/tundrawork/DG-citrus/config"
 )
 
 type CitrusClientType int
@@ -15,6 +21,19 @@ type ClientInsecureId string
 
 type CitrusServer struct {
 	clients CitrusClients
+	// store persists clients and bindings across restarts, it is nil if persistence is disabled
+	store          Store
+	persistMutex   sync.Mutex
+	bindTokens     BindTokens
+	insecureIdSalt InsecureIdSalt
+	// allowInsecureClientId starts as config.Conf.AllowInsecureClientId, administrators can toggle it at runtime
+	allowInsecureClientId atomic.Bool
+	dashboard             Dashboard
+	// audit keeps the audit log of commands forwarded to DG-LAB apps, it is nil if the audit log is disabled
+	audit      AuditStore
+	recordings Recordings
+	// shuttingDown is set once the server starts shutting down, after which clients can not connect or send commands
+	shuttingDown atomic.Bool
 }
 
 type CitrusClients struct {
@@ -27,127 +46,489 @@ type CitrusClient struct {
 	typ        CitrusClientType
 	secureId   ClientSecureId
 	insecureId ClientInsecureId
-	bindings   map[ClientSecureId]bool
-	conn       *websocket.Conn
+	// bindings maps the secure IDs of the peers of the client to the scopes of their bindings
+	bindings map[ClientSecureId]BindingScope
+	conn     *websocket.Conn
+	// writeMutex serializes writes to conn, which does not support concurrent writers
+	writeMutex sync.Mutex
+	// purgeTimer purges a detached websocket client unless it reconnects before the timer fires
+	purgeTimer *time.Timer
+	// resumeToken allows a websocket client to resume its session on a new connection
+	resumeToken string
+	// auditKey lets the owner of a DG-LAB app query its audit log, it is never sent to a client, but shown on the consent
+	// page list opened from the device of the app, see HTTPAudit
+	auditKey string
+	// bindingCode is the code a DG-LAB app has connected with, which it knows the third party client it was bound to on
+	// connect by, instead of the secure ID of bindingCodeOwner
+	bindingCode      string
+	bindingCodeOwner ClientSecureId
+	bindingCodeScope BindingScope
+	// strength is the strength a DG-LAB app has last reported, it is nil until the app reports its strength
+	strength *DataReportStrength
+	// strengthBound is at least the strength a DG-LAB app has, for checking binding scopes. It is raised by the reports of
+	// the app and follows the adjustments forwarded to it, so that adjustments the app has not reported yet count as
+	// well, and a stale report can not lower it.
+	strengthBound *DataReportStrength
+	// metadata is given by a third party client on registration, it is nil if the client has not given any
+	metadata *ClientMetadata
+	// apiKeyName is the name of the API key the third party client was registered with, if API keys are required
+	apiKeyName string
+	// remoteIPHash identifies the IP address the client has last connected from to administrators, see hashClientIP
+	remoteIPHash string
+	// connectedAt is when the client has registered, or last connected if it is a websocket client
+	connectedAt time.Time
+	// lastSeen is when the server has last heard from the client, in unix nanoseconds
+	lastSeen atomic.Int64
+}
+
+// ClientMetadata describes a third party client to humans, such as the owners of the DG-LAB apps it is bound to.
+type ClientMetadata struct {
+	Name        string            `json:"name,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+}
+
+// BindingInfo describes a DG-LAB app a third party client is bound to, along with all third party clients bound to it.
+type BindingInfo struct {
+	AppId       ClientSecureId   `json:"appId"`
+	Scope       BindingScope     `json:"scope"`
+	Connected   bool             `json:"connected"`
+	Controllers []ControllerInfo `json:"controllers"`
+}
+
+// Binding is a peer of a client along with the scope of their binding.
+type Binding struct {
+	peer  *CitrusClient
+	scope BindingScope
+	// peerStrength is a copy of the strength the peer has last reported, if it is a DG-LAB app
+	peerStrength *DataReportStrength
+	// peerConnected is whether the peer was connected when the binding was looked up
+	peerConnected bool
+}
+
+// ControllerInfo describes a third party client without revealing its secure ID.
+type ControllerInfo struct {
+	ClientMetadata
+	Self      bool `json:"self"`
+	Observer  bool `json:"observer"`
+	Connected bool `json:"connected"`
 }
 
 const (
 	ClientTypeDGApp CitrusClientType = iota
 	ClientTypeThirdPartyWS
 	ClientTypeThirdPartyHTTP
+	// ClientTypeObserver is a read-only third party websocket client, which receives the reports of the DG-LAB apps it is
+	// bound to and the commands other clients send to them, but can not send commands itself
+	ClientTypeObserver
 )
 
+var errClientsAlreadyBound = errors.New("clients are already bound")
+
+// isThirdParty checks whether clients of the type can be bound to DG-LAB apps.
+func (typ CitrusClientType) isThirdParty() bool {
+	return typ == ClientTypeThirdPartyWS || typ == ClientTypeThirdPartyHTTP || typ == ClientTypeObserver
+}
+
+// isThirdPartyWS checks whether clients of the type are third party clients connected via websocket, which receive the
+// reports of the DG-LAB apps they are bound to.
+func (typ CitrusClientType) isThirdPartyWS() bool {
+	return typ == ClientTypeThirdPartyWS || typ == ClientTypeObserver
+}
+
+// String identifies the client in logs, by its name along with its secure ID if it has given one.
+func (client *CitrusClient) String() string {
+	if client.metadata != nil && client.metadata.Name != "" {
+		return fmt.Sprintf("%q (%s)", client.metadata.Name, client.secureId)
+	}
+	return string(client.secureId)
+}
+
 func NewCitrusServer() *CitrusServer {
 	return &CitrusServer{
 		clients: CitrusClients{
 			secureMapping:   make(map[ClientSecureId]*CitrusClient),
 			insecureMapping: make(map[ClientInsecureId]*CitrusClient),
 		},
+		bindTokens: BindTokens{
+			tokens: make(map[string]*BindToken),
+		},
+		insecureIdSalt: newInsecureIdSalt(),
+		dashboard:      newDashboard(),
+		recordings:     newRecordings(),
 	}
 }
 
-func (client *CitrusClient) serve() {
+// serve sends the client its secure ID, binds a DG-LAB app to the third party client it was given by the binding code,
+// and then processes messages from the connection until it is closed. Each message gets its own correlation ID.
+func (client *CitrusClient) serve(ctx context.Context, conn *websocket.Conn) {
 	event := &EventBindToServer{
-		ClientId: client.secureId,
+		ClientId:    client.secureId,
+		ResumeToken: client.resumeToken,
 	}
-	err := citrusServer.sendEvent(client.secureId, event)
+	err := citrusServer.sendEvent(ctx, client.secureId, event)
 	if err != nil {
-		hlog.Errorf("serve: failed to send EventBindToServer: %s", err)
+		serverLog.ErrorContext(ctx, "Failed to send EventBindToServer", "client", client, "error", err)
 		return
 	}
+	citrusServer.clients.mutex.RLock()
+	bindingCodeOwner := client.bindingCodeOwner
+	citrusServer.clients.mutex.RUnlock()
+	if client.typ == ClientTypeDGApp && bindingCodeOwner != "" {
+		bindEvent := &EventBindAppToThirdParty{
+			ClientId: bindingCodeOwner,
+			TargetId: client.secureId,
+		}
+		err = bindEvent.Process(ctx)
+		if err != nil {
+			serverLog.ErrorContext(ctx, "Failed to bind DG App client to third party client", "client", client, "error", err)
+		}
+	}
 	for {
-		typ, message, err := client.conn.ReadMessage()
+		typ, message, err := conn.ReadMessage()
 		if err != nil {
-			hlog.Errorf("serve: read message from conn failed: %v", err)
+			serverLog.InfoContext(ctx, "Stopped reading messages from connection", "client", client, "error", err)
 			break
 		}
 
 		switch typ {
 		case websocket.TextMessage:
-			rawEvent := &RawEvent{}
-			err := rawEvent.FromByteArray(message)
-			if err != nil {
-				hlog.Errorf("serve: failed to parse message: %v", err)
-				continue
-			}
-			event, err := rawEvent.ToEvent()
-			if err != nil {
-				hlog.Errorf("serve: failed to convert raw event to event: %v", err)
-				continue
-			}
-			err = event.Process()
-			if err != nil {
-				hlog.Errorf("serve: failed to process event: %v", err)
-				continue
-			}
+			client.handleMessage(withCorrelationId(ctx, generateRandomHex(8)), message)
 		case websocket.CloseMessage:
-			hlog.Infof("serve: received close message")
-			err := client.conn.Close()
+			serverLog.InfoContext(ctx, "Received close message", "client", client)
+			err := conn.Close()
 			if err != nil {
-				hlog.Errorf("serve: failed to close connection: %v", err)
+				serverLog.ErrorContext(ctx, "Failed to close connection", "client", client, "error", err)
 			}
 			break
 		default:
-			hlog.Errorf("serve: received unsupported message type: %d", typ)
+			serverLog.WarnContext(ctx, "Received unsupported message type", "client", client, "messageType", typ)
+		}
+	}
+}
+
+// handleMessage parses and processes a single text message, a panic is recovered so that it only drops the message.
+func (client *CitrusClient) handleMessage(ctx context.Context, message []byte) {
+	defer func() {
+		if r := recover(); r != nil {
+			serverLog.ErrorContext(ctx, "Recovered from panic while handling message", "client", client, "message", string(message), "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+		}
+	}()
+
+	client.touch()
+	// commands could otherwise start the DG-LAB apps again after they have been stopped for the shutdown
+	if citrusServer.shuttingDown.Load() {
+		serverLog.DebugContext(ctx, "Dropped message as the server is shutting down", "client", client)
+		return
+	}
+	rawEvent := &RawEvent{}
+	err := rawEvent.FromByteArray(message)
+	if err != nil {
+		serverLog.WarnContext(ctx, "Failed to parse message", "client", client, "direction", "in", "error", err)
+		return
+	}
+	// a client can only act as itself, so that it can not e.g. bypass the scope of its bindings with another secure ID
+	if client.typ == ClientTypeDGApp {
+		rawEvent.TargetId = string(client.secureId)
+		citrusServer.clients.mutex.RLock()
+		if client.bindingCode != "" && rawEvent.ClientId == client.bindingCode {
+			rawEvent.ClientId = string(client.bindingCodeOwner)
 		}
+		citrusServer.clients.mutex.RUnlock()
+	} else {
+		rawEvent.ClientId = string(client.secureId)
 	}
+	citrusServer.record(ctx, client.typ, client.secureId, RecordingDirectionIn, rawEvent)
+	event, err := rawEvent.ToEvent()
+	if err != nil {
+		serverLog.WarnContext(ctx, "Failed to convert raw event to event", "client", client, "direction", "in", "eventType", rawEvent.Type, "error", err)
+		return
+	}
+	if err = denyAppEvent(ctx, client, event, ClientSecureId(rawEvent.TargetId)); err != nil {
+		return
+	}
+	err = event.Process(ctx)
+	if err != nil {
+		serverLog.WarnContext(ctx, "Failed to process event", eventLogAttrs(event, "in", "client", client, "error", err)...)
+		return
+	}
+}
+
+// forgetBindingCodeOwnerLocked keeps a DG-LAB app from binding to the third party client of its binding code again,
+// once that binding has been broken or the third party client removed by an administrator.
+func (client *CitrusClient) forgetBindingCodeOwnerLocked() {
+	client.bindingCodeOwner = ""
+	client.bindingCodeScope = ""
 }
 
-func (server *CitrusServer) newWSClient(typ CitrusClientType, insecureId ClientInsecureId, conn *websocket.Conn) CitrusClient {
+// newWSClient registers a new websocket client, a DG-LAB app client also needs the binding code it connected with and
+// the third party client the code belongs to.
+func (server *CitrusServer) newWSClient(typ CitrusClientType, insecureId ClientInsecureId, conn *websocket.Conn, bindToken *BindToken, metadata *ClientMetadata, apiKey *config.APIKey) (*CitrusClient, error) {
+	defer server.persist()
 	server.clients.mutex.Lock()
 	defer server.clients.mutex.Unlock()
 
+	if err := server.checkAPIKeyClientLimitLocked(apiKey); err != nil {
+		return nil, err
+	}
+
 	secureID := ClientSecureId(uuid.NewString())
 	client := &CitrusClient{
 		typ:        typ,
 		secureId:   secureID,
 		insecureId: insecureId,
-		bindings:   make(map[ClientSecureId]bool),
+		bindings:   make(map[ClientSecureId]BindingScope),
 		conn:       conn,
+		metadata:   metadata,
+	}
+	if bindToken != nil {
+		client.bindingCode = bindToken.token
+		client.bindingCodeOwner = bindToken.thirdPartyClientId
+		client.bindingCodeScope = bindToken.scope
+	}
+	client.resumeToken = generateRandomHex(16)
+	if typ == ClientTypeDGApp {
+		client.auditKey = generateRandomHex(16)
+	}
+	if apiKey != nil {
+		client.apiKeyName = apiKey.Name
 	}
 
 	server.clients.secureMapping[secureID] = client
 	server.clients.insecureMapping[insecureId] = client
+	serverLog.Info("Registered client", "client", client, "type", clientTypeLabels[typ])
 
-	return *client
+	return client, nil
 }
 
-func (server *CitrusServer) newHTTPClient(insecureId ClientInsecureId) CitrusClient {
+func (server *CitrusServer) newHTTPClient(insecureId ClientInsecureId, metadata *ClientMetadata, apiKey *config.APIKey) (*CitrusClient, error) {
+	defer server.persist()
 	server.clients.mutex.Lock()
 	defer server.clients.mutex.Unlock()
 
+	if err := server.checkAPIKeyClientLimitLocked(apiKey); err != nil {
+		return nil, err
+	}
+
 	secureID := ClientSecureId(uuid.NewString())
 	client := &CitrusClient{
 		typ:        ClientTypeThirdPartyHTTP,
 		secureId:   secureID,
 		insecureId: insecureId,
-		bindings:   make(map[ClientSecureId]bool),
+		bindings:   make(map[ClientSecureId]BindingScope),
+		metadata:   metadata,
+	}
+	if apiKey != nil {
+		client.apiKeyName = apiKey.Name
 	}
 
 	server.clients.secureMapping[secureID] = client
 	server.clients.insecureMapping[insecureId] = client
+	serverLog.Info("Registered client", "client", client, "type", clientTypeLabels[ClientTypeThirdPartyHTTP])
+
+	return client, nil
+}
 
-	return *client
+// resumeWSClient reattaches a websocket client of the given type to a new connection, so that it keeps its bindings
+// after a network interruption. The previous connection is closed if the server has not noticed it is broken yet.
+func (server *CitrusServer) resumeWSClient(typ CitrusClientType, secureId ClientSecureId, resumeToken string, conn *websocket.Conn) (*CitrusClient, error) {
+	server.clients.mutex.Lock()
+	client, err := server.checkResumeTokenLocked(typ, secureId, resumeToken)
+	if err != nil {
+		server.clients.mutex.Unlock()
+		return nil, err
+	}
+	if client.purgeTimer != nil {
+		client.purgeTimer.Stop()
+		client.purgeTimer = nil
+	}
+	previousConn := client.conn
+	client.conn = conn
+	server.clients.mutex.Unlock()
+
+	if previousConn != nil {
+		closeConn(previousConn, "session resumed on another connection")
+	}
+	serverLog.Info("Resumed client", "client", client)
+	return client, nil
 }
 
-func (server *CitrusServer) purgeClient(insecureId ClientInsecureId) {
+// resumeDGAppClient reattaches a detached DG-LAB app client which has connected with the given binding code before to a
+// new connection, so that the official app keeps its bindings when it reconnects with the URL of the binding QR code.
+// Only a detached app can be resumed this way, that is within the resume grace period, so that the binding code of a
+// connected app can not be used to take over its session. It returns nil if there is no such client.
+func (server *CitrusServer) resumeDGAppClient(bindingCode string, conn *websocket.Conn) *CitrusClient {
 	server.clients.mutex.Lock()
 	defer server.clients.mutex.Unlock()
 
-	hlog.Infof("purgeClient: purging client with insecure ID %s", insecureId)
+	client := server.detachedDGAppClientLocked(bindingCode)
+	if client == nil {
+		return nil
+	}
+	if client.purgeTimer != nil {
+		client.purgeTimer.Stop()
+		client.purgeTimer = nil
+	}
+	client.conn = conn
+	serverLog.Info("Resumed DG App client with its binding code", "client", client)
+	return client
+}
+
+// hasDetachedDGAppClient checks whether a DG-LAB app client which has connected with the given binding code is waiting to
+// be resumed.
+func (server *CitrusServer) hasDetachedDGAppClient(bindingCode string) bool {
+	server.clients.mutex.RLock()
+	defer server.clients.mutex.RUnlock()
+
+	return server.detachedDGAppClientLocked(bindingCode) != nil
+}
+
+func (server *CitrusServer) detachedDGAppClientLocked(bindingCode string) *CitrusClient {
+	if bindingCode == "" {
+		return nil
+	}
+	for _, client := range server.clients.secureMapping {
+		if client.typ == ClientTypeDGApp && client.conn == nil && client.bindingCode == bindingCode {
+			return client
+		}
+	}
+	return nil
+}
+
+// markConnected records where and when a client has registered or connected from.
+func (server *CitrusServer) markConnected(client *CitrusClient, clientIP string) {
+	remoteIPHash := hashClientIP(clientIP)
+	server.clients.mutex.Lock()
+	defer server.clients.mutex.Unlock()
+
+	client.remoteIPHash = remoteIPHash
+	client.connectedAt = time.Now()
+	client.touch()
+}
+
+// touch records that the server has heard from the client.
+func (client *CitrusClient) touch() {
+	client.lastSeen.Store(time.Now().UnixNano())
+}
+
+// insecureClientIdAllowed checks whether clients can be identified by their IP address instead of a client ID.
+func (server *CitrusServer) insecureClientIdAllowed() bool {
+	return server.allowInsecureClientId.Load()
+}
+
+// closeConn ends a websocket connection from the server side. Hertz does not allow closing a hijacked connection
+// directly, so a close message is sent and the pending read is interrupted, after which the serving goroutine returns
+// and hertz closes the connection.
+func closeConn(conn *websocket.Conn, reason string) {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	_ = conn.SetReadDeadline(time.Now())
+}
+
+func (server *CitrusServer) checkResumeToken(typ CitrusClientType, secureId ClientSecureId, resumeToken string) error {
+	server.clients.mutex.RLock()
+	defer server.clients.mutex.RUnlock()
+
+	_, err := server.checkResumeTokenLocked(typ, secureId, resumeToken)
+	return err
+}
+
+func (server *CitrusServer) checkResumeTokenLocked(typ CitrusClientType, secureId ClientSecureId, resumeToken string) (*CitrusClient, error) {
+	client, ok := server.clients.secureMapping[secureId]
+	if !ok || client.typ != typ {
+		return nil, fmt.Errorf("no session to resume for client with secure ID %s, it may have expired", secureId)
+	}
+	if client.resumeToken == "" || subtle.ConstantTimeCompare([]byte(client.resumeToken), []byte(resumeToken)) != 1 {
+		return nil, fmt.Errorf("invalid resume token for client with secure ID %s", secureId)
+	}
+	return client, nil
+}
+
+// detachClient detaches a websocket client from its closed connection. The client keeps its bindings, and is purged if
+// it does not resume within the resume grace period.
+func (server *CitrusServer) detachClient(client *CitrusClient, conn *websocket.Conn) {
+	server.clients.mutex.Lock()
+	defer server.clients.mutex.Unlock()
+
+	if client.conn != conn {
+		// the client has already resumed on a new connection
+		return
+	}
+	serverLog.Info("Detached client", "client", client)
+	client.conn = nil
+	server.schedulePurgeLocked(client)
+}
+
+// insecureIdInUse checks whether a client that can still be reached is registered with the given insecure ID.
+func (server *CitrusServer) insecureIdInUse(insecureId ClientInsecureId) bool {
+	server.clients.mutex.RLock()
+	defer server.clients.mutex.RUnlock()
+
 	client, ok := server.clients.insecureMapping[insecureId]
 	if !ok {
-		hlog.Errorf("purgeClient: Client with insecure ID %s not found", insecureId)
+		return false
+	}
+	return client.typ == ClientTypeThirdPartyHTTP || client.conn != nil
+}
+
+// schedulePurgeLocked purges a detached websocket client if it does not reconnect within the resume grace period.
+func (server *CitrusServer) schedulePurgeLocked(client *CitrusClient) {
+	client.purgeTimer = time.AfterFunc(config.Conf.ResumeGracePeriod, func() {
+		server.clients.mutex.RLock()
+		detached := client.conn == nil
+		server.clients.mutex.RUnlock()
+		if detached {
+			server.purgeClient(newCorrelationContext(context.Background()), client.secureId)
+		}
+	})
+}
+
+func (server *CitrusServer) purgeClient(ctx context.Context, secureId ClientSecureId) {
+	defer server.persist()
+	server.clients.mutex.Lock()
+
+	client, ok := server.clients.secureMapping[secureId]
+	if !ok {
+		server.clients.mutex.Unlock()
+		serverLog.ErrorContext(ctx, "Client to purge not found", "clientId", secureId)
 		return
 	}
+	serverLog.InfoContext(ctx, "Purging client", "client", client)
+	connectedPeers := make([]ClientSecureId, 0, len(client.bindings))
+	for bindingId := range client.bindings {
+		if peer, ok := server.clients.secureMapping[bindingId]; ok && peer.conn != nil {
+			connectedPeers = append(connectedPeers, bindingId)
+		}
+	}
 
-	err := server.unbindClientFromAllBindings(client.secureId)
+	err := server.unbindClientFromAllBindingsLocked(secureId)
 	if err != nil {
+		server.clients.mutex.Unlock()
 		return
 	}
 
-	delete(server.clients.secureMapping, client.secureId)
-	delete(server.clients.insecureMapping, insecureId)
+	delete(server.clients.secureMapping, secureId)
+	// the insecure ID may have been taken over by a newer client from the same address
+	if server.clients.insecureMapping[client.insecureId] == client {
+		delete(server.clients.insecureMapping, client.insecureId)
+	}
+	server.clients.mutex.Unlock()
+	server.forgetStrength(secureId)
+	server.stopRecording(secureId)
+
+	for _, peerId := range connectedPeers {
+		event := &EventBreak{
+			ClientId: secureId,
+			TargetId: peerId,
+		}
+		if client.typ == ClientTypeDGApp {
+			event.ClientId, event.TargetId = peerId, secureId
+		}
+		err := server.sendEvent(ctx, peerId, event)
+		if err != nil {
+			serverLog.ErrorContext(ctx, "Failed to notify peer of the purged client", "clientId", secureId, "peerId", peerId, "error", err)
+		}
+	}
 }
 
 func (server *CitrusServer) getClientSecure(secureId ClientSecureId) (*CitrusClient, error) {
@@ -162,6 +543,27 @@ func (server *CitrusServer) getClientSecure(secureId ClientSecureId) (*CitrusCli
 	return client, nil
 }
 
+// getThirdPartyClient returns the third party client with the given secure ID, which a DG-LAB app can bind to.
+func (server *CitrusServer) getThirdPartyClient(secureId ClientSecureId) (*CitrusClient, error) {
+	client, err := server.getClientSecure(secureId)
+	if err != nil {
+		return nil, err
+	}
+	if !client.typ.isThirdParty() {
+		return nil, fmt.Errorf("getThirdPartyClient: client with secure ID %s is not a Third Party client", secureId)
+	}
+	return client, nil
+}
+
+// describeClient identifies the client with the given secure ID in logs, see CitrusClient.String.
+func (server *CitrusServer) describeClient(secureId ClientSecureId) string {
+	client, err := server.getClientSecure(secureId)
+	if err != nil {
+		return string(secureId)
+	}
+	return client.String()
+}
+
 func (server *CitrusServer) getClientInsecure(insecureId ClientInsecureId) (*CitrusClient, error) {
 	server.clients.mutex.RLock()
 	defer server.clients.mutex.RUnlock()
@@ -175,6 +577,7 @@ func (server *CitrusServer) getClientInsecure(insecureId ClientInsecureId) (*Cit
 }
 
 func (server *CitrusServer) bindClients(dgAppClientId ClientSecureId, thirdPartyClientId ClientSecureId) error {
+	defer server.persist()
 	server.clients.mutex.Lock()
 	defer server.clients.mutex.Unlock()
 
@@ -189,23 +592,49 @@ func (server *CitrusServer) bindClients(dgAppClientId ClientSecureId, thirdParty
 	if !ok {
 		return fmt.Errorf("bindClients: Third Party client with secure ID %s not found", thirdPartyClientId)
 	}
-	if thirdPartyClient.typ != ClientTypeThirdPartyWS && thirdPartyClient.typ != ClientTypeThirdPartyHTTP {
+	if !thirdPartyClient.typ.isThirdParty() {
 		return fmt.Errorf("bindClients: client with secure ID %s is not a Third Party client", thirdPartyClientId)
 	}
 
 	if _, ok := dgAppClient.bindings[thirdPartyClientId]; ok {
-		return fmt.Errorf("bindClients: Clients with secure IDs %s and %s are already bound", dgAppClientId, thirdPartyClientId)
+		return fmt.Errorf("bindClients: Clients with secure IDs %s and %s: %w", dgAppClientId, thirdPartyClientId, errClientsAlreadyBound)
+	}
+	if err := server.checkAPIKeyBindingLimitLocked(thirdPartyClient.apiKeyName); err != nil {
+		return fmt.Errorf("bindClients: %w", err)
 	}
 
-	dgAppClient.bindings[thirdPartyClientId] = true
-	thirdPartyClient.bindings[dgAppClientId] = true
+	// the scope chosen by the third party client for the bind token only applies to the binding made with the token,
+	// an app binding with the secure ID of another third party client is bound as with a legacy binding code
+	var scope BindingScope
+	switch {
+	case dgAppClient.bindingCodeOwner == thirdPartyClientId:
+		scope = dgAppClient.bindingCodeScope
+		if scope == "" {
+			scope = BindingScopeFull
+		}
+	case config.Conf.LegacyBindingCodes:
+		scope = BindingScope(config.Conf.LegacyBindingScope)
+	default:
+		return fmt.Errorf("bindClients: DG App client with secure ID %s can only bind to the third party client of its binding code", dgAppClientId)
+	}
+	if thirdPartyClient.typ == ClientTypeObserver {
+		scope = BindingScopeReadOnly
+	}
+	dgAppClient.bindings[thirdPartyClientId] = scope
+	thirdPartyClient.bindings[dgAppClientId] = scope
 	return nil
 }
 
 func (server *CitrusServer) unbindClientFromAllBindings(secureId ClientSecureId) error {
+	defer server.persist()
 	server.clients.mutex.Lock()
 	defer server.clients.mutex.Unlock()
 
+	return server.unbindClientFromAllBindingsLocked(secureId)
+}
+
+// unbindClientFromAllBindingsLocked is the same as unbindClientFromAllBindings, but expects the caller to hold the lock.
+func (server *CitrusServer) unbindClientFromAllBindingsLocked(secureId ClientSecureId) error {
 	client, ok := server.clients.secureMapping[secureId]
 	if !ok {
 		return fmt.Errorf("unbindClientFromAllBindings: Client with secure ID %s not found", secureId)
@@ -214,17 +643,17 @@ func (server *CitrusServer) unbindClientFromAllBindings(secureId ClientSecureId)
 	for binding := range client.bindings {
 		peerClient, ok := server.clients.secureMapping[binding]
 		if !ok {
-			hlog.Errorf("unbindClientFromAllBindings: Client with secure ID %s not found", binding)
+			serverLog.Error("Bound client not found", "clientId", secureId, "peerId", binding)
 			continue
 		}
 		delete(peerClient.bindings, secureId)
 	}
-	client.bindings = make(map[ClientSecureId]bool)
+	client.bindings = make(map[ClientSecureId]BindingScope)
 
 	return nil
 }
 
-func (server *CitrusServer) getClientBindings(secureId ClientSecureId) ([]CitrusClient, error) {
+func (server *CitrusServer) getClientBindings(secureId ClientSecureId) ([]Binding, error) {
 	server.clients.mutex.RLock()
 	defer server.clients.mutex.RUnlock()
 
@@ -233,45 +662,250 @@ func (server *CitrusServer) getClientBindings(secureId ClientSecureId) ([]Citrus
 		return nil, fmt.Errorf("getClientBindings: Client with secure ID %s not found", secureId)
 	}
 
-	bindings := make([]CitrusClient, 0)
-	for bindingId := range client.bindings {
-		binding, ok := server.clients.secureMapping[bindingId]
+	bindings := make([]Binding, 0)
+	for bindingId, scope := range client.bindings {
+		peer, ok := server.clients.secureMapping[bindingId]
 		if !ok {
-			hlog.Errorf("getClientBindings: Binding with secure ID %s not found", bindingId)
+			serverLog.Error("Bound client not found", "clientId", secureId, "peerId", bindingId)
 			continue
 		}
-		bindings = append(bindings, *binding)
+		binding := Binding{
+			peer:          peer,
+			scope:         scope,
+			peerConnected: peer.typ == ClientTypeThirdPartyHTTP || peer.conn != nil,
+		}
+		if peer.strength != nil {
+			strength := *peer.strength
+			binding.peerStrength = &strength
+		}
+		bindings = append(bindings, binding)
 	}
 
 	return bindings, nil
 }
 
-func (server *CitrusServer) sendEvent(secureId ClientSecureId, event Event) error {
+// setStrength records the strength a DG-LAB app has reported.
+func (server *CitrusServer) setStrength(appId ClientSecureId, strength DataReportStrength) {
+	server.clients.mutex.Lock()
+	defer server.clients.mutex.Unlock()
+
+	if client, ok := server.clients.secureMapping[appId]; ok && client.typ == ClientTypeDGApp {
+		client.strength = &strength
+		bound := strength
+		if client.strengthBound != nil {
+			bound.ChannelAValue = max(bound.ChannelAValue, client.strengthBound.ChannelAValue)
+			bound.ChannelBValue = max(bound.ChannelBValue, client.strengthBound.ChannelBValue)
+		}
+		client.strengthBound = &bound
+	}
+}
+
+// admitAdjustStrength checks a strength adjustment for a DG-LAB app against the scope of the binding it is sent through,
+// and applies an admitted adjustment to the strength bound of the app. Checking and applying at once keeps concurrent
+// adjustments from being checked against the same bound.
+func (server *CitrusServer) admitAdjustStrength(appId ClientSecureId, scope BindingScope, adjust DataAdjustStrength) bool {
+	server.clients.mutex.Lock()
+	defer server.clients.mutex.Unlock()
+
+	client, ok := server.clients.secureMapping[appId]
+	if !ok || !scope.allowsAdjustStrength(adjust, client.strengthBound) {
+		return false
+	}
+	if client.strengthBound != nil {
+		bound := adjust.apply(*client.strengthBound)
+		client.strengthBound = &bound
+	}
+	return true
+}
+
+// listBindings describes the DG-LAB apps the third party client with the given secure ID is bound to.
+func (server *CitrusServer) listBindings(secureId ClientSecureId) ([]BindingInfo, error) {
 	server.clients.mutex.RLock()
 	defer server.clients.mutex.RUnlock()
 
 	client, ok := server.clients.secureMapping[secureId]
 	if !ok {
-		return fmt.Errorf("sendEvent: Client with secure ID %s not found", secureId)
+		return nil, fmt.Errorf("listBindings: Client with secure ID %s not found", secureId)
+	}
+
+	bindings := make([]BindingInfo, 0, len(client.bindings))
+	for appId, scope := range client.bindings {
+		app, ok := server.clients.secureMapping[appId]
+		if !ok {
+			serverLog.Error("Bound client not found", "clientId", secureId, "peerId", appId)
+			continue
+		}
+		binding := BindingInfo{
+			AppId:       appId,
+			Scope:       scope,
+			Connected:   app.conn != nil,
+			Controllers: make([]ControllerInfo, 0, len(app.bindings)),
+		}
+		for controllerId := range app.bindings {
+			controller, ok := server.clients.secureMapping[controllerId]
+			if !ok {
+				continue
+			}
+			info := ControllerInfo{
+				Self:      controllerId == secureId,
+				Observer:  controller.typ == ClientTypeObserver,
+				Connected: controller.typ == ClientTypeThirdPartyHTTP || controller.conn != nil,
+			}
+			if controller.metadata != nil {
+				info.ClientMetadata = *controller.metadata
+			}
+			binding.Controllers = append(binding.Controllers, info)
+		}
+		bindings = append(bindings, binding)
 	}
 
+	return bindings, nil
+}
+
+// sendEvent sends an event to a websocket client, it is logged with the correlation ID of the context.
+func (server *CitrusServer) sendEvent(ctx context.Context, secureId ClientSecureId, event Event) error {
 	rawEvent, err := event.ToRawEvent()
 	if err != nil {
-		hlog.Errorf("sendEvent: Failed to convert event to raw event: %v", err)
-		return err
+		return fmt.Errorf("sendEvent: Failed to convert event to raw event: %v", err)
 	}
-	if client.typ == ClientTypeDGApp {
+
+	// the write may block on a slow client, so it happens after the clients mutex is released
+	server.clients.mutex.RLock()
+	client, ok := server.clients.secureMapping[secureId]
+	if !ok {
+		server.clients.mutex.RUnlock()
+		return fmt.Errorf("sendEvent: Client with secure ID %s not found", secureId)
+	}
+	if client.conn == nil {
+		server.clients.mutex.RUnlock()
+		return fmt.Errorf("sendEvent: Client with secure ID %s is not connected", secureId)
+	}
+	typ, conn, writeMutex := client.typ, client.conn, &client.writeMutex
+	if typ == ClientTypeDGApp {
 		rawEvent.TargetId = string(secureId)
+		if client.bindingCodeOwner != "" && rawEvent.ClientId == string(client.bindingCodeOwner) {
+			rawEvent.ClientId = client.bindingCode
+		}
 	} else {
 		rawEvent.ClientId = string(secureId)
 	}
+	server.clients.mutex.RUnlock()
+
 	data, err := rawEvent.ToByteArray()
 	if err != nil {
 		return fmt.Errorf("sendEvent: Failed to serialize event: %v", err)
 	}
-	err = client.conn.WriteMessage(websocket.TextMessage, data)
+	_, kind := eventLabels(event)
+	serverLog.DebugContext(ctx, "Sending event", eventLogAttrs(event, "out", "clientId", secureId, "message", rawEvent.Message)...)
+	start := time.Now()
+	sendQueueDepth.Inc()
+	writeMutex.Lock()
+	sendQueueDepth.Dec()
+	err = conn.WriteMessage(websocket.TextMessage, data)
+	writeMutex.Unlock()
+	sendEventDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
 	if err != nil {
 		return fmt.Errorf("sendEvent: WriteMessage failed: %v", err)
 	}
+	server.record(ctx, typ, secureId, RecordingDirectionOut, rawEvent)
+	return nil
+}
+
+// restore loads the clients and bindings saved in the store. Restored websocket clients are detached until they
+// reconnect, and are purged if they do not reconnect within the resume grace period.
+func (server *CitrusServer) restore() error {
+	snapshot, err := server.store.Load()
+	if err != nil {
+		return fmt.Errorf("restore: %v", err)
+	}
+
+	server.restoreInsecureIdSalt(snapshot.InsecureIdSalt)
+
+	server.clients.mutex.Lock()
+	defer server.clients.mutex.Unlock()
+
+	for _, clientSnapshot := range snapshot.Clients {
+		client := &CitrusClient{
+			typ:         clientSnapshot.Type,
+			secureId:    clientSnapshot.SecureId,
+			insecureId:  clientSnapshot.InsecureId,
+			bindings:    make(map[ClientSecureId]BindingScope),
+			resumeToken: clientSnapshot.ResumeToken,
+			auditKey:    clientSnapshot.AuditKey,
+
+			bindingCode:      clientSnapshot.BindingCode,
+			bindingCodeOwner: clientSnapshot.BindingCodeOwner,
+			bindingCodeScope: clientSnapshot.BindingCodeScope,
+			metadata:         clientSnapshot.Metadata,
+			apiKeyName:       clientSnapshot.APIKeyName,
+		}
+		if client.typ == ClientTypeDGApp && client.auditKey == "" {
+			// the state has been saved before apps had audit keys
+			client.auditKey = generateRandomHex(16)
+		}
+		for _, bindingId := range clientSnapshot.Bindings {
+			client.bindings[bindingId] = BindingScopeFull
+			if scope, ok := clientSnapshot.BindingScopes[bindingId]; ok {
+				client.bindings[bindingId] = scope
+			}
+		}
+		server.clients.secureMapping[client.secureId] = client
+		if client.insecureId != "" {
+			server.clients.insecureMapping[client.insecureId] = client
+		}
+		if client.typ != ClientTypeThirdPartyHTTP {
+			server.schedulePurgeLocked(client)
+		}
+	}
+	serverLog.Info("Restored state", "clients", len(snapshot.Clients))
 	return nil
 }
+
+// persist saves all clients and bindings to the store if persistence is enabled, it must be called without holding the
+// clients lock.
+func (server *CitrusServer) persist() {
+	if server.store == nil {
+		return
+	}
+	// the lock keeps snapshots from being saved out of order
+	server.persistMutex.Lock()
+	defer server.persistMutex.Unlock()
+
+	snapshot := &Snapshot{
+		InsecureIdSalt: server.snapshotInsecureIdSalt(),
+	}
+	server.clients.mutex.RLock()
+	snapshot.Clients = make([]ClientSnapshot, 0, len(server.clients.secureMapping))
+	for _, client := range server.clients.secureMapping {
+		clientSnapshot := ClientSnapshot{
+			Type:        client.typ,
+			SecureId:    client.secureId,
+			InsecureId:  client.insecureId,
+			ResumeToken: client.resumeToken,
+			AuditKey:    client.auditKey,
+			Bindings:    make([]ClientSecureId, 0, len(client.bindings)),
+
+			BindingCode:      client.bindingCode,
+			BindingCodeOwner: client.bindingCodeOwner,
+			BindingCodeScope: client.bindingCodeScope,
+			Metadata:         client.metadata,
+			APIKeyName:       client.apiKeyName,
+		}
+		for bindingId, scope := range client.bindings {
+			clientSnapshot.Bindings = append(clientSnapshot.Bindings, bindingId)
+			if scope != BindingScopeFull {
+				if clientSnapshot.BindingScopes == nil {
+					clientSnapshot.BindingScopes = make(map[ClientSecureId]BindingScope)
+				}
+				clientSnapshot.BindingScopes[bindingId] = scope
+			}
+		}
+		snapshot.Clients = append(snapshot.Clients, clientSnapshot)
+	}
+	server.clients.mutex.RUnlock()
+
+	err := server.store.Save(snapshot)
+	if err != nil {
+		serverLog.Error("Failed to save state", "error", err)
+	}
+}
@@ -0,0 +1,189 @@
+package citrus_server
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/cloudwego/hertz/pkg/common/adaptor"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+	metricsHandler  = promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+	eventsProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "citrus",
+		Name:      "events_processed_total",
+		Help:      "Events processed by the server, by event type and message kind.",
+	}, []string{"event_type", "kind"})
+	forwardFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "citrus",
+		Name:      "forward_failures_total",
+		Help:      "Events which failed to be forwarded to a bound client, by message kind.",
+	}, []string{"kind"})
+	sendEventDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "citrus",
+		Name:      "send_event_duration_seconds",
+		Help:      "Time taken to send an event to a websocket client, including waiting for other writes to the client, by message kind.",
+		Buckets:   prometheus.ExponentialBuckets(0.00005, 4, 9),
+	}, []string{"kind"})
+	sendQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "citrus",
+		Name:      "send_queue_depth",
+		Help:      "Events waiting for another write to the connection of their recipient to finish.",
+	})
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "citrus",
+		Name:      "http_requests_total",
+		Help:      "HTTP requests, including websocket upgrades, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+)
+
+var clientTypeLabels = map[CitrusClientType]string{
+	ClientTypeDGApp:          "dg_app",
+	ClientTypeThirdPartyWS:   "third_party_ws",
+	ClientTypeThirdPartyHTTP: "third_party_http",
+	ClientTypeObserver:       "observer",
+}
+
+func init() {
+	metricsRegistry.MustRegister(
+		eventsProcessed,
+		forwardFailures,
+		sendEventDuration,
+		sendQueueDepth,
+		httpRequests,
+		stateCollector{},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// eventLabels returns the event type and message kind of an event for metrics.
+func eventLabels(event Event) (EventType, string) {
+	switch event.(type) {
+	case *EventHeartbeat:
+		return EventTypeHeartbeat, "heartbeat"
+	case *EventBindToServer:
+		return EventTypeBind, "bind_to_server"
+	case *EventBindAppToThirdParty:
+		return EventTypeBind, "bind_app"
+	case *EventBindResult:
+		return EventTypeBind, "bind_result"
+	case *EventBreak:
+		return EventTypeBreak, "break"
+	case *EventError:
+		return EventTypeError, "error"
+	case *EventReportStrength:
+		return EventTypeMsg, "strength_report"
+	case *EventAdjustStrength:
+		return EventTypeMsg, "strength_adjust"
+	case *EventExecutePulse:
+		return EventTypeMsg, "pulse"
+	case *EventStopPulse:
+		return EventTypeMsg, "clear"
+	case *EventReportFeedback:
+		return EventTypeMsg, "feedback"
+	case *EventControlActivity:
+		return EventTypeMsg, "control_activity"
+	default:
+		return "unknown", "unknown"
+	}
+}
+
+func countEvent(event Event) {
+	eventType, kind := eventLabels(event)
+	eventsProcessed.WithLabelValues(string(eventType), kind).Inc()
+}
+
+func countForwardFailure(event Event) {
+	_, kind := eventLabels(event)
+	forwardFailures.WithLabelValues(kind).Inc()
+}
+
+// stateCollector reports the clients, bindings and bind tokens of the server when metrics are scraped.
+type stateCollector struct{}
+
+var (
+	clientsDesc    = prometheus.NewDesc("citrus_clients", "Registered clients, by client type and whether they are connected.", []string{"type", "state"}, nil)
+	bindingsDesc   = prometheus.NewDesc("citrus_bindings", "Active bindings between DG-LAB apps and third party clients, by binding scope.", []string{"scope"}, nil)
+	bindTokensDesc = prometheus.NewDesc("citrus_bind_tokens", "Bind tokens which have not expired yet, by whether a DG-LAB app has redeemed them.", []string{"state"}, nil)
+)
+
+func (stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- clientsDesc
+	ch <- bindingsDesc
+	ch <- bindTokensDesc
+}
+
+func (stateCollector) Collect(ch chan<- prometheus.Metric) {
+	server := citrusServer
+	type clientState struct {
+		typ       CitrusClientType
+		connected bool
+	}
+	clients := make(map[clientState]int)
+	for typ := range clientTypeLabels {
+		clients[clientState{typ, true}] = 0
+		clients[clientState{typ, false}] = 0
+	}
+	bindings := make(map[BindingScope]int)
+	server.clients.mutex.RLock()
+	for _, client := range server.clients.secureMapping {
+		clients[clientState{client.typ, client.typ == ClientTypeThirdPartyHTTP || client.conn != nil}]++
+		if client.typ == ClientTypeDGApp {
+			for _, scope := range client.bindings {
+				bindings[scope]++
+			}
+		}
+	}
+	server.clients.mutex.RUnlock()
+	for state, count := range clients {
+		connected := "detached"
+		if state.connected {
+			connected = "connected"
+		}
+		ch <- prometheus.MustNewConstMetric(clientsDesc, prometheus.GaugeValue, float64(count), clientTypeLabels[state.typ], connected)
+	}
+	for scope, count := range bindings {
+		ch <- prometheus.MustNewConstMetric(bindingsDesc, prometheus.GaugeValue, float64(count), string(scope))
+	}
+
+	pending, redeemed := server.countBindTokens()
+	ch <- prometheus.MustNewConstMetric(bindTokensDesc, prometheus.GaugeValue, float64(pending), "pending")
+	ch <- prometheus.MustNewConstMetric(bindTokensDesc, prometheus.GaugeValue, float64(redeemed), "redeemed")
+}
+
+// HTTPMetrics is a middleware counting HTTP requests by route.
+func HTTPMetrics(ctx context.Context, c *app.RequestContext) {
+	c.Next(ctx)
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.WithLabelValues(route, string(c.Method()), strconv.Itoa(c.Response.StatusCode())).Inc()
+}
+
+// MetricsHandler exposes the metrics of the server in the Prometheus format.
+func MetricsHandler(ctx context.Context, c *app.RequestContext) {
+	if token := config.Conf.MetricsToken; token != "" {
+		given := string(c.GetHeader("Authorization"))
+		if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) != 1 {
+			failWithStatus(ctx, c, http.StatusUnauthorized, "MetricsHandler", "A valid metrics token is required")
+			return
+		}
+	}
+	req, err := adaptor.GetCompatRequest(&c.Request)
+	if err != nil {
+		fail(ctx, c, "MetricsHandler", err.Error())
+		return
+	}
+	metricsHandler.ServeHTTP(adaptor.GetCompatResponseWriter(&c.Response), req)
+}
@@ -1,52 +1,84 @@
 package citrus_server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"strconv"
 
-	"github.com/cloudwego/hertz/pkg/common/hlog"
+	"github.com/tundrawork/DG-citrus/config"
 )
 
-func (e *EventBreak) Process() error {
+func (e *EventBreak) Process(ctx context.Context) error {
 	return fmt.Errorf("should never receive EventBreak")
 }
 
-func (e *EventBindToServer) Process() error {
+func (e *EventBindToServer) Process(ctx context.Context) error {
 	return fmt.Errorf("should never receive EventBindToServer")
 }
 
-func (e *EventBindResult) Process() error {
+func (e *EventBindResult) Process(ctx context.Context) error {
 	return fmt.Errorf("should never receive EventBindResult")
 }
 
-func (e *EventError) Process() error {
-	hlog.Warnf("[Processor] Received error: appId = %s, thirdPartyId = %s, message = %s", e.TargetId, e.ClientId, e.Message)
+func (e *EventControlActivity) Process(ctx context.Context) error {
+	return fmt.Errorf("should never receive EventControlActivity")
+}
+
+func (e *EventError) Process(ctx context.Context) error {
+	countEvent(e)
+	processorLog.WarnContext(ctx, "Received error", eventLogAttrs(e, "in", "appId", e.TargetId, "thirdParty", logClient(e.ClientId), "message", e.Message)...)
+	citrusServer.recordActivity(DashboardActivityError, e.ClientId, e.TargetId, fmt.Sprintf("Received error %s", e.Message))
 	return nil
 }
 
-func (e *EventHeartbeat) Process() error {
-	hlog.Infof("[Processor] Received heartbeat: appId = %s, thirdPartyId = %s", e.TargetId, e.ClientId)
+func (e *EventHeartbeat) Process(ctx context.Context) error {
+	countEvent(e)
+	processorLog.DebugContext(ctx, "Received heartbeat", eventLogAttrs(e, "in", "thirdParty", logClient(e.ClientId))...)
 	return nil
 }
 
-func (e *EventBindAppToThirdParty) Process() error {
-	hlog.Infof("[Processor] Received bind app to third party: appId = %s, thirdPartyId = %s", e.TargetId, e.ClientId)
+func (e *EventBindAppToThirdParty) Process(ctx context.Context) error {
+	countEvent(e)
+	processorLog.InfoContext(ctx, "Received bind app to third party", eventLogAttrs(e, "in", "appId", e.TargetId, "thirdParty", logClient(e.ClientId))...)
 	event := &EventBindResult{
 		ClientId: e.ClientId,
 		TargetId: e.TargetId,
 	}
-	err := citrusServer.bindClients(e.TargetId, e.ClientId)
-	if err != nil {
-		hlog.Errorf("[Processor] Failed to bind app to third party: appId = %s, thirdPartyId = %s, error = %v", e.TargetId, e.ClientId, err)
-		event.Code = 400
-		err = citrusServer.sendEvent(e.TargetId, event)
+	// let the app and its owner know who they are bound to
+	if client, err := citrusServer.getClientSecure(e.ClientId); err == nil {
+		event.Controller = client.metadata
+	}
+	if config.Conf.RequireBindingApproval {
+		approved, consentSecret, err := citrusServer.checkBindingApproval(e.TargetId, e.ClientId)
 		if err != nil {
-			return err
+			processorLog.ErrorContext(ctx, "Failed to bind app to third party", "appId", e.TargetId, "thirdParty", logClient(e.ClientId), "error", err)
+			event.Code = 400
+			return citrusServer.sendEvent(ctx, e.TargetId, event)
+		}
+		if !approved {
+			processorLog.InfoContext(ctx, "Binding is waiting for approval", "appId", e.TargetId, "thirdParty", logClient(e.ClientId))
+			// only the app gets the consent page, so that its owner is the one deciding, the official app does not show
+			// it though, and its owner finds it on the consent page list instead
+			event.Code = 202
+			event.ConsentURL = bindingConsentURL(consentSecret)
+			return citrusServer.sendEvent(ctx, e.TargetId, event)
 		}
 	}
+	err := citrusServer.bindClients(e.TargetId, e.ClientId)
+	if errors.Is(err, errClientsAlreadyBound) {
+		// the app binds again after being bound on connect, or after resuming, only the app needs to know the result
+		processorLog.InfoContext(ctx, "App is already bound to third party", "appId", e.TargetId, "thirdParty", logClient(e.ClientId))
+		event.Code = 200
+		return citrusServer.sendEvent(ctx, e.TargetId, event)
+	} else if err != nil {
+		processorLog.ErrorContext(ctx, "Failed to bind app to third party", "appId", e.TargetId, "thirdParty", logClient(e.ClientId), "error", err)
+		event.Code = 400
+		return citrusServer.sendEvent(ctx, e.TargetId, event)
+	}
 
 	event.Code = 200
-	err = citrusServer.sendEvent(e.TargetId, event)
+	err = citrusServer.sendEvent(ctx, e.TargetId, event)
 	if err != nil {
 		return err
 	}
@@ -54,8 +86,8 @@ func (e *EventBindAppToThirdParty) Process() error {
 	if err != nil {
 		return err
 	}
-	if client.typ == ClientTypeThirdPartyWS {
-		err = citrusServer.sendEvent(e.ClientId, event)
+	if client.typ.isThirdPartyWS() {
+		err = citrusServer.sendEvent(ctx, e.ClientId, event)
 		if err != nil {
 			return err
 		}
@@ -63,112 +95,264 @@ func (e *EventBindAppToThirdParty) Process() error {
 	return nil
 }
 
-func (e *EventReportStrength) Process() error {
-	hlog.Infof("[Processor] Received report strength: appId = %s, thirdPartyId = %s (ignored), strength = %+v", e.TargetId, e.ClientId, e.Strength)
+func (e *EventReportStrength) Process(ctx context.Context) error {
+	countEvent(e)
+	processorLog.DebugContext(ctx, "Received report strength", eventLogAttrs(e, "in", "appId", e.TargetId, "strength", e.Strength)...)
+	citrusServer.setStrength(e.TargetId, e.Strength)
+	citrusServer.recordStrength(e.TargetId, e.Strength)
 	bindings, err := citrusServer.getClientBindings(e.TargetId)
 	if err != nil {
-		err = failWithCode(e.ClientId, e.TargetId, 403)
+		err = failWithCode(ctx, e.ClientId, e.TargetId, 403)
 		if err != nil {
 			return err
 		}
 	}
 	for _, binding := range bindings {
 		// Only forward to websocket clients
-		if binding.typ == ClientTypeThirdPartyWS {
-			hlog.Infof("[Processor] Forwarding report strength to third party: appId = %s, thirdPartyId = %s", e.TargetId, binding.secureId)
-			err = citrusServer.sendEvent(binding.secureId, e)
+		if binding.peer.typ.isThirdPartyWS() {
+			processorLog.DebugContext(ctx, "Forwarding report strength to third party", "appId", e.TargetId, "thirdParty", binding.peer)
+			err = citrusServer.sendEvent(ctx, binding.peer.secureId, e)
 			if err != nil {
-				hlog.Errorf("[Processor] Failed to forward report strength to third party: appId = %s, thirdPartyId = %s, error = %v", e.TargetId, binding.secureId, err)
+				processorLog.ErrorContext(ctx, "Failed to forward report strength to third party", "appId", e.TargetId, "thirdParty", binding.peer, "error", err)
+				countForwardFailure(e)
 			}
 		}
 	}
 	return nil
 }
 
-func (e *EventAdjustStrength) Process() error {
-	hlog.Infof("[Processor] Received adjust strength: thirdPartyId = %s, appId = %s (ignored), strength = %+v", e.ClientId, e.TargetId, e.Strength)
+func (e *EventAdjustStrength) Process(ctx context.Context) error {
+	countEvent(e)
+	processorLog.DebugContext(ctx, "Received adjust strength", eventLogAttrs(e, "in", "thirdParty", logClient(e.ClientId), "strength", e.Strength)...)
+	if err := denyObserver(ctx, e.ClientId, e.TargetId); err != nil {
+		return err
+	}
 	bindings, err := citrusServer.getClientBindings(e.ClientId)
 	if err != nil {
-		err = failWithCode(e.ClientId, e.TargetId, 403)
+		err = failWithCode(ctx, e.ClientId, e.TargetId, 403)
 		if err != nil {
 			return err
 		}
 	}
+	var denied []ClientSecureId
 	for _, binding := range bindings {
-		hlog.Infof("[Processor] Forwarding adjust strength to DG-LAB app: thirdPartyId = %s, appId = %s", e.ClientId, binding.secureId)
-		err = citrusServer.sendEvent(binding.secureId, e)
+		if !citrusServer.admitAdjustStrength(binding.peer.secureId, binding.scope, e.Strength) {
+			processorLog.WarnContext(ctx, "Binding scope denies adjust strength", "thirdParty", logClient(e.ClientId), "appId", binding.peer.secureId, "scope", binding.scope)
+			denied = append(denied, binding.peer.secureId)
+			continue
+		}
+		processorLog.DebugContext(ctx, "Forwarding adjust strength to DG-LAB app", "thirdParty", logClient(e.ClientId), "appId", binding.peer.secureId)
+		err = citrusServer.sendEvent(ctx, binding.peer.secureId, e)
 		if err != nil {
-			hlog.Errorf("[Processor] Failed to forward adjust strength to DG-LAB app: thirdPartyId = %s, appId = %s, error = %v", e.ClientId, binding.secureId, err)
+			processorLog.ErrorContext(ctx, "Failed to forward adjust strength to DG-LAB app", "thirdParty", logClient(e.ClientId), "appId", binding.peer.secureId, "error", err)
+			countForwardFailure(e)
+			continue
 		}
+		notifyObservers(ctx, e.ClientId, binding.peer.secureId, e)
+		citrusServer.recordCommand(e.ClientId, binding.peer.secureId, e)
+		citrusServer.auditCommand(ctx, e.ClientId, binding, e)
 	}
-	return nil
+	return denyCommand(ctx, e.ClientId, denied)
 }
 
-func (e *EventExecutePulse) Process() error {
-	hlog.Infof("[Processor] Received execute pulse: thirdPartyId = %s, appId = %s (ignored), channel = %d, pulseSequences = %+v", e.ClientId, e.TargetId, e.Channel, e.PulseSequences)
+func (e *EventExecutePulse) Process(ctx context.Context) error {
+	countEvent(e)
+	processorLog.DebugContext(ctx, "Received execute pulse", eventLogAttrs(e, "in", "thirdParty", logClient(e.ClientId), "channel", e.Channel, "pulseSequences", e.PulseSequences)...)
+	if err := denyObserver(ctx, e.ClientId, e.TargetId); err != nil {
+		return err
+	}
 	bindings, err := citrusServer.getClientBindings(e.ClientId)
 	if err != nil {
-		err = failWithCode(e.ClientId, e.TargetId, 403)
+		err = failWithCode(ctx, e.ClientId, e.TargetId, 403)
 		if err != nil {
 			return err
 		}
 	}
+	var denied []ClientSecureId
 	for _, binding := range bindings {
-		hlog.Infof("[Processor] Forwarding execute pulse to DG-LAB app: thirdPartyId = %s, appId = %s", e.ClientId, binding.secureId)
-		err = citrusServer.sendEvent(binding.secureId, e)
+		if !binding.scope.allowsPulses() {
+			processorLog.WarnContext(ctx, "Binding scope denies execute pulse", "thirdParty", logClient(e.ClientId), "appId", binding.peer.secureId, "scope", binding.scope)
+			denied = append(denied, binding.peer.secureId)
+			continue
+		}
+		processorLog.DebugContext(ctx, "Forwarding execute pulse to DG-LAB app", "thirdParty", logClient(e.ClientId), "appId", binding.peer.secureId)
+		err = citrusServer.sendEvent(ctx, binding.peer.secureId, e)
 		if err != nil {
-			hlog.Errorf("[Processor] Failed to forward execute pulse to DG-LAB app: thirdPartyId = %s, appId = %s, error = %v", e.ClientId, binding.secureId, err)
+			processorLog.ErrorContext(ctx, "Failed to forward execute pulse to DG-LAB app", "thirdParty", logClient(e.ClientId), "appId", binding.peer.secureId, "error", err)
+			countForwardFailure(e)
+			continue
 		}
+		notifyObservers(ctx, e.ClientId, binding.peer.secureId, e)
+		citrusServer.recordCommand(e.ClientId, binding.peer.secureId, e)
+		citrusServer.auditCommand(ctx, e.ClientId, binding, e)
 	}
-	return nil
+	return denyCommand(ctx, e.ClientId, denied)
 }
 
-func (e *EventStopPulse) Process() error {
-	hlog.Infof("[Processor] Received stop pulse: thirdPartyId = %s, appId = %s (ignored), channel = %d", e.ClientId, e.TargetId, e.Channel)
+func (e *EventStopPulse) Process(ctx context.Context) error {
+	countEvent(e)
+	processorLog.DebugContext(ctx, "Received stop pulse", eventLogAttrs(e, "in", "thirdParty", logClient(e.ClientId), "channel", e.Channel)...)
+	if err := denyObserver(ctx, e.ClientId, e.TargetId); err != nil {
+		return err
+	}
 	bindings, err := citrusServer.getClientBindings(e.ClientId)
 	if err != nil {
-		err = failWithCode(e.ClientId, e.TargetId, 403)
+		err = failWithCode(ctx, e.ClientId, e.TargetId, 403)
 		if err != nil {
 			return err
 		}
 	}
+	var denied []ClientSecureId
 	for _, binding := range bindings {
-		hlog.Infof("[Processor] Forwarding stop pulse to DG-LAB app: thirdPartyId = %s, appId = %s", e.ClientId, binding.secureId)
-		err = citrusServer.sendEvent(binding.secureId, e)
+		if !binding.scope.allowsPulses() {
+			processorLog.WarnContext(ctx, "Binding scope denies stop pulse", "thirdParty", logClient(e.ClientId), "appId", binding.peer.secureId, "scope", binding.scope)
+			denied = append(denied, binding.peer.secureId)
+			continue
+		}
+		processorLog.DebugContext(ctx, "Forwarding stop pulse to DG-LAB app", "thirdParty", logClient(e.ClientId), "appId", binding.peer.secureId)
+		err = citrusServer.sendEvent(ctx, binding.peer.secureId, e)
 		if err != nil {
-			hlog.Errorf("[Processor] Failed to forward stop pulse to DG-LAB app: thirdPartyId = %s, appId = %s, error = %v", e.ClientId, binding.secureId, err)
+			processorLog.ErrorContext(ctx, "Failed to forward stop pulse to DG-LAB app", "thirdParty", logClient(e.ClientId), "appId", binding.peer.secureId, "error", err)
+			countForwardFailure(e)
+			continue
 		}
+		notifyObservers(ctx, e.ClientId, binding.peer.secureId, e)
+		citrusServer.recordCommand(e.ClientId, binding.peer.secureId, e)
+		citrusServer.auditCommand(ctx, e.ClientId, binding, e)
 	}
-	return nil
+	return denyCommand(ctx, e.ClientId, denied)
 }
 
-func (e *EventReportFeedback) Process() error {
-	hlog.Infof("[Processor] Received report feedback: appId = %s, thirdPartyId = %s (ignored), button = %+v", e.TargetId, e.ClientId, e.Button)
+func (e *EventReportFeedback) Process(ctx context.Context) error {
+	countEvent(e)
+	processorLog.DebugContext(ctx, "Received report feedback", eventLogAttrs(e, "in", "appId", e.TargetId, "button", e.Button)...)
 	bindings, err := citrusServer.getClientBindings(e.TargetId)
 	if err != nil {
-		err = failWithCode(e.ClientId, e.TargetId, 403)
+		err = failWithCode(ctx, e.ClientId, e.TargetId, 403)
 		if err != nil {
 			return err
 		}
 	}
 	for _, binding := range bindings {
 		// Only forward to websocket clients
-		if binding.typ == ClientTypeThirdPartyWS {
-			hlog.Infof("[Processor] Forwarding report feedback to third party: appId = %s, thirdPartyId = %s", e.TargetId, binding.secureId)
-			err = citrusServer.sendEvent(binding.secureId, e)
+		if binding.peer.typ.isThirdPartyWS() {
+			processorLog.DebugContext(ctx, "Forwarding report feedback to third party", "appId", e.TargetId, "thirdParty", binding.peer)
+			err = citrusServer.sendEvent(ctx, binding.peer.secureId, e)
 			if err != nil {
-				hlog.Errorf("[Processor] Failed to forward report feedback to third party: appId = %s, thirdPartyId = %s, error = %v", e.TargetId, binding.secureId, err)
+				processorLog.ErrorContext(ctx, "Failed to forward report feedback to third party", "appId", e.TargetId, "thirdParty", binding.peer, "error", err)
+				countForwardFailure(e)
 			}
 		}
 	}
 	return nil
 }
 
-func failWithCode(clientId ClientSecureId, targetId ClientSecureId, code int) error {
+// denyCommand tells a third party client that the scopes of its bindings to the given DG-LAB apps have denied a command.
+func denyCommand(ctx context.Context, thirdPartyClientId ClientSecureId, denied []ClientSecureId) error {
+	if len(denied) == 0 {
+		return nil
+	}
+	for _, appId := range denied {
+		citrusServer.recordActivity(DashboardActivityError, thirdPartyClientId, appId, "Command denied by the binding scope")
+	}
+	client, err := citrusServer.getClientSecure(thirdPartyClientId)
+	if err == nil && client.typ == ClientTypeThirdPartyWS {
+		for _, appId := range denied {
+			event := &EventError{
+				ClientId: thirdPartyClientId,
+				TargetId: appId,
+				Message:  strconv.Itoa(ErrorCodePermissionDenied),
+			}
+			err = citrusServer.sendEvent(ctx, thirdPartyClientId, event)
+			if err != nil {
+				processorLog.ErrorContext(ctx, "Failed to send permission denied error to third party", "thirdParty", client, "appId", appId, "error", err)
+			}
+		}
+	}
+	return fmt.Errorf("binding scope does not allow this command for DG-LAB apps %v", denied)
+}
+
+// denyAppEvent rejects an event only DG-LAB apps are allowed to send, when another client sends it. Such events act on
+// behalf of the app in their target ID, so that a third party client could otherwise e.g. bind itself to any app it
+// knows the secure ID of, without a bind token, a binding scope, or the approval of the owner of the app.
+func denyAppEvent(ctx context.Context, client *CitrusClient, event Event, targetId ClientSecureId) error {
+	switch event.(type) {
+	case *EventBindAppToThirdParty, *EventReportStrength, *EventReportFeedback:
+	default:
+		return nil
+	}
+	if client.typ == ClientTypeDGApp {
+		return nil
+	}
+	processorLog.WarnContext(ctx, "Third party client is not allowed to send DG-LAB app events", eventLogAttrs(event, "in", "thirdParty", client, "appId", targetId)...)
+	citrusServer.recordActivity(DashboardActivityError, client.secureId, targetId, "Only DG-LAB apps are allowed to send this event")
+	if client.typ.isThirdPartyWS() {
+		event := &EventError{
+			ClientId: client.secureId,
+			TargetId: targetId,
+			Message:  strconv.Itoa(ErrorCodePermissionDenied),
+		}
+		err := citrusServer.sendEvent(ctx, client.secureId, event)
+		if err != nil {
+			processorLog.ErrorContext(ctx, "Failed to send permission denied error to third party", "thirdParty", client, "error", err)
+		}
+	}
+	return fmt.Errorf("third party client %s is not allowed to send DG-LAB app events", client)
+}
+
+// denyObserver rejects a command sent by an observer client, which is only allowed to watch.
+func denyObserver(ctx context.Context, clientId ClientSecureId, targetId ClientSecureId) error {
+	client, err := citrusServer.getClientSecure(clientId)
+	if err != nil || client.typ != ClientTypeObserver {
+		return nil
+	}
+	processorLog.WarnContext(ctx, "Observer is not allowed to send commands", "observer", client)
+	citrusServer.recordActivity(DashboardActivityError, clientId, targetId, "Observers are not allowed to send commands")
+	event := &EventError{
+		ClientId: clientId,
+		TargetId: targetId,
+		Message:  strconv.Itoa(ErrorCodePermissionDenied),
+	}
+	err = citrusServer.sendEvent(ctx, clientId, event)
+	if err != nil {
+		processorLog.ErrorContext(ctx, "Failed to send permission denied error to observer", "observer", client, "error", err)
+	}
+	return fmt.Errorf("observer %s is not allowed to send commands", client)
+}
+
+// notifyObservers tells the connected observer clients bound to a DG-LAB app about a command forwarded to it.
+func notifyObservers(ctx context.Context, thirdPartyClientId ClientSecureId, appId ClientSecureId, command Event) {
+	bindings, err := citrusServer.getClientBindings(appId)
+	if err != nil {
+		return
+	}
+	var controller *ClientMetadata
+	if client, err := citrusServer.getClientSecure(thirdPartyClientId); err == nil {
+		controller = client.metadata
+	}
+	for _, binding := range bindings {
+		if binding.peer.typ != ClientTypeObserver || !binding.peerConnected {
+			continue
+		}
+		event := &EventControlActivity{
+			ClientId:   binding.peer.secureId,
+			TargetId:   appId,
+			Controller: controller,
+			Command:    command,
+		}
+		err = citrusServer.sendEvent(ctx, binding.peer.secureId, event)
+		if err != nil {
+			processorLog.ErrorContext(ctx, "Failed to forward control activity to observer", "appId", appId, "observer", binding.peer, "error", err)
+			countForwardFailure(event)
+		}
+	}
+}
+
+func failWithCode(ctx context.Context, clientId ClientSecureId, targetId ClientSecureId, code int) error {
 	event := &EventError{
 		ClientId: clientId,
 		TargetId: targetId,
 		Message:  strconv.Itoa(code),
 	}
-	return citrusServer.sendEvent(targetId, event)
+	return citrusServer.sendEvent(ctx, targetId, event)
 }
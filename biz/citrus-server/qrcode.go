@@ -2,12 +2,17 @@ package citrus_server
 
 import (
 	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
+	"os"
+	"regexp"
+	"strings"
 
 	"github.com/tundrawork/DG-citrus/config"
 	"github.com/yeqown/go-qrcode/v2"
 	"github.com/yeqown/go-qrcode/writer/standard"
-	"golang.org/x/image/colornames"
 )
 
 const (
@@ -15,6 +20,119 @@ const (
 	DGAppWebsocketTag = "DGLAB-SOCKET"
 )
 
+type QrcodeFormat string
+
+const (
+	QrcodeFormatJPEG QrcodeFormat = "jpeg"
+	QrcodeFormatPNG  QrcodeFormat = "png"
+	QrcodeFormatSVG  QrcodeFormat = "svg"
+	QrcodeFormatTXT  QrcodeFormat = "txt"
+	QrcodeFormatJSON QrcodeFormat = "json"
+)
+
+// maxQrcodePixels caps the width of a raster QR code image, as the size and margin multiply each other.
+const maxQrcodePixels = 2048
+
+// QrcodeOptions controls how a binding QR code is rendered, Size is the width of a single module in pixels, and Margin
+// is the width of the quiet zone around the code in modules.
+type QrcodeOptions struct {
+	Format          QrcodeFormat
+	Size            int
+	Margin          int
+	ErrorCorrection string
+}
+
+func DefaultQrcodeOptions() *QrcodeOptions {
+	return &QrcodeOptions{
+		Format:          QrcodeFormatJPEG,
+		Size:            20,
+		Margin:          1,
+		ErrorCorrection: "Q",
+	}
+}
+
+// Validate checks the options, they are usually supplied by the client.
+func (o *QrcodeOptions) Validate() error {
+	switch o.Format {
+	case QrcodeFormatJPEG, QrcodeFormatPNG, QrcodeFormatSVG, QrcodeFormatTXT, QrcodeFormatJSON:
+	default:
+		return fmt.Errorf("unsupported format %q, expected one of jpeg, png, svg, txt, json", o.Format)
+	}
+	if o.Size < 1 || o.Size > 255 {
+		return fmt.Errorf("size must be between 1 and 255, got %d", o.Size)
+	}
+	if o.Margin < 0 || o.Margin > 16 {
+		return fmt.Errorf("margin must be between 0 and 16, got %d", o.Margin)
+	}
+	// even the smallest QR code is 21 modules wide, the actual width is checked again once the payload is encoded
+	if o.isRaster() && (21+2*o.Margin)*o.Size > maxQrcodePixels {
+		return fmt.Errorf("size %d with margin %d would be wider than %d pixels", o.Size, o.Margin, maxQrcodePixels)
+	}
+	if _, err := parseErrorCorrectionLevel(o.ErrorCorrection); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (o *QrcodeOptions) isRaster() bool {
+	return o.Format == QrcodeFormatJPEG || o.Format == QrcodeFormatPNG
+}
+
+func parseErrorCorrectionLevel(level string) (qrcode.EncodeOption, error) {
+	switch strings.ToUpper(level) {
+	case "L":
+		return qrcode.WithErrorCorrectionLevel(qrcode.ErrorCorrectionLow), nil
+	case "M":
+		return qrcode.WithErrorCorrectionLevel(qrcode.ErrorCorrectionMedium), nil
+	case "Q":
+		return qrcode.WithErrorCorrectionLevel(qrcode.ErrorCorrectionQuart), nil
+	case "H":
+		return qrcode.WithErrorCorrectionLevel(qrcode.ErrorCorrectionHighest), nil
+	default:
+		return nil, fmt.Errorf("unsupported error correction level %q, expected one of L, M, Q, H", level)
+	}
+}
+
+// qrcodeLogo is drawn in the center of raster binding QR codes, it is loaded from config.Conf.QRCode.LogoFile by Init.
+var qrcodeLogo image.Image
+
+var hexColorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// initQrcode checks the configured QR code style and loads the logo.
+func initQrcode() error {
+	style := config.Conf.QRCode
+	for _, color := range []string{style.BackgroundColor, style.ForegroundColor} {
+		if !hexColorPattern.MatchString(color) {
+			return fmt.Errorf("initQrcode: invalid color %q, expected #rgb or #rrggbb", color)
+		}
+	}
+	if style.Shape != "circle" && style.Shape != "square" {
+		return fmt.Errorf("initQrcode: invalid shape %q, expected circle or square", style.Shape)
+	}
+	qrcodeLogo = nil
+	if style.LogoFile != "" {
+		logo, err := loadQrcodeLogo(style.LogoFile)
+		if err != nil {
+			return err
+		}
+		qrcodeLogo = logo
+	}
+	return nil
+}
+
+func loadQrcodeLogo(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadQrcodeLogo: failed to open logo file: %v", err)
+	}
+	defer file.Close()
+	logo, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("loadQrcodeLogo: failed to decode logo file: %v", err)
+	}
+	return logo, nil
+}
+
 type qrcodeWriteCloser struct {
 	io.Writer
 }
@@ -29,26 +147,139 @@ func newQrcodeWriteCloser(w io.Writer) io.WriteCloser {
 	return &qrcodeWriteCloser{Writer: w}
 }
 
-func sendDGAppBindingCode(bodyWriter io.Writer, secureId ClientSecureId) error {
-	var protocol string
-	if config.Conf.UseSecureWebsocket {
-		protocol = "wss"
-	} else {
-		protocol = "ws"
-	}
-	payload := fmt.Sprintf("%s#%s#%s://%s:%s/app/%s", DGAppWebsiteLink, DGAppWebsocketTag, protocol, config.Conf.HostName, config.Conf.Port, secureId)
-	qrc, err := qrcode.New(payload)
+// dgAppBindingPayload returns the content of the QR code a DG-LAB app scans to connect with the given binding code.
+func dgAppBindingPayload(bindingCode string) string {
+	return fmt.Sprintf("%s#%s#%s", DGAppWebsiteLink, DGAppWebsocketTag, publicURL("/app/"+bindingCode, true))
+}
+
+// writeQrcode renders the payload as a QR code image or text in the given format, which must not be json.
+func writeQrcode(w io.Writer, payload string, options *QrcodeOptions) error {
+	ecLevel, err := parseErrorCorrectionLevel(options.ErrorCorrection)
 	if err != nil {
 		return err
 	}
-	writer := standard.NewWithWriter(
-		newQrcodeWriteCloser(bodyWriter),
-		standard.WithBgColor(colornames.Lightpink),
-		standard.WithCircleShape(),
-	)
-	err = qrc.Save(writer)
+	qrc, err := qrcode.NewWith(payload, ecLevel)
 	if err != nil {
 		return err
 	}
+	if pixels := (qrc.Dimension() + 2*options.Margin) * options.Size; options.isRaster() && pixels > maxQrcodePixels {
+		return fmt.Errorf("writeQrcode: image would be %d pixels wide, at most %d are allowed", pixels, maxQrcodePixels)
+	}
+
+	style := config.Conf.QRCode
+	var writer qrcode.Writer
+	switch options.Format {
+	case QrcodeFormatJPEG, QrcodeFormatPNG:
+		imageOptions := []standard.ImageOption{
+			standard.WithBgColorRGBHex(style.BackgroundColor),
+			standard.WithFgColorRGBHex(style.ForegroundColor),
+			standard.WithQRWidth(uint8(options.Size)),
+			standard.WithBorderWidth(options.Margin * options.Size),
+		}
+		if style.Shape == "circle" {
+			imageOptions = append(imageOptions, standard.WithCircleShape())
+		}
+		if options.Format == QrcodeFormatPNG {
+			imageOptions = append(imageOptions, standard.WithBuiltinImageEncoder(standard.PNG_FORMAT))
+		}
+		if qrcodeLogo != nil {
+			imageOptions = append(imageOptions, standard.WithLogoImage(qrcodeLogo))
+		}
+		writer = standard.NewWithWriter(newQrcodeWriteCloser(w), imageOptions...)
+	case QrcodeFormatSVG:
+		writer = &svgQrcodeWriter{w: w, options: options, shape: style.Shape, bgColor: style.BackgroundColor, fgColor: style.ForegroundColor}
+	case QrcodeFormatTXT:
+		writer = &txtQrcodeWriter{w: w, margin: options.Margin}
+	default:
+		return fmt.Errorf("writeQrcode: can not render QR code as %s", options.Format)
+	}
+	return qrc.Save(writer)
+}
+
+// svgQrcodeWriter is a qrcode.Writer rendering the QR code as a scalable SVG image.
+type svgQrcodeWriter struct {
+	w       io.Writer
+	options *QrcodeOptions
+	shape   string
+	bgColor string
+	fgColor string
+}
+
+func (s *svgQrcodeWriter) Write(mat qrcode.Matrix) error {
+	dimension := mat.Width() + 2*s.options.Margin
+	pixels := dimension * s.options.Size
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, pixels, pixels, dimension, dimension)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="%s"/>`, s.bgColor)
+	if s.shape == "circle" {
+		fmt.Fprintf(&b, `<g fill="%s">`, s.fgColor)
+		mat.Iterate(qrcode.IterDirection_ROW, func(x, y int, v qrcode.QRValue) {
+			if v.IsSet() {
+				fmt.Fprintf(&b, `<circle cx="%d.5" cy="%d.5" r="0.5"/>`, x+s.options.Margin, y+s.options.Margin)
+			}
+		})
+		b.WriteString(`</g>`)
+	} else {
+		fmt.Fprintf(&b, `<path fill="%s" d="`, s.fgColor)
+		mat.Iterate(qrcode.IterDirection_ROW, func(x, y int, v qrcode.QRValue) {
+			if v.IsSet() {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+s.options.Margin, y+s.options.Margin)
+			}
+		})
+		b.WriteString(`"/>`)
+	}
+	b.WriteString("</svg>\n")
+	_, err := io.WriteString(s.w, b.String())
+	return err
+}
+
+func (s *svgQrcodeWriter) Close() error {
+	return nil
+}
+
+// txtQrcodeWriter is a qrcode.Writer rendering the QR code as text for terminals, using half block characters so that
+// every line of text holds two rows of modules. Dark modules are drawn as blocks, which is meant to be displayed as
+// dark text on a light background.
+type txtQrcodeWriter struct {
+	w      io.Writer
+	margin int
+}
+
+func (t *txtQrcodeWriter) Write(mat qrcode.Matrix) error {
+	width, height := mat.Width(), mat.Height()
+	dark := make([][]bool, height)
+	for y := range dark {
+		dark[y] = make([]bool, width)
+	}
+	mat.Iterate(qrcode.IterDirection_ROW, func(x, y int, v qrcode.QRValue) {
+		dark[y][x] = v.IsSet()
+	})
+	isDark := func(x, y int) bool {
+		x, y = x-t.margin, y-t.margin
+		return x >= 0 && y >= 0 && x < width && y < height && dark[y][x]
+	}
+
+	var b strings.Builder
+	for y := 0; y < height+2*t.margin; y += 2 {
+		for x := 0; x < width+2*t.margin; x++ {
+			top, bottom := isDark(x, y), isDark(x, y+1)
+			switch {
+			case top && bottom:
+				b.WriteString("█")
+			case top:
+				b.WriteString("▀")
+			case bottom:
+				b.WriteString("▄")
+			default:
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString("\n")
+	}
+	_, err := io.WriteString(t.w, b.String())
+	return err
+}
+
+func (t *txtQrcodeWriter) Close() error {
 	return nil
 }
@@ -0,0 +1,156 @@
+package citrus_server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/common/json"
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+const (
+	RecordingDirectionIn  = "in"
+	RecordingDirectionOut = "out"
+)
+
+// RecordedEvent is a line of a recording, an event received from or sent to a client.
+type RecordedEvent struct {
+	Time time.Time `json:"time"`
+	// Direction is in for events received from the client, and out for events sent to it
+	Direction  string         `json:"direction"`
+	ClientType string         `json:"clientType"`
+	ClientId   ClientSecureId `json:"clientId"`
+	Event      RawEvent       `json:"event"`
+}
+
+// IsCommandToApp checks whether the event is a command sent to a DG-LAB app, either received from a third party
+// client, or sent to the recorded DG-LAB app. These are the events played back by cmd/replay.
+func (e *RecordedEvent) IsCommandToApp() bool {
+	switch {
+	case e.Direction == RecordingDirectionIn && e.ClientType != clientTypeLabels[ClientTypeDGApp]:
+	case e.Direction == RecordingDirectionOut && e.ClientType == clientTypeLabels[ClientTypeDGApp]:
+	default:
+		return false
+	}
+	event, err := e.Event.ToEvent()
+	if err != nil {
+		return false
+	}
+	switch event.(type) {
+	case *EventAdjustStrength, *EventExecutePulse, *EventStopPulse:
+		return true
+	}
+	return false
+}
+
+// ReadRecording parses a recording, a line cut short by a crash ends it.
+func ReadRecording(r io.Reader) ([]RecordedEvent, error) {
+	var events []RecordedEvent
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event RecordedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			break
+		}
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ReadRecording: %v", err)
+	}
+	return events, nil
+}
+
+// Recordings writes the events of each client to its own JSON lines file in config.Conf.RecordingDir, named after its
+// secure ID. A client keeps appending to its file when it resumes on a new connection, or after a restart.
+type Recordings struct {
+	// dir is config.Conf.RecordingDir as of initRecordings, events are recorded outside the clients mutex
+	dir   string
+	files map[ClientSecureId]*os.File
+	mutex sync.Mutex
+}
+
+func newRecordings() Recordings {
+	return Recordings{files: make(map[ClientSecureId]*os.File)}
+}
+
+// initRecordings creates the directory recordings are written to, if recording is enabled.
+func (server *CitrusServer) initRecordings() error {
+	server.recordings.dir = config.Conf.RecordingDir
+	if server.recordings.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(server.recordings.dir, 0700); err != nil {
+		return fmt.Errorf("initRecordings: %v", err)
+	}
+	return nil
+}
+
+// record appends an event received from or sent to the client to its recording, if recording is enabled. It takes the
+// type and ID of the client rather than the client, so that it can be called without holding the clients mutex. The
+// resume token and the consent page are left out, but the recordings still hold the secure IDs of the clients, which
+// are their credentials, so they have to be kept as private as the state file.
+func (server *CitrusServer) record(ctx context.Context, typ CitrusClientType, secureId ClientSecureId, direction string, rawEvent *RawEvent) {
+	if server.recordings.dir == "" {
+		return
+	}
+	event := *rawEvent
+	event.ResumeToken = ""
+	event.ConsentURL = ""
+	data, err := json.Marshal(&RecordedEvent{
+		Time:       time.Now(),
+		Direction:  direction,
+		ClientType: clientTypeLabels[typ],
+		ClientId:   secureId,
+		Event:      event,
+	})
+	if err != nil {
+		return
+	}
+	data = append(data, '\n')
+
+	server.recordings.mutex.Lock()
+	defer server.recordings.mutex.Unlock()
+
+	file, ok := server.recordings.files[secureId]
+	if !ok {
+		path := filepath.Join(server.recordings.dir, string(secureId)+".jsonl")
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			serverLog.ErrorContext(ctx, "Failed to open recording", "clientId", secureId, "error", err)
+			return
+		}
+		server.recordings.files[secureId] = file
+	}
+	if _, err := file.Write(data); err != nil {
+		serverLog.ErrorContext(ctx, "Failed to write recording", "clientId", secureId, "error", err)
+	}
+}
+
+// stopRecording closes the recording of a purged client.
+func (server *CitrusServer) stopRecording(secureId ClientSecureId) {
+	server.recordings.mutex.Lock()
+	defer server.recordings.mutex.Unlock()
+
+	if file, ok := server.recordings.files[secureId]; ok {
+		_ = file.Close()
+		delete(server.recordings.files, secureId)
+	}
+}
+
+// closeRecordings closes the recordings of all clients.
+func (server *CitrusServer) closeRecordings() {
+	server.recordings.mutex.Lock()
+	defer server.recordings.mutex.Unlock()
+
+	for secureId, file := range server.recordings.files {
+		_ = file.Close()
+		delete(server.recordings.files, secureId)
+	}
+}
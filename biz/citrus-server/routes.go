@@ -0,0 +1,44 @@
+package citrus_server
+
+import (
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/tundrawork/DG-citrus/biz/handler"
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+// RegisterRoutes registers all routes of the citrus server under config.Conf.PathPrefix, it is shared by the server
+// and the integration tests so that they can not drift apart.
+func RegisterRoutes(h *server.Hertz) {
+	root := h.Group(config.Conf.PathPrefix)
+	root.GET("/", handler.HomeHandler)
+	root.GET("/ping", handler.Ping)
+	root.GET("/controller", handler.ControllerHandler)
+	root.GET("/metrics", MetricsHandler)
+
+	root.GET("/app/:uuid", DGAppHandler)
+	root.GET("/consent", BindingConsentListPage)
+	root.GET("/consent/:secret", BindingConsentPage)
+	root.POST("/consent/:secret", BindingConsentPage)
+
+	v1 := root.Group("/v1")
+	v1.GET("/ws", ThirdPartyWSHandler)
+	v1.GET("/observe", ObserverWSHandler)
+	v1.GET("/register", HTTPRegister)
+	v1.GET("/bind", HTTPBindingQrcode)
+	v1.GET("/bindings", HTTPBindings)
+	v1.GET("/command", HTTPCommand)
+	v1.GET("/heartbeat", HTTPHeartbeat)
+	v1.GET("/whoami", HTTPWhoami)
+	v1.GET("/audit", HTTPAudit)
+
+	admin := root.Group("/admin", AdminAuth)
+	admin.GET("/clients", AdminClients)
+	admin.DELETE("/clients/:id", AdminPurgeClient)
+	admin.DELETE("/clients/:id/bindings/:peerId", AdminBreakBinding)
+	admin.POST("/clients/:id/stop", AdminStopDevice)
+	admin.GET("/settings", AdminSettings)
+	admin.POST("/settings", AdminSettings)
+	admin.GET("/dashboard", AdminDashboard)
+	admin.GET("/feed", AdminFeed)
+	admin.GET("/audit", AdminAudit)
+}
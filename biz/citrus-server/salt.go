@@ -0,0 +1,155 @@
+package citrus_server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+// InsecureIdSalt is the key insecure client IDs are derived from the IP addresses of clients with, so that they can not
+// be guessed from an IP address. Rotating it invalidates all insecure client IDs.
+type InsecureIdSalt struct {
+	salt      string
+	rotatedAt time.Time
+	// configured is whether the salt is set in the config, in which case it is neither persisted nor rotated
+	configured bool
+	timer      *time.Timer
+	mutex      sync.RWMutex
+}
+
+// SaltSnapshot is the persisted insecure ID salt.
+type SaltSnapshot struct {
+	Salt      string    `json:"salt"`
+	RotatedAt time.Time `json:"rotatedAt"`
+}
+
+func newInsecureIdSalt() InsecureIdSalt {
+	return InsecureIdSalt{
+		salt:      generateRandomHex(8),
+		rotatedAt: time.Now(),
+	}
+}
+
+// initInsecureIdSalt applies the configured salt, it must be called before the state is restored.
+func (server *CitrusServer) initInsecureIdSalt() error {
+	if config.Conf.InsecureIdSalt == "" {
+		return nil
+	}
+	if config.Conf.InsecureIdSaltRotation != 0 {
+		return fmt.Errorf("initInsecureIdSalt: InsecureIdSalt can not be rotated, remove it to use InsecureIdSaltRotation")
+	}
+	server.insecureIdSalt.mutex.Lock()
+	defer server.insecureIdSalt.mutex.Unlock()
+
+	server.insecureIdSalt.salt = config.Conf.InsecureIdSalt
+	server.insecureIdSalt.configured = true
+	return nil
+}
+
+func (server *CitrusServer) getInsecureIdSalt() string {
+	server.insecureIdSalt.mutex.RLock()
+	defer server.insecureIdSalt.mutex.RUnlock()
+
+	return server.insecureIdSalt.salt
+}
+
+// restoreInsecureIdSalt applies a persisted salt, unless the salt is configured.
+func (server *CitrusServer) restoreInsecureIdSalt(snapshot *SaltSnapshot) {
+	server.insecureIdSalt.mutex.Lock()
+	defer server.insecureIdSalt.mutex.Unlock()
+
+	if snapshot == nil || snapshot.Salt == "" || server.insecureIdSalt.configured {
+		return
+	}
+	server.insecureIdSalt.salt = snapshot.Salt
+	server.insecureIdSalt.rotatedAt = snapshot.RotatedAt
+}
+
+// snapshotInsecureIdSalt returns the salt to persist, or nil if it is configured.
+func (server *CitrusServer) snapshotInsecureIdSalt() *SaltSnapshot {
+	server.insecureIdSalt.mutex.RLock()
+	defer server.insecureIdSalt.mutex.RUnlock()
+
+	if server.insecureIdSalt.configured {
+		return nil
+	}
+	return &SaltSnapshot{
+		Salt:      server.insecureIdSalt.salt,
+		RotatedAt: server.insecureIdSalt.rotatedAt,
+	}
+}
+
+// rotateInsecureIdSalt replaces the salt with a new random one. Clients can no longer be reached by their insecure
+// client IDs afterward, and need to register again to get new ones, while their secure IDs stay valid.
+func (server *CitrusServer) rotateInsecureIdSalt() error {
+	server.insecureIdSalt.mutex.RLock()
+	configured := server.insecureIdSalt.configured
+	server.insecureIdSalt.mutex.RUnlock()
+	if configured {
+		return fmt.Errorf("rotateInsecureIdSalt: the salt is set in the config, change InsecureIdSalt to rotate it")
+	}
+
+	defer server.persist()
+	// the salt is swapped under the lock insecure client IDs are looked up with, so that no lookup sees the new salt
+	// while the IDs derived from the old one are still registered
+	server.clients.mutex.Lock()
+	defer server.clients.mutex.Unlock()
+
+	server.insecureIdSalt.mutex.Lock()
+	server.insecureIdSalt.salt = generateRandomHex(8)
+	server.insecureIdSalt.rotatedAt = time.Now()
+	server.insecureIdSalt.mutex.Unlock()
+
+	for _, client := range server.clients.secureMapping {
+		client.insecureId = ""
+	}
+	count := len(server.clients.insecureMapping)
+	server.clients.insecureMapping = make(map[ClientInsecureId]*CitrusClient)
+	serverLog.Info("Rotated the insecure ID salt", "invalidatedInsecureIds", count)
+	return nil
+}
+
+// scheduleInsecureIdSaltRotation rotates the salt every config.Conf.InsecureIdSaltRotation, counting from the last
+// rotation, which may have happened before a restart.
+func (server *CitrusServer) scheduleInsecureIdSaltRotation() {
+	rotation := config.Conf.InsecureIdSaltRotation
+	server.insecureIdSalt.mutex.Lock()
+	defer server.insecureIdSalt.mutex.Unlock()
+
+	if rotation <= 0 || server.insecureIdSalt.configured {
+		return
+	}
+	delay := time.Until(server.insecureIdSalt.rotatedAt.Add(rotation))
+	if delay < 0 {
+		delay = 0
+	}
+	server.insecureIdSalt.timer = time.AfterFunc(delay, func() {
+		if err := server.rotateInsecureIdSalt(); err != nil {
+			serverLog.Error("Failed to rotate the insecure ID salt", "error", err)
+			return
+		}
+		server.scheduleInsecureIdSaltRotation()
+	})
+}
+
+// stopInsecureIdSaltRotation stops the scheduled rotation of the salt.
+func (server *CitrusServer) stopInsecureIdSaltRotation() {
+	server.insecureIdSalt.mutex.Lock()
+	defer server.insecureIdSalt.mutex.Unlock()
+
+	if server.insecureIdSalt.timer != nil {
+		server.insecureIdSalt.timer.Stop()
+		server.insecureIdSalt.timer = nil
+	}
+}
+
+// RotateInsecureIdSalt rotates the persisted insecure ID salt, it is meant to be run while the server is stopped, as a
+// running server keeps its own salt and overwrites the state file.
+func RotateInsecureIdSalt() error {
+	if citrusServer.store == nil {
+		return fmt.Errorf("RotateInsecureIdSalt: there is no state file to rotate the salt in, set StateFile")
+	}
+	return citrusServer.rotateInsecureIdSalt()
+}
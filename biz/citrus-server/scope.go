@@ -0,0 +1,94 @@
+package citrus_server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BindingScope limits what a third party client can do to a DG-LAB app it is bound to, it is chosen by the third party
+// client when requesting the bind token, so that the owner of the app knows what they allow when scanning it.
+type BindingScope string
+
+const (
+	// BindingScopeFull allows everything, which is the default
+	BindingScopeFull BindingScope = "full"
+	// BindingScopePulseOnly allows sending and clearing pulses, but not adjusting the strength
+	BindingScopePulseOnly BindingScope = "pulse-only"
+	// BindingScopeReadOnly only allows receiving reports from the app
+	BindingScopeReadOnly BindingScope = "read-only"
+	// bindingScopeStrengthIncreaseMaxPrefix is followed by N, which allows everything, but the strength of a channel can
+	// not be raised above N
+	bindingScopeStrengthIncreaseMaxPrefix = "strength-increase-max-"
+)
+
+// ErrorCodePermissionDenied is sent to a third party client in an error message, when a binding scope denies a command.
+const ErrorCodePermissionDenied = 406
+
+// ParseBindingScope parses a binding scope, an empty string is the full scope.
+func ParseBindingScope(scope string) (BindingScope, error) {
+	switch BindingScope(scope) {
+	case "", BindingScopeFull:
+		return BindingScopeFull, nil
+	case BindingScopePulseOnly, BindingScopeReadOnly:
+		return BindingScope(scope), nil
+	}
+	if value, ok := strings.CutPrefix(scope, bindingScopeStrengthIncreaseMaxPrefix); ok {
+		maxIncrease, err := strconv.Atoi(value)
+		if err == nil && maxIncrease >= 0 && maxIncrease <= 200 && strconv.Itoa(maxIncrease) == value {
+			return BindingScope(scope), nil
+		}
+	}
+	return "", fmt.Errorf("unknown binding scope %q, expected one of full, pulse-only, read-only, strength-increase-max-<0-200>", scope)
+}
+
+// maxStrength returns N of a strength-increase-max-N scope.
+func (s BindingScope) maxStrength() (int, bool) {
+	value, ok := strings.CutPrefix(string(s), bindingScopeStrengthIncreaseMaxPrefix)
+	if !ok {
+		return 0, false
+	}
+	maxStrength, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, false
+	}
+	return maxStrength, true
+}
+
+// allowsAdjustStrength checks a strength adjustment against the scope, bound is at least the strength the app has, see
+// CitrusClient.strengthBound, or nil if it is unknown. An increase is only allowed if the strength it results in from
+// the bound is known to stay within the scope.
+func (s BindingScope) allowsAdjustStrength(strength DataAdjustStrength, bound *DataReportStrength) bool {
+	switch s {
+	case BindingScopeFull, "":
+		return true
+	case BindingScopePulseOnly, BindingScopeReadOnly:
+		return false
+	}
+	maxStrength, ok := s.maxStrength()
+	if !ok || strength.Value < 0 || (strength.Channel != ChannelA && strength.Channel != ChannelB) {
+		return false
+	}
+	switch strength.Type {
+	case AdjustStrengthTypeDecrease:
+		return true
+	case AdjustStrengthTypeSet:
+		return strength.Value <= maxStrength
+	case AdjustStrengthTypeIncrease:
+		if bound == nil {
+			return false
+		}
+		result := strength.apply(*bound)
+		if strength.Channel == ChannelA {
+			return result.ChannelAValue <= maxStrength
+		}
+		return result.ChannelBValue <= maxStrength
+	default:
+		return false
+	}
+}
+
+// allowsPulses checks whether the scope allows sending and clearing pulses.
+func (s BindingScope) allowsPulses() bool {
+	return s != BindingScopeReadOnly
+}
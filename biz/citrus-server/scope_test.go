@@ -0,0 +1,88 @@
+package citrus_server
+
+import (
+	"testing"
+)
+
+func TestParseBindingScope(t *testing.T) {
+	for scope, want := range map[string]BindingScope{
+		"":                         BindingScopeFull,
+		"full":                     BindingScopeFull,
+		"pulse-only":               BindingScopePulseOnly,
+		"read-only":                BindingScopeReadOnly,
+		"strength-increase-max-10": "strength-increase-max-10",
+	} {
+		parsed, err := ParseBindingScope(scope)
+		if err != nil || parsed != want {
+			t.Fatalf("ParseBindingScope(%q) = %q, %v, want %q", scope, parsed, err, want)
+		}
+	}
+	for _, scope := range []string{"admin", "strength-increase-max-", "strength-increase-max--1", "strength-increase-max-201", "strength-increase-max-010"} {
+		if _, err := ParseBindingScope(scope); err == nil {
+			t.Fatalf("ParseBindingScope(%q) should fail", scope)
+		}
+	}
+}
+
+func TestBindingScopeAllowsAdjustStrength(t *testing.T) {
+	bound := &DataReportStrength{ChannelAValue: 20, ChannelBValue: 5, ChannelALimit: 100, ChannelBLimit: 25}
+	for _, tc := range []struct {
+		scope    BindingScope
+		strength DataAdjustStrength
+		bound    *DataReportStrength
+		want     bool
+	}{
+		{BindingScopeFull, DataAdjustStrength{ChannelA, AdjustStrengthTypeSet, 200}, bound, true},
+		{BindingScopePulseOnly, DataAdjustStrength{ChannelA, AdjustStrengthTypeDecrease, 1}, bound, false},
+		{BindingScopeReadOnly, DataAdjustStrength{ChannelA, AdjustStrengthTypeDecrease, 1}, bound, false},
+		{"strength-increase-max-30", DataAdjustStrength{ChannelA, AdjustStrengthTypeDecrease, 50}, bound, true},
+		{"strength-increase-max-30", DataAdjustStrength{ChannelA, AdjustStrengthTypeIncrease, 10}, bound, true},
+		{"strength-increase-max-30", DataAdjustStrength{ChannelA, AdjustStrengthTypeIncrease, 11}, bound, false},
+		// the app keeps the strength within its limit
+		{"strength-increase-max-30", DataAdjustStrength{ChannelB, AdjustStrengthTypeIncrease, 100}, bound, true},
+		{"strength-increase-max-30", DataAdjustStrength{ChannelA, AdjustStrengthTypeSet, 30}, bound, true},
+		{"strength-increase-max-30", DataAdjustStrength{ChannelA, AdjustStrengthTypeSet, 31}, bound, false},
+		{"strength-increase-max-30", DataAdjustStrength{ChannelA, AdjustStrengthTypeSet, 30}, nil, true},
+		{"strength-increase-max-30", DataAdjustStrength{ChannelA, AdjustStrengthTypeIncrease, 1}, nil, false},
+		// a negative decrease or increase would get around the limit
+		{"strength-increase-max-30", DataAdjustStrength{ChannelA, AdjustStrengthTypeDecrease, -50}, bound, false},
+		{"strength-increase-max-30", DataAdjustStrength{ChannelA, AdjustStrengthTypeIncrease, -5}, bound, false},
+		{"strength-increase-max-30", DataAdjustStrength{ChannelA, AdjustStrengthTypeSet, -1}, bound, false},
+		{"strength-increase-max-30", DataAdjustStrength{Channel(3), AdjustStrengthTypeIncrease, 0}, bound, false},
+		{"strength-increase-max-30", DataAdjustStrength{ChannelA, AdjustStrengthType(7), 0}, bound, false},
+	} {
+		if got := tc.scope.allowsAdjustStrength(tc.strength, tc.bound); got != tc.want {
+			t.Fatalf("%s allowsAdjustStrength(%+v) = %t, want %t", tc.scope, tc.strength, got, tc.want)
+		}
+	}
+}
+
+func TestAdmitAdjustStrength(t *testing.T) {
+	server := NewCitrusServer()
+	server.clients.secureMapping["app"] = &CitrusClient{typ: ClientTypeDGApp, secureId: "app"}
+	scope := BindingScope("strength-increase-max-25")
+	increase := DataAdjustStrength{ChannelA, AdjustStrengthTypeIncrease, 10}
+	admit := func(adjust DataAdjustStrength, want bool) {
+		t.Helper()
+		if got := server.admitAdjustStrength("app", scope, adjust); got != want {
+			t.Fatalf("admitAdjustStrength(%+v) = %t, want %t", adjust, got, want)
+		}
+	}
+
+	// increases are only admitted once the strength is known
+	admit(increase, false)
+	server.setStrength("app", DataReportStrength{ChannelALimit: 200, ChannelBLimit: 200})
+	// repeated increases count against the limit before the app reports the resulting strength
+	admit(increase, true)
+	admit(increase, true)
+	admit(increase, false)
+	// a stale report does not lower the strength the limit is checked against
+	server.setStrength("app", DataReportStrength{ChannelAValue: 10, ChannelALimit: 200, ChannelBLimit: 200})
+	admit(increase, false)
+	admit(DataAdjustStrength{ChannelA, AdjustStrengthTypeDecrease, 10}, true)
+	admit(increase, true)
+	// a report of a higher strength, e.g. set on the app itself, raises it
+	server.setStrength("app", DataReportStrength{ChannelBValue: 20, ChannelALimit: 200, ChannelBLimit: 200})
+	admit(DataAdjustStrength{ChannelB, AdjustStrengthTypeIncrease, 6}, false)
+	admit(DataAdjustStrength{ChannelB, AdjustStrengthTypeSet, 25}, true)
+}
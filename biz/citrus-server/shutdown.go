@@ -0,0 +1,130 @@
+package citrus_server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/cloudwego/hertz/pkg/app"
+	"github.com/hertz-contrib/websocket"
+)
+
+// shutdownNotice is the break messages a connected client gets on shutdown, one for each of its bindings.
+type shutdownNotice struct {
+	clientId ClientSecureId
+	events   []*EventBreak
+}
+
+// Shutdown stops every connected DG-LAB app and disconnects all clients, it is meant to run as a hertz shutdown hook,
+// whose context expires after config.Conf.ShutdownTimeout.
+func Shutdown(ctx context.Context) {
+	citrusServer.shutdown(newCorrelationContext(ctx))
+}
+
+// shutdown stops accepting clients and commands, clears the pulses of every connected DG-LAB app and sets their
+// strength to 0, tells every client its bindings are broken, flushes the state, audit log and recordings, and then
+// closes all connections. A step which does not finish before ctx is done is abandoned for the next one, so that the
+// connections are closed in time. Bindings are kept in the state file, so that clients can resume them after a restart.
+func (server *CitrusServer) shutdown(ctx context.Context) {
+	if !server.shuttingDown.CompareAndSwap(false, true) {
+		return
+	}
+	serverLog.InfoContext(ctx, "Shutting down")
+
+	apps, notices, conns := server.shutdownTargets()
+	if !forEachWithin(ctx, apps, func(appId ClientSecureId) {
+		if err := server.stopDevice(ctx, appId); err != nil {
+			serverLog.ErrorContext(ctx, "Failed to stop DG App client on shutdown", "clientId", appId, "error", err)
+		}
+	}) {
+		serverLog.WarnContext(ctx, "Shutdown deadline exceeded while stopping DG App clients")
+	}
+	if !forEachWithin(ctx, notices, func(notice shutdownNotice) {
+		for _, event := range notice.events {
+			if err := server.sendEvent(ctx, notice.clientId, event); err != nil {
+				serverLog.ErrorContext(ctx, "Failed to notify client of the shutdown", "clientId", notice.clientId, "error", err)
+				return
+			}
+		}
+	}) {
+		serverLog.WarnContext(ctx, "Shutdown deadline exceeded while notifying clients")
+	}
+
+	server.persist()
+	if server.audit != nil {
+		if err := server.audit.Close(); err != nil {
+			auditLog.ErrorContext(ctx, "Failed to close the audit log", "error", err)
+		}
+	}
+	server.closeRecordings()
+
+	forEachWithin(ctx, conns, func(conn *websocket.Conn) {
+		closeConn(conn, "server is shutting down")
+	})
+	serverLog.InfoContext(ctx, "Shut down", "stoppedApps", len(apps), "closedConnections", len(conns))
+}
+
+// shutdownTargets lists the connected DG-LAB apps, the break messages of the connected clients, and their connections.
+func (server *CitrusServer) shutdownTargets() ([]ClientSecureId, []shutdownNotice, []*websocket.Conn) {
+	server.clients.mutex.RLock()
+	defer server.clients.mutex.RUnlock()
+
+	var apps []ClientSecureId
+	var notices []shutdownNotice
+	var conns []*websocket.Conn
+	for secureId, client := range server.clients.secureMapping {
+		if client.conn == nil {
+			continue
+		}
+		conns = append(conns, client.conn)
+		if client.typ == ClientTypeDGApp {
+			apps = append(apps, secureId)
+		}
+		notice := shutdownNotice{clientId: secureId}
+		for peerId := range client.bindings {
+			appId, thirdPartyId := secureId, peerId
+			if client.typ != ClientTypeDGApp {
+				appId, thirdPartyId = peerId, secureId
+			}
+			notice.events = append(notice.events, &EventBreak{ClientId: thirdPartyId, TargetId: appId})
+		}
+		if len(notice.events) > 0 {
+			notices = append(notices, notice)
+		}
+	}
+	return apps, notices, conns
+}
+
+// forEachWithin calls fn for every item concurrently, so that a slow client does not hold up the others. It returns
+// whether all calls have finished before ctx is done.
+func forEachWithin[T any](ctx context.Context, items []T, fn func(T)) bool {
+	var wg sync.WaitGroup
+	for _, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(item)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// rejectWhileShuttingDown fails a request which would connect a client or send a command once the server is shutting
+// down, and returns whether it has.
+func rejectWhileShuttingDown(ctx context.Context, c *app.RequestContext, context string) bool {
+	if !citrusServer.shuttingDown.Load() {
+		return false
+	}
+	failWithStatus(ctx, c, http.StatusServiceUnavailable, context, "The server is shutting down, please try again later")
+	return true
+}
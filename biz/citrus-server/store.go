@@ -0,0 +1,98 @@
+package citrus_server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cloudwego/hertz/pkg/common/json"
+)
+
+// Store persists the clients and bindings of a CitrusServer, so that they survive a server restart.
+type Store interface {
+	// Load returns the last saved snapshot, or an empty snapshot if nothing has been saved yet.
+	Load() (*Snapshot, error)
+	// Save replaces the saved state with the given snapshot.
+	Save(snapshot *Snapshot) error
+}
+
+type Snapshot struct {
+	Clients []ClientSnapshot `json:"clients"`
+	// InsecureIdSalt keeps insecure client IDs valid across restarts, it is nil if the salt is set in the config
+	InsecureIdSalt *SaltSnapshot `json:"insecureIdSalt,omitempty"`
+}
+
+type ClientSnapshot struct {
+	Type        CitrusClientType `json:"type"`
+	SecureId    ClientSecureId   `json:"secureId"`
+	InsecureId  ClientInsecureId `json:"insecureId,omitempty"`
+	ResumeToken string           `json:"resumeToken,omitempty"`
+	AuditKey    string           `json:"auditKey,omitempty"`
+	Bindings    []ClientSecureId `json:"bindings"`
+	// BindingScopes holds the scopes of the bindings which do not have the full scope
+	BindingScopes map[ClientSecureId]BindingScope `json:"bindingScopes,omitempty"`
+
+	BindingCode      string         `json:"bindingCode,omitempty"`
+	BindingCodeOwner ClientSecureId `json:"bindingCodeOwner,omitempty"`
+	BindingCodeScope BindingScope   `json:"bindingCodeScope,omitempty"`
+
+	Metadata   *ClientMetadata `json:"metadata,omitempty"`
+	APIKeyName string          `json:"apiKeyName,omitempty"`
+}
+
+// fileStore is a Store which keeps the snapshot as a JSON file.
+type fileStore struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewFileStore(path string) Store {
+	return &fileStore{path: path}
+}
+
+func (s *fileStore) Load() (*Snapshot, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	snapshot := &Snapshot{}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse state file: %v", err)
+	}
+	return snapshot, nil
+}
+
+func (s *fileStore) Save(snapshot *Snapshot) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize state: %v", err)
+	}
+	// write to a temporary file first, so that a crash during the write never leaves a truncated state file behind
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write temporary state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write temporary state file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace state file: %v", err)
+	}
+	return nil
+}
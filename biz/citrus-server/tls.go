@@ -0,0 +1,214 @@
+package citrus_server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for changes.
+var tlsReloadInterval = 10 * time.Second
+
+// selfSignedCertificateValidity is how long a generated self-signed certificate is valid for.
+const selfSignedCertificateValidity = 365 * 24 * time.Hour
+
+// NewTLSConfig returns the TLS config for serving HTTPS and WSS directly, or nil if TLS is not enabled. Certificates
+// loaded from files are reloaded when the files change, so that renewed certificates are used without a restart.
+func NewTLSConfig() (*tls.Config, error) {
+	conf := config.Conf
+	if !conf.TLSEnabled() {
+		return nil, nil
+	}
+	if (conf.TLSCertFile == "") != (conf.TLSKeyFile == "") {
+		return nil, fmt.Errorf("NewTLSConfig: TLSCertFile and TLSKeyFile must be set together")
+	}
+	if conf.TLSSelfSigned {
+		hosts := []string{conf.HostName, "localhost", "127.0.0.1", "::1"}
+		if base, err := url.Parse(conf.PublicBaseURL); err == nil && base.Hostname() != "" && base.Hostname() != conf.HostName {
+			hosts = append([]string{base.Hostname()}, hosts...)
+		}
+		if conf.TLSCertFile == "" {
+			// without files to keep it in, a new certificate is generated on every start
+			certPEM, keyPEM, err := generateSelfSignedCertificate(hosts)
+			if err != nil {
+				return nil, err
+			}
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("NewTLSConfig: %v", err)
+			}
+			serverLog.Warn("Serving a self-signed certificate, clients need to trust it manually", "hosts", hosts)
+			return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+		}
+		if err := ensureSelfSignedCertificate(conf.TLSCertFile, conf.TLSKeyFile, hosts); err != nil {
+			return nil, err
+		}
+	}
+	reloader := newCertReloader(conf.TLSCertFile, conf.TLSKeyFile)
+	if err := reloader.reload(); err != nil {
+		return nil, fmt.Errorf("NewTLSConfig: %v", err)
+	}
+	return &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}, nil
+}
+
+// ensureSelfSignedCertificate generates a self-signed certificate into the given files, unless they exist already. If
+// only one of them exists, it fails instead of overwriting it, as it may belong to a certificate issued elsewhere.
+func ensureSelfSignedCertificate(certFile string, keyFile string, hosts []string) error {
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if certErr == nil && keyErr == nil {
+		return nil
+	}
+	if !errors.Is(certErr, os.ErrNotExist) && certErr != nil {
+		return fmt.Errorf("ensureSelfSignedCertificate: %v", certErr)
+	}
+	if !errors.Is(keyErr, os.ErrNotExist) && keyErr != nil {
+		return fmt.Errorf("ensureSelfSignedCertificate: %v", keyErr)
+	}
+	if certErr == nil {
+		return fmt.Errorf("ensureSelfSignedCertificate: certificate file %s exists but key file %s does not, remove it to generate a new pair", certFile, keyFile)
+	}
+	if keyErr == nil {
+		return fmt.Errorf("ensureSelfSignedCertificate: key file %s exists but certificate file %s does not, remove it to generate a new pair", keyFile, certFile)
+	}
+	certPEM, keyPEM, err := generateSelfSignedCertificate(hosts)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("ensureSelfSignedCertificate: failed to write key file: %v", err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("ensureSelfSignedCertificate: failed to write certificate file: %v", err)
+	}
+	serverLog.Warn("Generated a self-signed certificate, clients need to trust it manually", "hosts", hosts, "certFile", certFile)
+	return nil
+}
+
+// generateSelfSignedCertificate returns a PEM encoded self-signed certificate for the given host names and IP
+// addresses, along with its private key.
+func generateSelfSignedCertificate(hosts []string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generateSelfSignedCertificate: failed to generate key: %v", err)
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("generateSelfSignedCertificate: failed to generate serial number: %v", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{Organization: []string{"DG-citrus"}, CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedCertificateValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generateSelfSignedCertificate: failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generateSelfSignedCertificate: failed to marshal key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// certReloader serves a certificate loaded from files, and reloads it once the files have changed.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	// modTime is the latest modification time of the files the certificate was loaded from
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) *certReloader {
+	return &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: tlsReloadInterval,
+	}
+}
+
+// reload loads the certificate if the files have changed since it was last loaded.
+func (r *certReloader) reload() error {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && modTime.Equal(r.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("reload: failed to load certificate: %v", err)
+	}
+	if r.cert != nil {
+		serverLog.Info("Reloaded TLS certificate", "certFile", r.certFile)
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return nil
+}
+
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("filesModTime: %v", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. A certificate which fails to reload, e.g. while only one of the
+// files has been replaced yet, is retried after the reload interval, and the previous certificate is served until then.
+func (r *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if time.Since(r.checkedAt) >= r.interval {
+		r.checkedAt = time.Now()
+		if err := r.reload(); err != nil {
+			serverLog.Warn("Keeping the previous TLS certificate", "error", err)
+		}
+	}
+	return r.cert, nil
+}
@@ -0,0 +1,134 @@
+package citrus_server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cloudwego/hertz/pkg/app/server"
+	"github.com/gorilla/websocket"
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+
+	conf := config.Config{HostName: "citrus.lan", TLSCertFile: certFile, TLSKeyFile: keyFile, TLSSelfSigned: true}
+	conf.SetDefaults()
+	if !conf.UseSecureWebsocket {
+		t.Fatalf("serving TLS should enable secure websocket URLs")
+	}
+	config.Conf = conf
+	citrusServer = NewCitrusServer()
+	interval := tlsReloadInterval
+	tlsReloadInterval = 0
+	t.Cleanup(func() {
+		tlsReloadInterval = interval
+	})
+	tlsConfig, err := NewTLSConfig()
+	if err != nil {
+		t.Fatalf("NewTLSConfig failed: %v", err)
+	}
+	if _, err := os.Stat(certFile); err != nil {
+		t.Fatalf("self-signed certificate was not written: %v", err)
+	}
+
+	h := server.New(server.WithHostPorts(addr), server.WithTLS(tlsConfig))
+	h.NoHijackConnPool = true
+	h.GET("/v1/ws", ThirdPartyWSHandler)
+	go func() {
+		_ = h.Run()
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_ = h.Shutdown(ctx)
+	})
+
+	dial := func() *x509.Certificate {
+		t.Helper()
+		dialer := websocket.Dialer{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		u := url.URL{Scheme: "wss", Host: addr, Path: "/v1/ws"}
+		var conn *websocket.Conn
+		deadline := time.Now().Add(testTimeout)
+		for {
+			conn, _, err = dialer.Dial(u.String(), nil)
+			if err == nil || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("dial over TLS failed: %v", err)
+		}
+		defer conn.Close()
+		event := &RawEvent{}
+		if err := conn.ReadJSON(event); err != nil || event.Type != EventTypeBind {
+			t.Fatalf("expected bind message on connect, got %+v: %v", event, err)
+		}
+		state := conn.UnderlyingConn().(*tls.Conn).ConnectionState()
+		return state.PeerCertificates[0]
+	}
+	if cert := dial(); len(cert.DNSNames) == 0 || cert.DNSNames[0] != "citrus.lan" {
+		t.Fatalf("unexpected certificate names: %v", cert.DNSNames)
+	}
+
+	// a renewed certificate is picked up without a restart
+	certPEM, keyPEM, err := generateSelfSignedCertificate([]string{"renewed.lan"})
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+	_ = os.Chtimes(keyFile, future, future)
+	if cert := dial(); len(cert.DNSNames) == 0 || cert.DNSNames[0] != "renewed.lan" {
+		t.Fatalf("certificate was not reloaded, names: %v", cert.DNSNames)
+	}
+}
+
+func TestSelfSignedCertificateNeedsBothFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(keyFile, []byte("existing key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureSelfSignedCertificate(certFile, keyFile, []string{"citrus.lan"}); err == nil {
+		t.Fatalf("expected an error with only the key file present")
+	}
+	if key, _ := os.ReadFile(keyFile); string(key) != "existing key" {
+		t.Fatalf("the existing key file was overwritten")
+	}
+	if _, err := os.Stat(certFile); !os.IsNotExist(err) {
+		t.Fatalf("no certificate should be written next to an existing key: %v", err)
+	}
+
+	_ = os.Remove(keyFile)
+	if err := os.WriteFile(certFile, []byte("existing certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ensureSelfSignedCertificate(certFile, keyFile, []string{"citrus.lan"}); err == nil {
+		t.Fatalf("expected an error with only the certificate file present")
+	}
+	if cert, _ := os.ReadFile(certFile); string(cert) != "existing certificate" {
+		t.Fatalf("the existing certificate file was overwritten")
+	}
+}
@@ -1,6 +1,7 @@
 package citrus_server
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"strconv"
@@ -14,6 +15,14 @@ type RawEvent struct {
 	ClientId string    `json:"clientId"`
 	TargetId string    `json:"targetId"`
 	Message  string    `json:"message"`
+	// ResumeToken is an extension to the official protocol, sent to third party websocket clients on connect
+	ResumeToken string `json:"resumeToken,omitempty"`
+	// Controller is an extension to the official protocol, it describes the third party client in bind results, and the
+	// third party client which has sent a command in control activity sent to observers
+	Controller *ClientMetadata `json:"controller,omitempty"`
+	// ConsentURL is an extension to the official protocol, it is the consent page sent to a DG-LAB app in the bind result
+	// of a binding which waits for the approval of its owner
+	ConsentURL string `json:"consentUrl,omitempty"`
 }
 
 func (e *RawEvent) FromByteArray(data []byte) error {
@@ -80,7 +89,7 @@ func (e *RawEvent) ToEvent() (Event, error) {
 type Event interface {
 	FromRawEvent(e *RawEvent) error
 	ToRawEvent() (*RawEvent, error)
-	Process() error
+	Process(ctx context.Context) error
 }
 
 type EventType string
@@ -101,6 +110,30 @@ const (
 	ChannelB
 )
 
+// Name returns the letter used for the channel in pulse messages.
+func (c Channel) Name() string {
+	switch c {
+	case ChannelA:
+		return "A"
+	case ChannelB:
+		return "B"
+	default:
+		return "?"
+	}
+}
+
+// ParseChannelName parses the letter used for a channel in pulse messages.
+func ParseChannelName(name string) (Channel, error) {
+	switch name {
+	case "A":
+		return ChannelA, nil
+	case "B":
+		return ChannelB, nil
+	default:
+		return ChannelUnknown, fmt.Errorf("unknown channel name: %s", name)
+	}
+}
+
 type EventHeartbeat struct {
 	ClientId ClientSecureId `json:"clientId"`
 	TargetId ClientSecureId `json:"targetId"`
@@ -122,7 +155,8 @@ func (e *EventHeartbeat) ToRawEvent() (*RawEvent, error) {
 }
 
 type EventBindToServer struct {
-	ClientId ClientSecureId `json:"clientId"`
+	ClientId    ClientSecureId `json:"clientId"`
+	ResumeToken string         `json:"resumeToken"`
 }
 
 func (e *EventBindToServer) FromRawEvent(_ *RawEvent) error {
@@ -131,9 +165,10 @@ func (e *EventBindToServer) FromRawEvent(_ *RawEvent) error {
 
 func (e *EventBindToServer) ToRawEvent() (*RawEvent, error) {
 	return &RawEvent{
-		Type:     EventTypeBind,
-		ClientId: string(e.ClientId),
-		Message:  "targetId",
+		Type:        EventTypeBind,
+		ClientId:    string(e.ClientId),
+		Message:     "targetId",
+		ResumeToken: e.ResumeToken,
 	}, nil
 }
 
@@ -156,9 +191,11 @@ func (e *EventBindAppToThirdParty) ToRawEvent() (*RawEvent, error) {
 }
 
 type EventBindResult struct {
-	ClientId ClientSecureId `json:"clientId"`
-	TargetId ClientSecureId `json:"targetId"`
-	Code     int            `json:"code"`
+	ClientId   ClientSecureId  `json:"clientId"`
+	TargetId   ClientSecureId  `json:"targetId"`
+	Code       int             `json:"code"`
+	Controller *ClientMetadata `json:"controller"`
+	ConsentURL string          `json:"consentUrl,omitempty"`
 }
 
 func (e *EventBindResult) FromRawEvent(_ *RawEvent) error {
@@ -167,13 +204,43 @@ func (e *EventBindResult) FromRawEvent(_ *RawEvent) error {
 
 func (e *EventBindResult) ToRawEvent() (*RawEvent, error) {
 	return &RawEvent{
-		Type:     EventTypeBind,
-		ClientId: string(e.ClientId),
-		TargetId: string(e.TargetId),
-		Message:  strconv.Itoa(e.Code),
+		Type:       EventTypeBind,
+		ClientId:   string(e.ClientId),
+		TargetId:   string(e.TargetId),
+		Message:    strconv.Itoa(e.Code),
+		Controller: e.Controller,
+		ConsentURL: e.ConsentURL,
 	}, nil
 }
 
+// EventControlActivity tells an observer client about a command a third party client has sent to a DG-LAB app the
+// observer is bound to.
+type EventControlActivity struct {
+	ClientId   ClientSecureId  `json:"clientId"`
+	TargetId   ClientSecureId  `json:"targetId"`
+	Controller *ClientMetadata `json:"controller"`
+	Command    Event           `json:"command"`
+}
+
+func (e *EventControlActivity) FromRawEvent(_ *RawEvent) error {
+	return fmt.Errorf("FromRawEvent should never be called for this event type")
+}
+
+func (e *EventControlActivity) ToRawEvent() (*RawEvent, error) {
+	rawEvent, err := e.Command.ToRawEvent()
+	if err != nil {
+		return nil, err
+	}
+	rawEvent.ClientId = string(e.ClientId)
+	rawEvent.TargetId = string(e.TargetId)
+	// an anonymous controller is described as an empty object, which tells control activity apart from reports
+	rawEvent.Controller = &ClientMetadata{}
+	if e.Controller != nil {
+		rawEvent.Controller = e.Controller
+	}
+	return rawEvent, nil
+}
+
 type EventBreak struct {
 	ClientId ClientSecureId `json:"clientId"`
 	TargetId ClientSecureId `json:"targetId"`
@@ -236,6 +303,9 @@ func (e *EventReportStrength) FromRawEvent(rawEvent *RawEvent) error {
 		return fmt.Errorf("invalid report strength data format: missing delimiter")
 	}
 	values := strings.Split(parts[1], "+")
+	if len(values) != 4 {
+		return fmt.Errorf("invalid report strength data format: unexpected number of values")
+	}
 	var err error
 	e.Strength.ChannelAValue, err = strconv.Atoi(values[0])
 	if err != nil {
@@ -291,6 +361,9 @@ func (e *EventAdjustStrength) FromRawEvent(rawEvent *RawEvent) error {
 		return fmt.Errorf("invalid strength data format: missing delimiter")
 	}
 	values := strings.Split(parts[1], "+")
+	if len(values) != 3 {
+		return fmt.Errorf("invalid strength data format: unexpected number of values")
+	}
 	var err error
 	channel, err := strconv.Atoi(values[0])
 	if err != nil {
@@ -306,6 +379,10 @@ func (e *EventAdjustStrength) FromRawEvent(rawEvent *RawEvent) error {
 	if err != nil {
 		return fmt.Errorf("error parsing data for adjust strength: %s", err)
 	}
+	// a negative decrease would raise the strength
+	if e.Strength.Value < 0 {
+		return fmt.Errorf("error parsing data for adjust strength: negative value %d", e.Strength.Value)
+	}
 	return nil
 }
 
@@ -336,15 +413,15 @@ type PulseSequence struct {
 func (e *EventExecutePulse) FromRawEvent(rawEvent *RawEvent) error {
 	e.ClientId = ClientSecureId(rawEvent.ClientId)
 	e.TargetId = ClientSecureId(rawEvent.TargetId)
-	values := strings.Split(rawEvent.Message, ":")
+	values := strings.SplitN(strings.TrimPrefix(rawEvent.Message, "pulse-"), ":", 2)
 	if len(values) != 2 {
 		return fmt.Errorf("invalid pulse data format: missing pulse sequence")
 	}
-	channel, err := strconv.Atoi(values[0])
+	channel, err := ParseChannelName(values[0])
 	if err != nil {
-		return fmt.Errorf("invalid pulse data format: failed to parse channel")
+		return fmt.Errorf("invalid pulse data format: %s", err)
 	}
-	e.Channel = Channel(channel)
+	e.Channel = channel
 	var pulseSequenceHexes []string
 	if err := json.Unmarshal([]byte(values[1]), &pulseSequenceHexes); err != nil {
 		return fmt.Errorf("invalid pulse data format: failed to parse pulse sequences as JSON")
@@ -385,7 +462,7 @@ func (e *EventExecutePulse) ToRawEvent() (*RawEvent, error) {
 		Type:     EventTypeMsg,
 		ClientId: string(e.ClientId),
 		TargetId: string(e.TargetId),
-		Message:  fmt.Sprintf("%d:%s", e.Channel, pulseSequencesJson),
+		Message:  fmt.Sprintf("pulse-%s:%s", e.Channel.Name(), pulseSequencesJson),
 	}, nil
 }
 
@@ -398,7 +475,7 @@ type EventStopPulse struct {
 func (e *EventStopPulse) FromRawEvent(rawEvent *RawEvent) error {
 	e.ClientId = ClientSecureId(rawEvent.ClientId)
 	e.TargetId = ClientSecureId(rawEvent.TargetId)
-	channel, err := strconv.Atoi(rawEvent.Message)
+	channel, err := strconv.Atoi(strings.TrimPrefix(rawEvent.Message, "clear-"))
 	if err != nil {
 		return err
 	}
@@ -438,7 +515,11 @@ const (
 func (e *EventReportFeedback) FromRawEvent(rawEvent *RawEvent) error {
 	e.ClientId = ClientSecureId(rawEvent.ClientId)
 	e.TargetId = ClientSecureId(rawEvent.TargetId)
-	button, err := strconv.Atoi(strings.Split(rawEvent.Message, "-")[1])
+	parts := strings.Split(rawEvent.Message, "-")
+	if len(parts) < 2 {
+		return fmt.Errorf("invalid feedback data format: missing delimiter")
+	}
+	button, err := strconv.Atoi(parts[1])
 	if err != nil {
 		return err
 	}
@@ -454,12 +535,3 @@ func (e *EventReportFeedback) ToRawEvent() (*RawEvent, error) {
 		Message:  fmt.Sprintf("feedback-%d", e.Button),
 	}, nil
 }
-
-func _() {
-	// ignore unused constants, should be removed after adding tests
-	_, _, _, _, _ = EventTypeHeartbeat, EventTypeBind, EventTypeMsg, EventTypeBreak, EventTypeError
-	_, _, _ = ChannelA, ChannelB, ChannelUnknown
-	_, _, _ = AdjustStrengthTypeDecrease, AdjustStrengthTypeIncrease, AdjustStrengthTypeSet
-	_, _, _, _, _ = ButtonIndexChannelA1, ButtonIndexChannelA2, ButtonIndexChannelA3, ButtonIndexChannelA4, ButtonIndexChannelA5
-	_, _, _, _, _ = ButtonIndexChannelB1, ButtonIndexChannelB2, ButtonIndexChannelB3, ButtonIndexChannelB4, ButtonIndexChannelB5
-}
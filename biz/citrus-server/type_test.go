@@ -0,0 +1,109 @@
+package citrus_server
+
+import (
+	"testing"
+)
+
+var rawEventSeeds = []string{
+	`{"type":"heartbeat","clientId":"c","targetId":"t","message":""}`,
+	`{"type":"bind","clientId":"c","targetId":"t","message":"DGLAB"}`,
+	`{"type":"bind","clientId":"c","targetId":"","message":"targetId"}`,
+	`{"type":"break","clientId":"c","targetId":"t","message":"209"}`,
+	`{"type":"error","clientId":"c","targetId":"t","message":"403"}`,
+	`{"type":"msg","clientId":"c","targetId":"t","message":"strength-1+2+20"}`,
+	`{"type":"msg","clientId":"c","targetId":"t","message":"strength-10+20+100+100"}`,
+	`{"type":"msg","clientId":"c","targetId":"t","message":"pulse-A:[\"0a0a0a0a64646464\",\"0A0A0A0A00000000\"]"}`,
+	`{"type":"msg","clientId":"c","targetId":"t","message":"clear-2"}`,
+	`{"type":"msg","clientId":"c","targetId":"t","message":"feedback-7"}`,
+	`{"type":"msg","clientId":"c","targetId":"t","message":"feedback"}`,
+	`{"type":"msg","clientId":"c","targetId":"t","message":"strength-"}`,
+	`{"type":"msg","clientId":"c","targetId":"t","message":"pulse-"}`,
+	`{"type":"msg","message":"strength++++"}`,
+	`{"type":"unknown"}`,
+	`not json`,
+}
+
+// FuzzRawEventCodec checks that decoding arbitrary client input never panics, and that every event which can be
+// decoded is encoded back into a raw event which decodes into the same event again.
+func FuzzRawEventCodec(f *testing.F) {
+	for _, seed := range rawEventSeeds {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		rawEvent := &RawEvent{}
+		if err := rawEvent.FromByteArray(data); err != nil {
+			return
+		}
+		event, err := rawEvent.ToEvent()
+		if err != nil {
+			return
+		}
+		encoded, err := event.ToRawEvent()
+		if err != nil {
+			return
+		}
+
+		bytes, err := encoded.ToByteArray()
+		if err != nil {
+			t.Fatalf("failed to serialize %+v: %v", encoded, err)
+		}
+		decoded := &RawEvent{}
+		if err := decoded.FromByteArray(bytes); err != nil {
+			t.Fatalf("failed to parse serialized event %q: %v", bytes, err)
+		}
+		if *decoded != *encoded {
+			t.Fatalf("serialization is not lossless:\n got: %+v\nwant: %+v", *decoded, *encoded)
+		}
+
+		reparsed, err := decoded.ToEvent()
+		if err != nil {
+			t.Fatalf("failed to parse encoded event %+v: %v", *decoded, err)
+		}
+		reencoded, err := reparsed.ToRawEvent()
+		if err != nil {
+			t.Fatalf("failed to encode reparsed event %+v: %v", reparsed, err)
+		}
+		if *reencoded != *encoded {
+			t.Fatalf("round trip is not stable:\n got: %+v\nwant: %+v", *reencoded, *encoded)
+		}
+	})
+}
+
+// FuzzRawEventParsers feeds arbitrary messages of every type directly into the parsers, bypassing the dispatch in
+// ToEvent, as malformed messages must be rejected with an error instead of a panic.
+func FuzzRawEventParsers(f *testing.F) {
+	for _, message := range []string{"", "-", "strength-1", "strength-1+2", "strength-1+0+-5", "feedback", "pulse-A", "pulse-C:[]", "clear-"} {
+		f.Add(message)
+	}
+	f.Fuzz(func(t *testing.T, message string) {
+		rawEvent := &RawEvent{Type: EventTypeMsg, ClientId: "c", TargetId: "t", Message: message}
+		events := []Event{
+			&EventHeartbeat{},
+			&EventBindToServer{},
+			&EventBindAppToThirdParty{},
+			&EventBindResult{},
+			&EventBreak{},
+			&EventError{},
+			&EventReportStrength{},
+			&EventAdjustStrength{},
+			&EventExecutePulse{},
+			&EventStopPulse{},
+			&EventReportFeedback{},
+		}
+		for _, event := range events {
+			_ = event.FromRawEvent(rawEvent)
+		}
+	})
+}
+
+func TestChannelName(t *testing.T) {
+	for _, channel := range []Channel{ChannelA, ChannelB} {
+		parsed, err := ParseChannelName(channel.Name())
+		if err != nil || parsed != channel {
+			t.Fatalf("channel %d does not round trip: %d, %v", channel, parsed, err)
+		}
+	}
+	if _, err := ParseChannelName("C"); err == nil {
+		t.Fatalf("expected an error for an unknown channel")
+	}
+}
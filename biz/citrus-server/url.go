@@ -0,0 +1,46 @@
+package citrus_server
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/tundrawork/DG-citrus/config"
+)
+
+// publicBaseURL is the address clients reach the server at, which may differ from the listen address behind a reverse
+// proxy or NAT, it is parsed from config.Conf.PublicBaseURL by Init.
+var publicBaseURL *url.URL
+
+// initPublicURL checks the configured public base URL.
+func initPublicURL() error {
+	base, err := url.Parse(config.Conf.PublicBaseURL)
+	if err != nil {
+		return fmt.Errorf("initPublicURL: invalid PublicBaseURL: %v", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return fmt.Errorf("initPublicURL: PublicBaseURL must start with http:// or https://, got %q", config.Conf.PublicBaseURL)
+	}
+	if base.Host == "" || base.RawQuery != "" || base.Fragment != "" {
+		return fmt.Errorf("initPublicURL: PublicBaseURL must have a host and no query or fragment, got %q", config.Conf.PublicBaseURL)
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawPath = ""
+	publicBaseURL = base
+	return nil
+}
+
+// publicURL returns the public address of the given path on this server, with the matching websocket scheme if
+// websocket is true.
+func publicURL(path string, websocket bool) string {
+	u := *publicBaseURL
+	u.Path += path
+	if websocket {
+		if u.Scheme == "https" {
+			u.Scheme = "wss"
+		} else {
+			u.Scheme = "ws"
+		}
+	}
+	return u.String()
+}
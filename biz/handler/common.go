@@ -12,5 +12,17 @@ import (
 func HomeHandler(ctx context.Context, c *app.RequestContext) {
 	c.HTML(http.StatusOK, "index.tmpl", utils.H{
 		"host": config.Conf.HostName,
+		// the page is also shown for failed websocket connections on other paths, so the link can not be relative
+		"dashboardPath":  config.Conf.PathPrefix + "/admin/dashboard",
+		"dashboard":      config.Conf.AdminPassword != "",
+		"controllerPath": config.Conf.PathPrefix + "/controller",
+	})
+}
+
+// ControllerHandler serves a web remote, which connects to the server as a third party websocket client.
+func ControllerHandler(ctx context.Context, c *app.RequestContext) {
+	c.HTML(http.StatusOK, "controller.tmpl", utils.H{
+		"apiKeyRequired":   len(config.Conf.APIKeys) > 0,
+		"approvalRequired": config.Conf.RequireBindingApproval,
 	})
 }
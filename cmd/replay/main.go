@@ -0,0 +1,254 @@
+// Command replay plays the commands of a recording made with RecordingDir back against a citrus server, acting as a
+// controller and keeping the original timing between the commands. The commands go to a real DG-LAB app scanning the
+// printed binding QR code, or to a simulated app which reports its strength like the real one.
+//
+//	go run ./cmd/replay -server http://localhost:6789 -simulate-app recordings/<client ID>.jsonl
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/tundrawork/DG-citrus/biz/citrus-server"
+)
+
+func main() {
+	serverURL := flag.String("server", "http://localhost:6789", "public base URL of the server, including its path prefix")
+	speed := flag.Float64("speed", 1, "playback speed, 2 plays the recording twice as fast")
+	simulateApp := flag.Bool("simulate-app", false, "bind a simulated DG-LAB app instead of waiting for a real one")
+	apiKey := flag.String("api-key", "", "API key to connect with, if the server requires one")
+	bindTimeout := flag.Duration("bind-timeout", 5*time.Minute, "how long to wait for a DG-LAB app to bind")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] <recording.jsonl>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 || *speed <= 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	commands, err := loadCommands(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("failed to load recording: %v", err)
+	}
+	if len(commands) == 0 {
+		log.Fatalf("the recording has no commands sent to DG-LAB apps")
+	}
+	log.Printf("loaded %d commands spanning %s", len(commands), commands[len(commands)-1].Time.Sub(commands[0].Time))
+
+	base, err := url.Parse(strings.TrimSuffix(*serverURL, "/"))
+	if err != nil {
+		log.Fatalf("invalid server URL: %v", err)
+	}
+	query := url.Values{"name": {"replay"}}
+	if *apiKey != "" {
+		query.Set("apiKey", *apiKey)
+	}
+	controller, err := dial(websocketURL(base, "/v1/ws", query))
+	if err != nil {
+		log.Fatalf("failed to connect as a controller: %v", err)
+	}
+	defer controller.Close()
+	hello, err := read(controller)
+	if err != nil || hello.Type != citrus_server.EventTypeBind || hello.Message != "targetId" {
+		log.Fatalf("unexpected first message from the server: %+v, %v", hello, err)
+	}
+	clientId := hello.ClientId
+	log.Printf("connected as controller %s", clientId)
+
+	appURL, err := requestBindingURL(base, clientId, *simulateApp)
+	if err != nil {
+		log.Fatalf("failed to request a binding QR code: %v", err)
+	}
+	if *simulateApp {
+		app, err := dial(appURL)
+		if err != nil {
+			log.Fatalf("failed to connect the simulated app: %v", err)
+		}
+		defer app.Close()
+		go runSimulatedApp(app, appURL[strings.LastIndex(appURL, "/")+1:])
+	}
+
+	deadline := time.Now().Add(*bindTimeout)
+	_ = controller.SetReadDeadline(deadline)
+	for {
+		event, err := read(controller)
+		if err != nil {
+			log.Fatalf("no DG-LAB app has bound: %v", err)
+		}
+		if event.Type == citrus_server.EventTypeBind && event.Message == "200" {
+			log.Printf("DG-LAB app %s is bound", event.TargetId)
+			break
+		}
+	}
+	_ = controller.SetReadDeadline(time.Time{})
+	go func() {
+		for {
+			event, err := read(controller)
+			if err != nil {
+				return
+			}
+			log.Printf("controller <- %s %s from %s", event.Type, event.Message, event.TargetId)
+		}
+	}()
+
+	start := time.Now()
+	for i, command := range commands {
+		offset := time.Duration(float64(command.Time.Sub(commands[0].Time)) / *speed)
+		time.Sleep(time.Until(start.Add(offset)))
+		message := citrus_server.RawEvent{Type: citrus_server.EventTypeMsg, ClientId: clientId, Message: command.Event.Message}
+		if err := controller.WriteJSON(message); err != nil {
+			log.Fatalf("failed to send command: %v", err)
+		}
+		log.Printf("[%d/%d] +%s controller -> %s", i+1, len(commands), offset.Round(time.Millisecond), message.Message)
+	}
+	// give the app a moment to report the strength after the last command
+	time.Sleep(time.Second)
+	_ = controller.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "replay finished"))
+}
+
+// loadCommands reads the commands sent to DG-LAB apps from a recording.
+func loadCommands(path string) ([]citrus_server.RecordedEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	events, err := citrus_server.ReadRecording(file)
+	if err != nil {
+		return nil, err
+	}
+	commands := make([]citrus_server.RecordedEvent, 0, len(events))
+	for _, event := range events {
+		if event.IsCommandToApp() {
+			commands = append(commands, event)
+		}
+	}
+	return commands, nil
+}
+
+func websocketURL(base *url.URL, path string, query url.Values) string {
+	u := *base
+	u.Scheme = map[string]string{"https": "wss"}[base.Scheme]
+	if u.Scheme == "" {
+		u.Scheme = "ws"
+	}
+	u.Path += path
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func dial(rawURL string) (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(rawURL, nil)
+	return conn, err
+}
+
+func read(conn *websocket.Conn) (*citrus_server.RawEvent, error) {
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	event := &citrus_server.RawEvent{}
+	if err := event.FromByteArray(data); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// requestBindingURL requests a bind token and returns the address a DG-LAB app connects to with it. Unless the app is
+// simulated, the QR code is printed for a real app to scan.
+func requestBindingURL(base *url.URL, clientId string, simulated bool) (string, error) {
+	query := url.Values{"clientId": {clientId}, "format": {"json"}, "name": {"replay"}}
+	resp, err := http.Get(base.String() + "/v1/bind?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Message string `json:"message"`
+		URL     string `json:"url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s", body.Message)
+	}
+	_, appURL, ok := strings.Cut(body.URL, "#"+citrus_server.DGAppWebsocketTag+"#")
+	if !ok {
+		return "", fmt.Errorf("unexpected binding payload %q", body.URL)
+	}
+	if !simulated {
+		query.Set("format", "txt")
+		resp, err := http.Get(base.String() + "/v1/bind?" + query.Encode())
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		fmt.Println("Scan this QR code with the DG-LAB app:")
+		_, _ = io.Copy(os.Stdout, resp.Body)
+	}
+	return appURL, nil
+}
+
+// runSimulatedApp behaves like a DG-LAB app bound with the given binding code, it applies strength adjustments and
+// reports the resulting strength, and logs the pulses it receives.
+func runSimulatedApp(conn *websocket.Conn, bindingCode string) {
+	strength := citrus_server.DataReportStrength{ChannelALimit: 200, ChannelBLimit: 200}
+	var appId string
+	for {
+		rawEvent, err := read(conn)
+		if err != nil {
+			return
+		}
+		if rawEvent.Type == citrus_server.EventTypeBind && rawEvent.Message == "targetId" {
+			appId = rawEvent.ClientId
+			continue
+		}
+		if rawEvent.ConsentURL != "" {
+			log.Printf("app: approve the binding on %s", rawEvent.ConsentURL)
+			continue
+		}
+		log.Printf("app <- %s %s", rawEvent.Type, rawEvent.Message)
+		event, err := rawEvent.ToEvent()
+		if err != nil {
+			continue
+		}
+		adjust, ok := event.(*citrus_server.EventAdjustStrength)
+		if !ok {
+			continue
+		}
+		value, limit := &strength.ChannelAValue, strength.ChannelALimit
+		if adjust.Strength.Channel == citrus_server.ChannelB {
+			value, limit = &strength.ChannelBValue, strength.ChannelBLimit
+		}
+		switch adjust.Strength.Type {
+		case citrus_server.AdjustStrengthTypeDecrease:
+			*value -= adjust.Strength.Value
+		case citrus_server.AdjustStrengthTypeIncrease:
+			*value += adjust.Strength.Value
+		case citrus_server.AdjustStrengthTypeSet:
+			*value = adjust.Strength.Value
+		}
+		*value = min(max(*value, 0), limit)
+		report := &citrus_server.EventReportStrength{
+			ClientId: citrus_server.ClientSecureId(bindingCode),
+			TargetId: citrus_server.ClientSecureId(appId),
+			Strength: strength,
+		}
+		message, _ := report.ToRawEvent()
+		if err := conn.WriteJSON(message); err != nil {
+			return
+		}
+	}
+}
@@ -1,6 +1,10 @@
 package config
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/cloudwego/hertz/pkg/common/hlog"
 	"github.com/knadh/koanf/parsers/yaml"
 	"github.com/knadh/koanf/providers/file"
@@ -14,10 +18,123 @@ var (
 )
 
 type Config struct {
-	HostName              string `yaml:"HostName"`
-	Port                  string `yaml:"Port"`
-	UseSecureWebsocket    bool   `yaml:"UseSecureWebsocket"`
-	AllowInsecureClientId bool   `yaml:"AllowInsecureClientId"`
+	HostName               string            `yaml:"HostName"`
+	Port                   string            `yaml:"Port"`
+	ListenAddress          string            `yaml:"ListenAddress"`
+	PublicBaseURL          string            `yaml:"PublicBaseURL"`
+	PathPrefix             string            `yaml:"PathPrefix"`
+	TrustedProxies         []string          `yaml:"TrustedProxies"`
+	RealIPHeaders          []string          `yaml:"RealIPHeaders"`
+	InsecureIdSalt         string            `yaml:"InsecureIdSalt"`
+	InsecureIdSaltRotation time.Duration     `yaml:"InsecureIdSaltRotation"`
+	UseSecureWebsocket     bool              `yaml:"UseSecureWebsocket"`
+	AllowInsecureClientId  bool              `yaml:"AllowInsecureClientId"`
+	StateFile              string            `yaml:"StateFile"`
+	ResumeGracePeriod      time.Duration     `yaml:"ResumeGracePeriod"`
+	BindTokenTTL           time.Duration     `yaml:"BindTokenTTL"`
+	RequireBindingApproval bool              `yaml:"RequireBindingApproval"`
+	LegacyBindingCodes     bool              `yaml:"LegacyBindingCodes"`
+	LegacyBindingScope     string            `yaml:"LegacyBindingScope"`
+	QRCode                 QRCode            `yaml:"QRCode"`
+	APIKeys                []APIKey          `yaml:"APIKeys"`
+	APIKeyFile             string            `yaml:"APIKeyFile"`
+	TLSCertFile            string            `yaml:"TLSCertFile"`
+	TLSKeyFile             string            `yaml:"TLSKeyFile"`
+	TLSSelfSigned          bool              `yaml:"TLSSelfSigned"`
+	MetricsToken           string            `yaml:"MetricsToken"`
+	AdminUsername          string            `yaml:"AdminUsername"`
+	AdminPassword          string            `yaml:"AdminPassword"`
+	LogFormat              string            `yaml:"LogFormat"`
+	LogLevel               string            `yaml:"LogLevel"`
+	LogLevels              map[string]string `yaml:"LogLevels"`
+	LogSecureIds           bool              `yaml:"LogSecureIds"`
+	AuditLogFile           string            `yaml:"AuditLogFile"`
+	AuditLogMaxSize        int64             `yaml:"AuditLogMaxSize"`
+	AuditLogMaxFiles       int               `yaml:"AuditLogMaxFiles"`
+	RecordingDir           string            `yaml:"RecordingDir"`
+	ShutdownTimeout        time.Duration     `yaml:"ShutdownTimeout"`
+}
+
+// TLSEnabled checks whether the server serves HTTPS and WSS itself, instead of relying on a reverse proxy.
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" || c.TLSKeyFile != "" || c.TLSSelfSigned
+}
+
+// APIKey authenticates third party clients on registration, if any API keys are configured, registering requires one.
+type APIKey struct {
+	Name string `yaml:"Name"`
+	Key  string `yaml:"Key"`
+	// Scopes limits which kinds of clients the key can register, it can register all kinds if empty
+	Scopes []string `yaml:"Scopes"`
+	// MaxClients and MaxBindings limit the clients registered with the key and their bindings, 0 means no limit
+	MaxClients  int `yaml:"MaxClients"`
+	MaxBindings int `yaml:"MaxBindings"`
+}
+
+// QRCode is the style of the binding QR codes.
+type QRCode struct {
+	BackgroundColor string `yaml:"BackgroundColor"`
+	ForegroundColor string `yaml:"ForegroundColor"`
+	Shape           string `yaml:"Shape"`
+	LogoFile        string `yaml:"LogoFile"`
+}
+
+// SetDefaults fills in the options which are not set.
+func (c *Config) SetDefaults() {
+	if c.ResumeGracePeriod == 0 {
+		c.ResumeGracePeriod = 5 * time.Minute
+	}
+	if c.BindTokenTTL == 0 {
+		c.BindTokenTTL = 5 * time.Minute
+	}
+	if c.LegacyBindingScope == "" {
+		c.LegacyBindingScope = "pulse-only"
+	}
+	if c.QRCode.BackgroundColor == "" {
+		c.QRCode.BackgroundColor = "#ffb6c1"
+	}
+	if c.QRCode.ForegroundColor == "" {
+		c.QRCode.ForegroundColor = "#000000"
+	}
+	if c.QRCode.Shape == "" {
+		c.QRCode.Shape = "circle"
+	}
+	if c.TLSEnabled() {
+		c.UseSecureWebsocket = true
+	}
+	if c.AuditLogMaxSize == 0 {
+		c.AuditLogMaxSize = 10 << 20
+	}
+	if c.AuditLogMaxFiles == 0 {
+		c.AuditLogMaxFiles = 5
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = 10 * time.Second
+	}
+	if c.AdminUsername == "" {
+		c.AdminUsername = "admin"
+	}
+	if c.ListenAddress == "" {
+		c.ListenAddress = ":" + c.Port
+	}
+	c.PathPrefix = strings.TrimSuffix(c.PathPrefix, "/")
+	if c.PathPrefix != "" && !strings.HasPrefix(c.PathPrefix, "/") {
+		c.PathPrefix = "/" + c.PathPrefix
+	}
+	if c.PublicBaseURL == "" {
+		scheme := "http"
+		if c.UseSecureWebsocket {
+			scheme = "https"
+		}
+		// the routes are served under the path prefix, so the default address has to include it as well
+		c.PublicBaseURL = fmt.Sprintf("%s://%s:%s%s", scheme, c.HostName, c.Port, c.PathPrefix)
+	}
+	if c.TrustedProxies == nil {
+		c.TrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+	}
+	if c.RealIPHeaders == nil {
+		c.RealIPHeaders = []string{"X-Forwarded-For", "X-Real-IP"}
+	}
 }
 
 func Init() {
@@ -27,4 +144,26 @@ func Init() {
 	if err := k.Unmarshal("", &Conf); err != nil {
 		hlog.Fatalf("error unmarshalling config: %v", err)
 	}
+	if Conf.APIKeyFile != "" {
+		keys, err := LoadAPIKeyFile(Conf.APIKeyFile)
+		if err != nil {
+			hlog.Fatalf("error loading API key file: %v", err)
+		}
+		Conf.APIKeys = append(Conf.APIKeys, keys...)
+	}
+	Conf.SetDefaults()
+}
+
+// LoadAPIKeyFile loads API keys from a separate file, which has an APIKeys list in the same format as config.yaml, so
+// that keys can be kept out of the main config.
+func LoadAPIKeyFile(path string) ([]APIKey, error) {
+	keyFile := koanf.New(".")
+	if err := keyFile.Load(file.Provider(path), yaml.Parser()); err != nil {
+		return nil, err
+	}
+	var keys []APIKey
+	if err := keyFile.Unmarshal("APIKeys", &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
 }
@@ -3,17 +3,65 @@
 package main
 
 import (
+	"flag"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/cloudwego/hertz/pkg/app/server"
+	hertzconfig "github.com/cloudwego/hertz/pkg/common/config"
+	"github.com/cloudwego/hertz/pkg/common/hlog"
+	"github.com/tundrawork/DG-citrus/biz/citrus-server"
 	"github.com/tundrawork/DG-citrus/config"
 )
 
 func main() {
+	rotateInsecureIdSalt := flag.Bool("rotate-insecure-id-salt", false, "rotate the salt of insecure client IDs in the state file and exit, the server must be stopped")
+	flag.Parse()
+
 	config.Init()
+	citrus_server.Init()
+	if *rotateInsecureIdSalt {
+		if err := citrus_server.RotateInsecureIdSalt(); err != nil {
+			hlog.Fatalf("failed to rotate the insecure ID salt: %v", err)
+		}
+		return
+	}
 
-	h := server.Default(server.WithHostPorts(":" + config.Conf.Port))
+	options := []hertzconfig.Option{
+		server.WithHostPorts(config.Conf.ListenAddress),
+		server.WithExitWaitTime(config.Conf.ShutdownTimeout),
+	}
+	tlsConfig, err := citrus_server.NewTLSConfig()
+	if err != nil {
+		hlog.Fatalf("failed to set up TLS: %v", err)
+	}
+	if tlsConfig != nil {
+		// hertz switches to the standard transport for TLS, as netpoll does not support it
+		options = append(options, server.WithTLS(tlsConfig))
+	}
+	h := server.Default(options...)
+	h.SetClientIPFunc(citrus_server.ClientIP)
+	h.Use(citrus_server.HTTPCorrelation, citrus_server.HTTPMetrics)
 	// https://github.com/cloudwego/hertz/issues/121
 	h.NoHijackConnPool = true
 	h.LoadHTMLGlob("resources/views/*")
 	register(h)
+	h.OnShutdown = append(h.OnShutdown, citrus_server.Shutdown)
+	h.SetCustomSignalWaiter(waitSignal)
 	h.Spin()
 }
+
+// waitSignal shuts the server down gracefully on SIGTERM as well as SIGINT, unlike the default of hertz which exits
+// immediately on SIGTERM, so that DG-LAB apps are stopped before their connections are closed.
+func waitSignal(errCh chan error) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		hlog.Infof("Received signal %s, shutting down", sig)
+		return nil
+	case err := <-errCh:
+		return err
+	}
+}